@@ -92,6 +92,10 @@ type MemoryBackend struct {
 	// A map of username and passwords that grant read and write access.
 	Credentials map[string]string
 
+	// CredentialStore can be set to verify credentials using a store of hashed
+	// passwords like a PasswordFile. If set, Credentials is ignored.
+	CredentialStore CredentialStore
+
 	// The Logger callback handles incoming log events.
 	Logger func(LogEvent, *Client, packet.Generic, *packet.Message, error)
 
@@ -119,6 +123,12 @@ func NewMemoryBackend() *MemoryBackend {
 
 // Authenticate will authenticates a clients credentials.
 func (m *MemoryBackend) Authenticate(client *Client, user, password string) (bool, error) {
+	// verify credentials before acquiring the mutex as hashing may be slow
+	var verified bool
+	if m.CredentialStore != nil {
+		verified = m.CredentialStore.Verify(user, password)
+	}
+
 	// acquire global mutex
 	m.globalMutex.Lock()
 	defer m.globalMutex.Unlock()
@@ -128,6 +138,11 @@ func (m *MemoryBackend) Authenticate(client *Client, user, password string) (boo
 		return false, ErrClosing
 	}
 
+	// use credential store if available
+	if m.CredentialStore != nil {
+		return verified, nil
+	}
+
 	// allow all if there are no credentials
 	if m.Credentials == nil {
 		return true, nil
@@ -187,8 +202,11 @@ func (m *MemoryBackend) Setup(client *Client, id string, clean bool) (Session, b
 
 	// kill existing client if session is taken
 	if ok && existingSession.owner != nil {
+		// get owner as it is reset during termination
+		owner := existingSession.owner
+
 		// close client
-		existingSession.owner.Close()
+		owner.Close()
 
 		// release global mutex to allow publish and termination, but leave the
 		// setup mutex to prevent setups
@@ -197,7 +215,7 @@ func (m *MemoryBackend) Setup(client *Client, id string, clean bool) (Session, b
 		// wait for client to close
 		var err error
 		select {
-		case <-existingSession.owner.Closed():
+		case <-owner.Closed():
 			// continue
 		case <-time.After(m.KillTimeout):
 			err = ErrKillTimeout
@@ -315,7 +333,13 @@ func (m *MemoryBackend) Unsubscribe(client *Client, topics []string, ack Ack) er
 	return nil
 }
 
-// Publish will handle retained messages and add the message to the session queues.
+// Publish will handle retained messages and add the message to the session
+// queues.
+//
+// The client may be nil if the message is not published on behalf of a client
+// e.g. by the Scheduler or a rules engine. Such publishes skip the detection of
+// deadlocks on the publishers own queue and wait for room in the queues of
+// online clients until they are closed.
 func (m *MemoryBackend) Publish(client *Client, msg *packet.Message, ack Ack) error {
 	// acquire global mutex
 	m.globalMutex.Lock()
@@ -351,10 +375,16 @@ func (m *MemoryBackend) Publish(client *Client, msg *packet.Message, ack Ack) er
 	// reset retained flag
 	msg.Retain = false
 
+	// get closed channel of the publishing client if available
+	var closed <-chan struct{}
+	if client != nil {
+		closed = client.Closed()
+	}
+
 	// add message to temporary sessions
 	for _, sess := range m.temporarySessions {
 		if sub := sess.lookupSubscription(msg.Topic); sub != nil {
-			if sess.owner == client {
+			if client != nil && sess.owner == client {
 				// detect deadlock when adding to own queue
 				select {
 				case queue(sess) <- msg:
@@ -366,7 +396,7 @@ func (m *MemoryBackend) Publish(client *Client, msg *packet.Message, ack Ack) er
 				select {
 				case queue(sess) <- msg:
 				case <-sess.owner.Closed():
-				case <-client.Closed():
+				case <-closed:
 				}
 			}
 		}
@@ -375,7 +405,7 @@ func (m *MemoryBackend) Publish(client *Client, msg *packet.Message, ack Ack) er
 	// add message to stored sessions
 	for _, sess := range m.storedSessions {
 		if sub := sess.lookupSubscription(msg.Topic); sub != nil {
-			if sess.owner == client {
+			if client != nil && sess.owner == client {
 				// detect deadlock when adding to own queue
 				select {
 				case queue(sess) <- msg:
@@ -387,7 +417,7 @@ func (m *MemoryBackend) Publish(client *Client, msg *packet.Message, ack Ack) er
 				select {
 				case queue(sess) <- msg:
 				case <-sess.owner.Closed():
-				case <-client.Closed():
+				case <-closed:
 				}
 			} else {
 				// ignore message if stored queue is full
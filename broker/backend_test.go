@@ -86,3 +86,92 @@ func TestMemoryBackendClose(t *testing.T) {
 
 	safeReceive(done)
 }
+
+func TestMemoryBackendPublishWithoutClient(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	wait := make(chan struct{})
+	var topics []string
+
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+
+		topics = append(topics, msg.Topic)
+		if len(topics) == 2 {
+			close(wait)
+		}
+
+		return nil
+	}
+
+	cf, err := c.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("foo/#", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	acked := false
+	err = backend.Publish(nil, &packet.Message{Topic: "foo/1", Payload: []byte("1")}, func() {
+		acked = true
+	})
+	assert.NoError(t, err)
+	assert.True(t, acked)
+
+	err = backend.Publish(nil, &packet.Message{Topic: "foo/2", Payload: []byte("2"), QOS: 1, Retain: true}, nil)
+	assert.NoError(t, err)
+
+	safeReceive(wait)
+
+	assert.ElementsMatch(t, []string{"foo/1", "foo/2"}, topics)
+	assert.Len(t, backend.retainedMessages.All(), 1)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
+
+func TestMemoryBackendTakeover(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	options := client.NewConfigWithClientID("tcp://localhost:"+port, "takeover")
+	options.CleanSession = false
+
+	var clients []*client.Client
+
+	for i := 0; i < 50; i++ {
+		c := client.New()
+		c.Callback = func(msg *packet.Message, err error) error {
+			return nil
+		}
+
+		// the previous client is terminated concurrently to the setup which
+		// resets the session owner (run with -race to detect regressions)
+		cf, err := c.Connect(options)
+		assert.NoError(t, err)
+		assert.NoError(t, cf.Wait(10*time.Second))
+		assert.Equal(t, packet.ConnectionAccepted, cf.ReturnCode())
+
+		clients = append(clients, c)
+	}
+
+	err := clients[len(clients)-1].Disconnect()
+	assert.NoError(t, err)
+
+	for _, c := range clients[:len(clients)-1] {
+		_ = c.Close()
+	}
+
+	close(quit)
+
+	safeReceive(done)
+}
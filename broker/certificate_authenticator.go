@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"crypto/x509"
+)
+
+// CertificateNames returns the names of a certificate that may identify a
+// client. These are the subject common name followed by all DNS, email and
+// URI subject alternative names.
+func CertificateNames(cert *x509.Certificate) []string {
+	// prepare list
+	var names []string
+
+	// add common name
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+
+	// add alternative names
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
+
+// A CertificateAuthenticator wraps a Backend and authenticates clients using
+// the verified TLS client certificate of their connection. All other calls are
+// forwarded to the wrapped Backend.
+type CertificateAuthenticator struct {
+	Backend
+
+	// Names returns the names of the client certificate that are matched
+	// against the username and client id.
+	//
+	// Will default to CertificateNames.
+	Names func(*x509.Certificate) []string
+
+	// Mapping can be set to translate certificate names to usernames. Names
+	// that are not contained in the map are used as is.
+	Mapping map[string]string
+
+	// Require will reject clients that did not present a verified certificate.
+	// Otherwise, such clients are authenticated by the wrapped Backend.
+	Require bool
+
+	// MatchUsername requires that the client supplied a username that matches
+	// one of the certificate names.
+	MatchUsername bool
+
+	// MatchClientID requires that the client id matches one of the certificate
+	// names.
+	MatchClientID bool
+
+	// AllowNoPassword will accept clients with a matching certificate that did
+	// not supply a password. Otherwise, the credentials are additionally checked
+	// by the wrapped Backend.
+	AllowNoPassword bool
+}
+
+// NewCertificateAuthenticator returns a new CertificateAuthenticator that wraps
+// the provided Backend.
+func NewCertificateAuthenticator(backend Backend) *CertificateAuthenticator {
+	return &CertificateAuthenticator{
+		Backend:       backend,
+		Names:         CertificateNames,
+		MatchUsername: true,
+	}
+}
+
+// Authenticate will authenticate the client using its certificate.
+func (a *CertificateAuthenticator) Authenticate(client *Client, user, password string) (bool, error) {
+	// get certificate chain
+	chain := client.Conn().PeerCertificates()
+	if len(chain) == 0 {
+		// reject if required
+		if a.Require {
+			return false, nil
+		}
+
+		return a.Backend.Authenticate(client, user, password)
+	}
+
+	// get names
+	names := a.Identities(chain[0])
+	if len(names) == 0 {
+		return false, nil
+	}
+
+	// check username
+	if a.MatchUsername && (user == "" || !containsString(names, user)) {
+		return false, nil
+	}
+
+	// check client id
+	if a.MatchClientID && !containsString(names, client.ID()) {
+		return false, nil
+	}
+
+	// allow missing password if enabled
+	if a.AllowNoPassword && password == "" {
+		return true, nil
+	}
+
+	return a.Backend.Authenticate(client, user, password)
+}
+
+// Identities returns the mapped names of the provided certificate.
+func (a *CertificateAuthenticator) Identities(cert *x509.Certificate) []string {
+	// get names function
+	fn := a.Names
+	if fn == nil {
+		fn = CertificateNames
+	}
+
+	// get names
+	names := fn(cert)
+
+	// map names without modifying the returned list
+	mapped := make([]string, len(names))
+	for i, name := range names {
+		if m, ok := a.Mapping[name]; ok {
+			mapped[i] = m
+		} else {
+			mapped[i] = name
+		}
+	}
+
+	return mapped
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificateNames(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "device1"},
+		DNSNames:       []string{"device1.example.com"},
+		EmailAddresses: []string{"device1@example.com"},
+	}
+
+	assert.Equal(t, []string{
+		"device1",
+		"device1.example.com",
+		"device1@example.com",
+	}, CertificateNames(cert))
+}
+
+func TestCertificateAuthenticator(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Credentials = map[string]string{
+		"device1": "secret",
+	}
+
+	auth := NewCertificateAuthenticator(backend)
+
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "device1"},
+	}
+
+	// without certificate
+	ok, err := auth.Authenticate(fakeClient("c1"), "device1", "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// matching username and password
+	ok, err = auth.Authenticate(fakeClient("c1", cert), "device1", "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// mismatching username
+	ok, err = auth.Authenticate(fakeClient("c1", cert), "device2", "secret")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// missing password
+	ok, err = auth.Authenticate(fakeClient("c1", cert), "", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	auth.AllowNoPassword = true
+
+	ok, err = auth.Authenticate(fakeClient("c1", cert), "device1", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// missing username
+	ok, err = auth.Authenticate(fakeClient("c1", cert), "", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	auth.MatchUsername = false
+
+	ok, err = auth.Authenticate(fakeClient("c1", cert), "", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	auth.MatchClientID = true
+
+	ok, err = auth.Authenticate(fakeClient("c1", cert), "", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = auth.Authenticate(fakeClient("device1", cert), "", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	auth.Require = true
+
+	ok, err = auth.Authenticate(fakeClient("device1"), "device1", "secret")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCertificateAuthenticatorMapping(t *testing.T) {
+	auth := NewCertificateAuthenticator(NewMemoryBackend())
+	auth.Mapping = map[string]string{
+		"device1.example.com": "device1",
+	}
+	auth.AllowNoPassword = true
+
+	cert := &x509.Certificate{
+		DNSNames: []string{"device1.example.com"},
+	}
+
+	ok, err := auth.Authenticate(fakeClient("c1", cert), "device1", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = auth.Authenticate(fakeClient("c1", &x509.Certificate{}), "device1", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCertificateAuthenticatorMappingCopy(t *testing.T) {
+	names := []string{"device1.example.com"}
+
+	auth := NewCertificateAuthenticator(NewMemoryBackend())
+	auth.Names = func(*x509.Certificate) []string {
+		return names
+	}
+	auth.Mapping = map[string]string{
+		"device1.example.com": "device1",
+	}
+
+	assert.Equal(t, []string{"device1"}, auth.Identities(&x509.Certificate{}))
+	assert.Equal(t, []string{"device1.example.com"}, names)
+}
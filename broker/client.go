@@ -294,14 +294,19 @@ func (c *Client) ID() string {
 }
 
 // Conn returns the client's underlying connection. Calls to SetReadLimit,
-// LocalAddr and RemoteAddr are safe.
+// LocalAddr and RemoteAddr are safe. It returns nil for in-process clients
+// created by MemoryBackend.SubscribeFunc and MemoryBackend.SubscribeChan.
 func (c *Client) Conn() transport.Conn {
 	return c.conn
 }
 
 // Close will immediately close the client.
 func (c *Client) Close() {
-	_ = c.conn.Close()
+	// close connection if available
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+
 	c.tomb.Kill(ErrClientClosed)
 }
 
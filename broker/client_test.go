@@ -176,3 +176,54 @@ func TestClientTokenTimeoutDequeue(t *testing.T) {
 
 	safeReceive(done)
 }
+
+func TestClientKeepAliveHungConnection(t *testing.T) {
+	errs := make(chan error, 1)
+
+	backend := NewMemoryBackend()
+	backend.Logger = func(event LogEvent, client *Client, pkt packet.Generic, msg *packet.Message, err error) {
+		if event == TransportError {
+			select {
+			case errs <- err:
+			default:
+			}
+		}
+	}
+
+	engine := NewEngine(backend)
+
+	server, err := transport.Launch("tcp://localhost:0")
+	assert.NoError(t, err)
+
+	// hang the connection after the connect and connack packets
+	engine.Accept(transport.NewFaultServer(server, transport.FaultConfig{
+		HangAfterPackets: 2,
+	}))
+
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		return nil
+	}
+
+	options := client.NewConfig("tcp://" + server.Addr().String())
+	options.KeepAlive = "1s"
+
+	cf, err := c.Connect(options)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	// the client keeps pinging while the broker times out
+	start := time.Now()
+	select {
+	case err := <-errs:
+		netErr, ok := err.(interface{ Timeout() bool })
+		assert.True(t, ok && netErr.Timeout())
+		assert.True(t, time.Since(start) < 3*time.Second)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	_ = c.Close()
+	_ = server.Close()
+	engine.Close()
+}
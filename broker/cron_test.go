@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	start := time.Date(2019, 3, 15, 10, 30, 20, 0, time.UTC) // friday
+
+	table := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2019, 3, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2019, 3, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 22 * * *", time.Date(2019, 3, 15, 22, 0, 0, 0, time.UTC)},
+		{"0 8 * * *", time.Date(2019, 3, 16, 8, 0, 0, 0, time.UTC)},
+		{"0 8-18 * * 1-5", time.Date(2019, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1", time.Date(2019, 3, 18, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2019, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"30 12 1,15 * *", time.Date(2019, 3, 15, 12, 30, 0, 0, time.UTC)},
+		{"30 9 1,15 * *", time.Date(2019, 4, 1, 9, 30, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2019, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, item := range table {
+		cron, err := ParseCron(item.spec)
+		require.NoError(t, err, item.spec)
+		assert.Equal(t, item.next, cron.Next(start), item.spec)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+	} {
+		_, err := ParseCron(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,485 @@
+package broker
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/qingcloudhx/gomqtt/topic"
+)
+
+// ErrInvalidReplay is returned if a replay subscription is malformed.
+var ErrInvalidReplay = errors.New("invalid replay subscription")
+
+// A JournalEntry is a message stored in a journal.
+type JournalEntry struct {
+	// The monotonically increasing offset of the entry.
+	Offset uint64
+
+	// The time the message has been published.
+	Time time.Time
+
+	// The stored message.
+	Message *packet.Message
+}
+
+type journal struct {
+	filter  string
+	entries []JournalEntry
+	next    uint64
+	bytes   int
+}
+
+// A Journal wraps a Backend and stores published messages that match one of
+// the configured topic filters with increasing offsets. Subscribers may request
+// the replay of stored messages by subscribing to a topic filter with the
+// replay prefix:
+//
+//	$replay/<offset>/<filter>
+//	$replay/@<unix seconds>/<filter>
+//
+// Stored messages of the first journal that covers the filter and that have
+// an equal or greater offset or have been published at or after the specified
+// time are delivered before any live messages. If no journal covers the
+// filter, only live messages are delivered. Messages are stored before they
+// are forwarded and may therefore be delivered twice to concurrent replay
+// subscriptions. All calls are forwarded to the wrapped Backend.
+type Journal struct {
+	Backend
+
+	// The topic filters that select the journaled messages. Every filter has
+	// its own journal and offsets.
+	Filters []string
+
+	// The maximum number of messages stored per journal.
+	//
+	// Will default to 10000.
+	MaxMessages int
+
+	// The maximum total payload size in bytes stored per journal. No limit is
+	// applied if zero.
+	MaxBytes int
+
+	// The maximum age of stored messages. No limit is applied if zero.
+	MaxAge time.Duration
+
+	// The prefix that denotes replay subscriptions.
+	//
+	// Will default to "$replay/".
+	Prefix string
+
+	journals []*journal
+	replays  map[*Client]*journalReplay
+	mutex    sync.Mutex
+	rMutex   sync.Mutex
+	once     sync.Once
+}
+
+type journalReplay struct {
+	messages []*packet.Message
+	notify   chan struct{}
+	pending  chan journalDequeue
+	live     *journalDequeue
+}
+
+type journalDequeue struct {
+	msg *packet.Message
+	ack Ack
+	err error
+}
+
+// NewJournal returns a new Journal that wraps the provided Backend and stores
+// messages that match the specified topic filters.
+func NewJournal(backend Backend, filters ...string) *Journal {
+	return &Journal{
+		Backend:     backend,
+		Filters:     filters,
+		MaxMessages: 10000,
+		Prefix:      "$replay/",
+	}
+}
+
+// Read returns the stored messages of the journal with the specified filter
+// starting from the provided offset.
+func (j *Journal) Read(filter string, offset uint64) []JournalEntry {
+	// ensure defaults
+	j.start()
+
+	// acquire mutex
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	// find journal
+	for _, jr := range j.prepare() {
+		if jr.filter == filter {
+			return append([]JournalEntry(nil), j.read(jr, offset, time.Time{})...)
+		}
+	}
+
+	return nil
+}
+
+// ReadSince returns the stored messages of the journal with the specified
+// filter that have been published at or after the provided time.
+func (j *Journal) ReadSince(filter string, since time.Time) []JournalEntry {
+	// ensure defaults
+	j.start()
+
+	// acquire mutex
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	// find journal
+	for _, jr := range j.prepare() {
+		if jr.filter == filter {
+			return append([]JournalEntry(nil), j.read(jr, 0, since)...)
+		}
+	}
+
+	return nil
+}
+
+// Subscribe will translate replay subscriptions and queue the stored messages
+// after forwarding the call.
+func (j *Journal) Subscribe(client *Client, subs []packet.Subscription, ack Ack) error {
+	// ensure defaults
+	j.start()
+
+	// translate replay subscriptions
+	type request struct {
+		sub    packet.Subscription
+		offset uint64
+		since  time.Time
+	}
+	var requests []request
+	translated := make([]packet.Subscription, 0, len(subs))
+	for _, sub := range subs {
+		// check prefix
+		if !strings.HasPrefix(sub.Topic, j.Prefix) {
+			translated = append(translated, sub)
+			continue
+		}
+
+		// parse replay subscription
+		filter, offset, since, err := j.parse(sub.Topic)
+		if err != nil {
+			return err
+		}
+
+		// add request
+		sub.Topic = filter
+		translated = append(translated, sub)
+		requests = append(requests, request{sub: sub, offset: offset, since: since})
+	}
+
+	// forward call directly if no replay has been requested
+	if len(requests) == 0 {
+		return j.Backend.Subscribe(client, subs, ack)
+	}
+
+	// acquire mutex to prevent concurrent publishes
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	// forward call
+	err := j.Backend.Subscribe(client, translated, ack)
+	if err != nil {
+		return err
+	}
+
+	// collect stored messages
+	var messages []*packet.Message
+	for _, req := range requests {
+		// find first covering journal
+		for _, jr := range j.prepare() {
+			if !covers(jr.filter, req.sub.Topic) {
+				continue
+			}
+
+			// prepare tree
+			tree := topic.NewTree()
+			tree.Set(req.sub.Topic, true)
+
+			// add matching entries
+			for _, entry := range j.read(jr, req.offset, req.since) {
+				if tree.MatchFirst(entry.Message.Topic) == nil {
+					continue
+				}
+
+				// apply qos
+				msg := entry.Message.Copy()
+				if msg.QOS > req.sub.QOS {
+					msg.QOS = req.sub.QOS
+				}
+
+				messages = append(messages, msg)
+			}
+
+			break
+		}
+	}
+
+	// queue messages
+	if len(messages) > 0 {
+		j.rMutex.Lock()
+		r := j.replay(client)
+		r.messages = append(r.messages, messages...)
+		j.rMutex.Unlock()
+
+		// notify dequeue
+		select {
+		case r.notify <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Unsubscribe will translate replay subscriptions before forwarding the call.
+func (j *Journal) Unsubscribe(client *Client, topics []string, ack Ack) error {
+	// ensure defaults
+	j.start()
+
+	// translate topics
+	translated := make([]string, 0, len(topics))
+	for _, t := range topics {
+		if strings.HasPrefix(t, j.Prefix) {
+			filter, _, _, err := j.parse(t)
+			if err == nil {
+				t = filter
+			}
+		}
+
+		translated = append(translated, t)
+	}
+
+	return j.Backend.Unsubscribe(client, translated, ack)
+}
+
+// Publish will store the message in all matching journals before forwarding
+// the call.
+func (j *Journal) Publish(client *Client, msg *packet.Message, ack Ack) error {
+	// ensure defaults
+	j.start()
+
+	// acquire mutex
+	j.mutex.Lock()
+
+	// append message to matching journals
+	var stored *packet.Message
+	var now time.Time
+	for _, jr := range j.prepare() {
+		if !covers(jr.filter, msg.Topic) {
+			continue
+		}
+
+		// copy message before it is modified by the backend
+		if stored == nil {
+			stored = msg.Copy()
+			stored.Retain = false
+			now = time.Now()
+		}
+
+		j.append(jr, stored, now)
+	}
+
+	// release mutex
+	j.mutex.Unlock()
+
+	return j.Backend.Publish(client, msg, ack)
+}
+
+// Dequeue will return queued replay messages before forwarding the call.
+func (j *Journal) Dequeue(client *Client) (*packet.Message, Ack, error) {
+	for {
+		// acquire mutex
+		j.rMutex.Lock()
+
+		// get replay
+		r := j.replay(client)
+
+		// return next replay message
+		if len(r.messages) > 0 {
+			msg := r.messages[0]
+			r.messages[0] = nil
+			r.messages = r.messages[1:]
+			j.rMutex.Unlock()
+			return msg, nil, nil
+		}
+
+		// return live message that has been held back
+		if r.live != nil {
+			res := r.live
+			r.live = nil
+			j.rMutex.Unlock()
+			return res.msg, res.ack, res.err
+		}
+
+		// forward call in the background if not already pending
+		if r.pending == nil {
+			pending := make(chan journalDequeue, 1)
+			r.pending = pending
+
+			go func() {
+				msg, ack, err := j.Backend.Dequeue(client)
+				pending <- journalDequeue{msg: msg, ack: ack, err: err}
+			}()
+		}
+
+		// get pending
+		pending := r.pending
+
+		// release mutex
+		j.rMutex.Unlock()
+
+		// wait for result or replay messages, the wrapped backend returns
+		// when the client is closing
+		select {
+		case res := <-pending:
+			j.rMutex.Lock()
+			r.pending = nil
+
+			// hold back live message if replay messages have been queued
+			if len(r.messages) > 0 {
+				r.live = &res
+				j.rMutex.Unlock()
+				continue
+			}
+
+			j.rMutex.Unlock()
+
+			return res.msg, res.ack, res.err
+		case <-r.notify:
+		}
+	}
+}
+
+// Terminate will remove queued replay messages before forwarding the call.
+func (j *Journal) Terminate(client *Client) error {
+	// remove replay
+	j.rMutex.Lock()
+	delete(j.replays, client)
+	j.rMutex.Unlock()
+
+	return j.Backend.Terminate(client)
+}
+
+func (j *Journal) start() {
+	j.once.Do(func() {
+		// apply defaults
+		if j.MaxMessages <= 0 {
+			j.MaxMessages = 10000
+		}
+		if j.Prefix == "" {
+			j.Prefix = "$replay/"
+		}
+	})
+}
+
+func (j *Journal) parse(subscription string) (string, uint64, time.Time, error) {
+	// split subscription
+	segments := strings.SplitN(strings.TrimPrefix(subscription, j.Prefix), "/", 2)
+	if len(segments) != 2 || segments[1] == "" {
+		return "", 0, time.Time{}, ErrInvalidReplay
+	}
+
+	// parse time
+	if strings.HasPrefix(segments[0], "@") {
+		seconds, err := strconv.ParseInt(segments[0][1:], 10, 64)
+		if err != nil {
+			return "", 0, time.Time{}, ErrInvalidReplay
+		}
+
+		return segments[1], 0, time.Unix(seconds, 0), nil
+	}
+
+	// parse offset
+	offset, err := strconv.ParseUint(segments[0], 10, 64)
+	if err != nil {
+		return "", 0, time.Time{}, ErrInvalidReplay
+	}
+
+	return segments[1], offset, time.Time{}, nil
+}
+
+func (j *Journal) prepare() []*journal {
+	// create journals
+	if j.journals == nil {
+		j.journals = make([]*journal, 0, len(j.Filters))
+		for _, filter := range j.Filters {
+			j.journals = append(j.journals, &journal{
+				filter: filter,
+				next:   1,
+			})
+		}
+	}
+
+	return j.journals
+}
+
+func (j *Journal) append(jr *journal, msg *packet.Message, now time.Time) {
+	// add entry
+	jr.entries = append(jr.entries, JournalEntry{
+		Offset:  jr.next,
+		Time:    now,
+		Message: msg,
+	})
+	jr.next++
+	jr.bytes += len(msg.Payload)
+
+	// remove entries that exceed the limits
+	j.trim(jr, now)
+}
+
+func (j *Journal) trim(jr *journal, now time.Time) {
+	// remove oldest entries while a limit is exceeded
+	for len(jr.entries) > 0 {
+		entry := jr.entries[0]
+		if (j.MaxMessages <= 0 || len(jr.entries) <= j.MaxMessages) &&
+			(j.MaxBytes <= 0 || jr.bytes <= j.MaxBytes) &&
+			(j.MaxAge <= 0 || now.Sub(entry.Time) <= j.MaxAge) {
+			break
+		}
+
+		jr.bytes -= len(entry.Message.Payload)
+		jr.entries[0] = JournalEntry{}
+		jr.entries = jr.entries[1:]
+	}
+}
+
+func (j *Journal) read(jr *journal, offset uint64, since time.Time) []JournalEntry {
+	// remove expired entries
+	j.trim(jr, time.Now())
+
+	// find first entry
+	for i, entry := range jr.entries {
+		if entry.Offset >= offset && !entry.Time.Before(since) {
+			return jr.entries[i:]
+		}
+	}
+
+	return nil
+}
+
+func (j *Journal) replay(client *Client) *journalReplay {
+	// ensure map
+	if j.replays == nil {
+		j.replays = make(map[*Client]*journalReplay)
+	}
+
+	// get or create replay
+	r, ok := j.replays[client]
+	if !ok {
+		r = &journalReplay{
+			notify: make(chan struct{}, 1),
+		}
+
+		j.replays[client] = r
+	}
+
+	return r
+}
@@ -0,0 +1,216 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/client"
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	backend := NewMemoryBackend()
+	journal := NewJournal(backend, "foo/#")
+
+	port, quit, done := Run(NewEngine(journal), "tcp")
+
+	publisher := client.New()
+
+	cf, err := publisher.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	for _, topic := range []string{"foo/1", "bar", "foo/2", "foo/3"} {
+		pf, err := publisher.Publish(topic, []byte(topic), 1, false)
+		assert.NoError(t, err)
+		assert.NoError(t, pf.Wait(10*time.Second))
+	}
+
+	entries := journal.Read("foo/#", 0)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, uint64(1), entries[0].Offset)
+	assert.Equal(t, uint64(3), entries[2].Offset)
+
+	var topics []string
+	wait := make(chan struct{})
+
+	subscriber := client.New()
+	subscriber.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		assert.Equal(t, packet.QOS(0), msg.QOS)
+
+		topics = append(topics, msg.Topic)
+		if len(topics) == 3 {
+			close(wait)
+		}
+
+		return nil
+	}
+
+	cf, err = subscriber.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := subscriber.Subscribe("$replay/2/foo/+", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := publisher.Publish("foo/4", []byte("foo/4"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	safeReceive(wait)
+
+	assert.Equal(t, []string{"foo/2", "foo/3", "foo/4"}, topics)
+
+	uf, err := subscriber.Unsubscribe("$replay/2/foo/+")
+	assert.NoError(t, err)
+	assert.NoError(t, uf.Wait(10*time.Second))
+
+	err = subscriber.Disconnect()
+	assert.NoError(t, err)
+
+	err = publisher.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
+
+func TestJournalLimits(t *testing.T) {
+	journal := NewJournal(NewMemoryBackend(), "foo", "bar")
+	journal.MaxMessages = 3
+	journal.MaxBytes = 10
+
+	c := fakeClient("c1")
+
+	for i := 0; i < 5; i++ {
+		err := journal.Publish(c, &packet.Message{Topic: "foo", Payload: []byte("x")}, nil)
+		assert.NoError(t, err)
+	}
+
+	entries := journal.Read("foo", 0)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, uint64(3), entries[0].Offset)
+	assert.Equal(t, uint64(5), entries[2].Offset)
+
+	assert.Len(t, journal.Read("foo", 5), 1)
+	assert.Empty(t, journal.Read("foo", 6))
+	assert.Empty(t, journal.Read("baz", 0))
+
+	for i := 0; i < 3; i++ {
+		err := journal.Publish(c, &packet.Message{Topic: "bar", Payload: []byte("xxxx")}, nil)
+		assert.NoError(t, err)
+	}
+
+	entries = journal.Read("bar", 0)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, uint64(2), entries[0].Offset)
+
+	journal.MaxAge = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+
+	err := journal.Publish(c, &packet.Message{Topic: "foo", Payload: []byte("x")}, nil)
+	assert.NoError(t, err)
+
+	entries = journal.ReadSince("foo", time.Now().Add(-time.Second))
+	assert.Len(t, entries, 1)
+	assert.Equal(t, uint64(6), entries[0].Offset)
+
+	assert.Empty(t, journal.ReadSince("foo", time.Now().Add(time.Second)))
+	assert.Empty(t, journal.Read("bar", 0))
+}
+
+func TestJournalParse(t *testing.T) {
+	journal := NewJournal(NewMemoryBackend())
+
+	filter, offset, since, err := journal.parse("$replay/42/foo/#")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo/#", filter)
+	assert.Equal(t, uint64(42), offset)
+	assert.True(t, since.IsZero())
+
+	filter, offset, since, err = journal.parse("$replay/@1500000000/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", filter)
+	assert.Equal(t, uint64(0), offset)
+	assert.Equal(t, time.Unix(1500000000, 0), since)
+
+	for _, sub := range []string{"$replay/", "$replay/1", "$replay/1/", "$replay/x/foo", "$replay/@x/foo"} {
+		_, _, _, err = journal.parse(sub)
+		assert.Equal(t, ErrInvalidReplay, err, sub)
+	}
+}
+
+func TestJournalZeroValue(t *testing.T) {
+	journal := &Journal{
+		Backend: NewMemoryBackend(),
+		Filters: []string{"foo/#"},
+	}
+
+	port, quit, done := Run(NewEngine(journal), "tcp")
+
+	publisher := client.New()
+
+	cf, err := publisher.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	for _, topic := range []string{"foo/1", "foo/2"} {
+		pf, err := publisher.Publish(topic, []byte(topic), 1, false)
+		assert.NoError(t, err)
+		assert.NoError(t, pf.Wait(10*time.Second))
+	}
+
+	var topics []string
+	wait := make(chan struct{})
+
+	subscriber := client.New()
+	subscriber.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+
+		topics = append(topics, msg.Topic)
+		if len(topics) == 4 {
+			close(wait)
+		}
+
+		return nil
+	}
+
+	cf, err = subscriber.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := subscriber.Subscribe("bar", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	sf, err = subscriber.Subscribe("$replay/1/foo/#", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	for _, topic := range []string{"foo/3", "bar"} {
+		pf, err := publisher.Publish(topic, []byte(topic), 1, false)
+		assert.NoError(t, err)
+		assert.NoError(t, pf.Wait(10*time.Second))
+	}
+
+	safeReceive(wait)
+
+	assert.Equal(t, []string{"foo/1", "foo/2", "foo/3", "bar"}, topics)
+	assert.Equal(t, 10000, journal.MaxMessages)
+	assert.Equal(t, "$replay/", journal.Prefix)
+
+	err = subscriber.Disconnect()
+	assert.NoError(t, err)
+
+	err = publisher.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
@@ -0,0 +1,318 @@
+package broker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hash
+	_ "crypto/sha512" // register hash
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned if a token is malformed or its signature cannot
+// be verified.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrTokenExpired is returned if a token has expired or is not yet valid.
+var ErrTokenExpired = errors.New("token expired")
+
+// JWTClaims holds the decoded claims of a verified token.
+type JWTClaims map[string]interface{}
+
+// String returns the string claim with the specified name.
+func (c JWTClaims) String(name string) (string, bool) {
+	str, ok := c[name].(string)
+	return str, ok
+}
+
+// Strings returns the claim with the specified name as a list of strings. A
+// single string is returned as a list with one entry.
+func (c JWTClaims) Strings(name string) ([]string, bool) {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}, true
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			str, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+
+			list = append(list, str)
+		}
+
+		return list, true
+	}
+
+	return nil, false
+}
+
+// Time returns the numeric date claim with the specified name.
+func (c JWTClaims) Time(name string) (time.Time, bool) {
+	num, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	sec := int64(num)
+	return time.Unix(sec, int64((num-float64(sec))*float64(time.Second))), true
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jwtAlgorithm struct {
+	hash   crypto.Hash
+	family string
+}
+
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"HS256": {crypto.SHA256, "HS"},
+	"HS384": {crypto.SHA384, "HS"},
+	"HS512": {crypto.SHA512, "HS"},
+	"RS256": {crypto.SHA256, "RS"},
+	"RS384": {crypto.SHA384, "RS"},
+	"RS512": {crypto.SHA512, "RS"},
+	"PS256": {crypto.SHA256, "PS"},
+	"PS384": {crypto.SHA384, "PS"},
+	"PS512": {crypto.SHA512, "PS"},
+	"ES256": {crypto.SHA256, "ES"},
+	"ES384": {crypto.SHA384, "ES"},
+	"ES512": {crypto.SHA512, "ES"},
+}
+
+// VerifyJWT will verify the signature of the provided token using the keys and
+// return its claims. Keys are indexed by their key id and may be a []byte for
+// HMAC, a *rsa.PublicKey or an *ecdsa.PublicKey. If the token does not specify
+// a key id, all keys are tried. The claims are not validated.
+func VerifyJWT(token string, keys map[string]interface{}) (JWTClaims, error) {
+	// split token
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	// decode header
+	var header jwtHeader
+	err := decodeJWTSegment(parts[0], &header)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// get algorithm
+	alg, ok := jwtAlgorithms[header.Algorithm]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	// decode signature
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// compute digest
+	hash := alg.hash.New()
+	_, _ = hash.Write([]byte(parts[0] + "." + parts[1]))
+	digest := hash.Sum(nil)
+
+	// prepare candidates
+	var candidates []interface{}
+	if header.KeyID != "" {
+		if key, ok := keys[header.KeyID]; ok {
+			candidates = append(candidates, key)
+		}
+	} else {
+		for _, key := range keys {
+			candidates = append(candidates, key)
+		}
+	}
+
+	// verify signature
+	verified := false
+	for _, key := range candidates {
+		if verifyJWTSignature(alg, key, []byte(parts[0]+"."+parts[1]), digest, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidToken
+	}
+
+	// decode claims
+	var claims JWTClaims
+	err = decodeJWTSegment(parts[1], &claims)
+	if err != nil || claims == nil {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+func verifyJWTSignature(alg jwtAlgorithm, key interface{}, input, digest, signature []byte) bool {
+	switch alg.family {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+
+		mac := hmac.New(alg.hash.New, secret)
+		_, _ = mac.Write(input)
+
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		return rsa.VerifyPKCS1v15(publicKey, alg.hash, digest, signature) == nil
+	case "PS":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		return rsa.VerifyPSS(publicKey, alg.hash, digest, signature, nil) == nil
+	case "ES":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		return ecdsa.Verify(publicKey, digest, r, s)
+	}
+
+	return false
+}
+
+func decodeJWTSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	K       string `json:"k"`
+}
+
+// ParseJWKS parses a JSON Web Key Set and returns the contained keys indexed by
+// their key id. Keys that are not intended for signatures are skipped.
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	// decode key set
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare map
+	keys := make(map[string]interface{})
+
+	// convert keys
+	for _, jwk := range set.Keys {
+		// skip encryption keys
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.KeyType {
+		case "oct":
+			k, err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil {
+				return nil, err
+			}
+
+			keys[jwk.KeyID] = k
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+			if err != nil {
+				return nil, err
+			}
+
+			e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err != nil {
+				return nil, err
+			}
+
+			keys[jwk.KeyID] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Curve {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, errors.New("unsupported curve " + jwk.Curve)
+			}
+
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if err != nil {
+				return nil, err
+			}
+
+			y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err != nil {
+				return nil, err
+			}
+
+			keys[jwk.KeyID] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// LoadJWKS reads and parses the JSON Web Key Set file at the specified path.
+func LoadJWKS(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseJWKS(data)
+}
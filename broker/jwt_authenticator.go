@@ -0,0 +1,307 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+)
+
+type jwtSession struct {
+	claims    JWTClaims
+	publish   []string
+	subscribe []string
+	timer     *time.Timer
+}
+
+// A JWTAuthenticator wraps a Backend and authenticates clients by treating the
+// password as a JSON Web Token. Tokens are verified using the configured keys
+// and the claims are used to restrict the username, client id and topics of the
+// client. Clients are closed when their token expires. All other calls are
+// forwarded to the wrapped Backend.
+type JWTAuthenticator struct {
+	Backend
+
+	// Keys used to verify tokens indexed by their key id. Supported are []byte
+	// for HMAC, *rsa.PublicKey and *ecdsa.PublicKey. See LoadJWKS to load keys
+	// from a JSON Web Key Set file.
+	Keys map[string]interface{}
+
+	// Issuer will be compared to the "iss" claim if set.
+	Issuer string
+
+	// Audience must be contained in the "aud" claim if set.
+	Audience string
+
+	// Leeway is the allowed clock skew when checking the "exp" and "nbf" claims.
+	Leeway time.Duration
+
+	// RequireExpiry will reject tokens without an "exp" claim.
+	RequireExpiry bool
+
+	// UsernameClaim is the claim the username must match. Clients without a
+	// username are rejected if set.
+	//
+	// Will default to "sub".
+	UsernameClaim string
+
+	// ClientIDClaim is the claim that lists the permitted client ids. Tokens
+	// without the claim are not restricted.
+	//
+	// Will default to "client_id".
+	ClientIDClaim string
+
+	// PublishClaim is the claim that lists the topic filters a client may
+	// publish to. Tokens without the claim are not restricted.
+	//
+	// Will default to "pub".
+	PublishClaim string
+
+	// SubscribeClaim is the claim that lists the topic filters a client may
+	// subscribe to. Tokens without the claim are not restricted.
+	//
+	// Will default to "sub_filters".
+	SubscribeClaim string
+
+	sessions map[*Client]*jwtSession
+	mutex    sync.Mutex
+}
+
+// NewJWTAuthenticator returns a new JWTAuthenticator that wraps the provided
+// Backend.
+func NewJWTAuthenticator(backend Backend, keys map[string]interface{}) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		Backend:        backend,
+		Keys:           keys,
+		UsernameClaim:  "sub",
+		ClientIDClaim:  "client_id",
+		PublishClaim:   "pub",
+		SubscribeClaim: "sub_filters",
+		sessions:       make(map[*Client]*jwtSession),
+	}
+}
+
+// Authenticate will verify the password as a token and validate its claims.
+func (a *JWTAuthenticator) Authenticate(client *Client, user, password string) (bool, error) {
+	// verify token
+	claims, err := VerifyJWT(password, a.Keys)
+	if err != nil {
+		return false, nil
+	}
+
+	// validate claims
+	if !a.validate(claims) {
+		return false, nil
+	}
+
+	// check username
+	if a.UsernameClaim != "" {
+		if name, _ := claims.String(a.UsernameClaim); user == "" || name != user {
+			return false, nil
+		}
+	}
+
+	// check client id, a malformed claim permits no client id
+	if _, ok := claims[a.ClientIDClaim]; ok && a.ClientIDClaim != "" {
+		ids, _ := claims.Strings(a.ClientIDClaim)
+		if !containsString(ids, client.ID()) {
+			return false, nil
+		}
+	}
+
+	// prepare session
+	sess := &jwtSession{
+		claims: claims,
+	}
+
+	// get topic permissions
+	sess.publish = permittedFilters(claims, a.PublishClaim)
+	sess.subscribe = permittedFilters(claims, a.SubscribeClaim)
+
+	// close client when the token expires
+	if exp, ok := claims.Time("exp"); ok {
+		sess.timer = time.AfterFunc(time.Until(exp)+a.Leeway, func() {
+			a.Backend.Log(ClientError, client, nil, nil, ErrTokenExpired)
+			client.Close()
+		})
+	}
+
+	// acquire mutex
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// ensure map
+	if a.sessions == nil {
+		a.sessions = make(map[*Client]*jwtSession)
+	}
+
+	// save session
+	a.sessions[client] = sess
+
+	return true, nil
+}
+
+// Claims returns the claims of the token the client has been authenticated
+// with.
+func (a *JWTAuthenticator) Claims(client *Client) JWTClaims {
+	sess := a.session(client)
+	if sess == nil {
+		return nil
+	}
+
+	return sess.claims
+}
+
+// Subscribe will check the topic permissions before forwarding the call.
+func (a *JWTAuthenticator) Subscribe(client *Client, subs []packet.Subscription, ack Ack) error {
+	// check permissions
+	if sess := a.session(client); sess != nil && sess.subscribe != nil {
+		for _, sub := range subs {
+			if !coveredBy(sess.subscribe, sub.Topic) {
+				return ErrNotAuthorized
+			}
+		}
+	}
+
+	return a.Backend.Subscribe(client, subs, ack)
+}
+
+// Publish will check the topic permissions before forwarding the call.
+func (a *JWTAuthenticator) Publish(client *Client, msg *packet.Message, ack Ack) error {
+	// check permissions
+	if sess := a.session(client); sess != nil && sess.publish != nil {
+		if !coveredBy(sess.publish, msg.Topic) {
+			return ErrNotAuthorized
+		}
+	}
+
+	return a.Backend.Publish(client, msg, ack)
+}
+
+// Terminate will release the token before forwarding the call.
+func (a *JWTAuthenticator) Terminate(client *Client) error {
+	// acquire mutex
+	a.mutex.Lock()
+
+	// stop timer and remove session
+	if sess, ok := a.sessions[client]; ok {
+		if sess.timer != nil {
+			sess.timer.Stop()
+		}
+
+		delete(a.sessions, client)
+	}
+
+	// release mutex
+	a.mutex.Unlock()
+
+	return a.Backend.Terminate(client)
+}
+
+func (a *JWTAuthenticator) session(client *Client) *jwtSession {
+	// acquire mutex
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.sessions[client]
+}
+
+func (a *JWTAuthenticator) validate(claims JWTClaims) bool {
+	// get now
+	now := time.Now()
+
+	// check expiry
+	exp, ok := claims.Time("exp")
+	if ok && !now.Before(exp.Add(a.Leeway)) {
+		return false
+	} else if !ok && a.RequireExpiry {
+		return false
+	}
+
+	// check not before
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(a.Leeway).Before(nbf) {
+		return false
+	}
+
+	// check issuer
+	if a.Issuer != "" {
+		if iss, _ := claims.String("iss"); iss != a.Issuer {
+			return false
+		}
+	}
+
+	// check audience
+	if a.Audience != "" {
+		if aud, _ := claims.Strings("aud"); !containsString(aud, a.Audience) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// permittedFilters returns the topic filters listed in the specified claim, nil
+// if the claim is missing or an empty list if the claim is malformed.
+func permittedFilters(claims JWTClaims, name string) []string {
+	// check presence
+	if _, ok := claims[name]; !ok || name == "" {
+		return nil
+	}
+
+	// get filters
+	filters, ok := claims.Strings(name)
+	if !ok || filters == nil {
+		return []string{}
+	}
+
+	return filters
+}
+
+// coveredBy returns whether the topic or topic filter is fully covered by one
+// of the provided topic filters.
+func coveredBy(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if covers(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// covers returns whether all topics matched by the topic or topic filter are
+// also matched by the provided topic filter.
+func covers(filter, topic string) bool {
+	// split filter and topic
+	filterSegments := strings.Split(filter, "/")
+	topicSegments := strings.Split(topic, "/")
+
+	for i, segment := range filterSegments {
+		// multi-level wildcards cover the rest
+		if segment == "#" {
+			return true
+		}
+
+		// check length
+		if i >= len(topicSegments) {
+			return false
+		}
+
+		// single-level wildcards cover all but multi-level wildcards
+		if segment == "+" {
+			if topicSegments[i] == "#" {
+				return false
+			}
+
+			continue
+		}
+
+		// otherwise segments must match
+		if segment != topicSegments[i] {
+			return false
+		}
+	}
+
+	return len(filterSegments) == len(topicSegments)
+}
@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/client"
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTAuthenticatorAuthenticate(t *testing.T) {
+	secret := []byte("secret")
+
+	auth := NewJWTAuthenticator(NewMemoryBackend(), map[string]interface{}{
+		"": secret,
+	})
+	auth.Issuer = "issuer"
+	auth.Audience = "broker"
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+
+	token := signJWT("HS256", secret, "", JWTClaims{
+		"sub":       "user",
+		"iss":       "issuer",
+		"aud":       []string{"broker", "other"},
+		"exp":       exp,
+		"client_id": "c1",
+	})
+
+	// valid
+	c1 := fakeClient("c1")
+	ok, err := auth.Authenticate(c1, "user", token)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "user", auth.Claims(c1)["sub"])
+
+	// empty username
+	ok, err = auth.Authenticate(fakeClient("c1"), "", token)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// wrong username
+	ok, err = auth.Authenticate(fakeClient("c1"), "other", token)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// wrong client id
+	ok, err = auth.Authenticate(fakeClient("c2"), "user", token)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// malformed client id
+	ok, err = auth.Authenticate(fakeClient("c1"), "user", signJWT("HS256", secret, "", JWTClaims{
+		"sub":       "user",
+		"iss":       "issuer",
+		"aud":       "broker",
+		"client_id": 42,
+	}))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// invalid token
+	ok, err = auth.Authenticate(fakeClient("c1"), "user", "password")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	for _, claims := range []JWTClaims{
+		{"iss": "issuer", "aud": "broker", "exp": float64(time.Now().Add(-time.Minute).Unix())},
+		{"iss": "issuer", "aud": "broker", "nbf": float64(time.Now().Add(time.Minute).Unix())},
+		{"iss": "other", "aud": "broker"},
+		{"iss": "issuer", "aud": "other"},
+	} {
+		ok, err = auth.Authenticate(fakeClient("c1"), "", signJWT("HS256", secret, "", claims))
+		assert.NoError(t, err)
+		assert.False(t, ok, claims)
+	}
+
+	// missing expiry
+	auth.RequireExpiry = true
+	ok, err = auth.Authenticate(fakeClient("c1"), "", signJWT("HS256", secret, "", JWTClaims{
+		"iss": "issuer",
+		"aud": "broker",
+	}))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, auth.Terminate(c1))
+	assert.Nil(t, auth.Claims(c1))
+}
+
+func TestJWTAuthenticatorPermissions(t *testing.T) {
+	secret := []byte("secret")
+
+	backend := NewMemoryBackend()
+	auth := NewJWTAuthenticator(backend, map[string]interface{}{
+		"": secret,
+	})
+
+	c1 := fakeClient("c1")
+	ok, err := auth.Authenticate(c1, "user", signJWT("HS256", secret, "", JWTClaims{
+		"sub":         "user",
+		"pub":         []string{"devices/c1/#"},
+		"sub_filters": "commands/+/c1",
+	}))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	err = auth.Publish(c1, &packet.Message{Topic: "devices/c2/data"}, nil)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	err = auth.Subscribe(c1, []packet.Subscription{{Topic: "commands/#"}}, nil)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	err = auth.Subscribe(c1, []packet.Subscription{{Topic: "commands/+/c2"}}, nil)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	assert.True(t, coveredBy([]string{"devices/c1/#"}, "devices/c1"))
+	assert.True(t, coveredBy([]string{"devices/c1/#"}, "devices/c1/a/b"))
+	assert.True(t, coveredBy([]string{"commands/+/c1"}, "commands/+/c1"))
+	assert.True(t, coveredBy([]string{"commands/+/c1"}, "commands/foo/c1"))
+	assert.False(t, coveredBy([]string{"commands/+/c1"}, "commands/#"))
+	assert.False(t, coveredBy([]string{"commands/+/c1"}, "commands/foo"))
+	assert.False(t, coveredBy([]string{}, "foo"))
+}
+
+func TestJWTAuthenticatorExpiry(t *testing.T) {
+	secret := []byte("secret")
+
+	backend := NewJWTAuthenticator(NewMemoryBackend(), map[string]interface{}{
+		"": secret,
+	})
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	token := signJWT("HS256", secret, "", JWTClaims{
+		"sub": "user",
+		"exp": float64(time.Now().Add(time.Second).Unix()) + 0.5,
+	})
+
+	wait := make(chan struct{})
+
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.Nil(t, msg)
+		assert.Error(t, err)
+		close(wait)
+
+		return nil
+	}
+
+	cf, err := c.Connect(client.NewConfig("tcp://user:" + token + "@localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+	assert.Equal(t, packet.ConnectionAccepted, cf.ReturnCode())
+
+	safeReceive(wait)
+
+	close(quit)
+
+	safeReceive(done)
+}
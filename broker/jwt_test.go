@@ -0,0 +1,174 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signJWT(alg string, key interface{}, kid string, claims JWTClaims) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	algorithm := jwtAlgorithms[alg]
+	hash := algorithm.hash.New()
+	hash.Write([]byte(input))
+	digest := hash.Sum(nil)
+
+	var signature []byte
+	var err error
+
+	switch alg[:2] {
+	case "HS":
+		mac := hmac.New(algorithm.hash.New, key.([]byte))
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case "RS":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), algorithm.hash, digest)
+	case "PS":
+		signature, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), algorithm.hash, digest, nil)
+	case "ES":
+		privateKey := key.(*ecdsa.PrivateKey)
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, privateKey, digest)
+		size := (privateKey.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	secret := []byte("secret")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	keys := map[string]interface{}{
+		"hmac":  secret,
+		"rsa":   &rsaKey.PublicKey,
+		"ecdsa": &ecKey.PublicKey,
+	}
+
+	claims := JWTClaims{"sub": "user"}
+
+	for _, item := range []struct {
+		alg string
+		key interface{}
+		kid string
+	}{
+		{"HS256", secret, "hmac"},
+		{"HS512", secret, ""},
+		{"RS256", rsaKey, "rsa"},
+		{"PS384", rsaKey, "rsa"},
+		{"ES256", ecKey, "ecdsa"},
+		{"ES256", ecKey, ""},
+	} {
+		token := signJWT(item.alg, item.key, item.kid, claims)
+
+		ret, err := VerifyJWT(token, keys)
+		assert.NoError(t, err, item.alg)
+		assert.Equal(t, claims, ret, item.alg)
+	}
+
+	// wrong key
+	token := signJWT("HS256", []byte("foo"), "", claims)
+	_, err = VerifyJWT(token, keys)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// key confusion
+	token = signJWT("HS256", secret, "rsa", claims)
+	_, err = VerifyJWT(token, keys)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// unsigned token
+	token = signJWT("HS256", secret, "hmac", claims)
+	parts := strings.Split(token, ".")
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	_, err = VerifyJWT(header+"."+parts[1]+".", keys)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// malformed token
+	_, err = VerifyJWT("foo", keys)
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	b64 := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "oct", "kid": "k1", "k": b64([]byte("secret"))},
+			{"kty": "RSA", "kid": "k2", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "k3", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kty": "RSA", "kid": "k4", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		},
+	})
+
+	keys, err := ParseJWKS(data)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+	assert.Equal(t, []byte("secret"), keys["k1"])
+	assert.Equal(t, &rsaKey.PublicKey, keys["k2"])
+	assert.Equal(t, ecKey.PublicKey.X, keys["k3"].(*ecdsa.PublicKey).X)
+
+	token := signJWT("RS256", rsaKey, "k2", JWTClaims{"sub": "user"})
+	_, err = VerifyJWT(token, keys)
+	assert.NoError(t, err)
+
+	_, err = ParseJWKS([]byte("foo"))
+	assert.Error(t, err)
+}
+
+func TestJWTClaims(t *testing.T) {
+	var claims JWTClaims
+	err := json.Unmarshal([]byte(`{"a":"foo","b":["foo","bar"],"c":[1],"d":1500000000.5}`), &claims)
+	require.NoError(t, err)
+
+	str, ok := claims.String("a")
+	assert.True(t, ok)
+	assert.Equal(t, "foo", str)
+
+	list, ok := claims.Strings("a")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"foo"}, list)
+
+	list, ok = claims.Strings("b")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"foo", "bar"}, list)
+
+	_, ok = claims.Strings("c")
+	assert.False(t, ok)
+
+	tm, ok := claims.Time("d")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1500000000500), tm.UnixNano()/int64(1e6))
+}
@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"gopkg.in/tomb.v2"
+)
+
+// A LocalSubscription is an in-process subscription to a MemoryBackend. It is
+// backed by a temporary session and receives messages with the same QOS,
+// retained and ordering semantics as network clients, but without encoding
+// or decoding of packets. Delivered messages may be shared with other
+// subscribers and must not be modified.
+type LocalSubscription struct {
+	backend *MemoryBackend
+	client  *Client
+	handler func(*LocalSubscription, *packet.Message)
+}
+
+// PublishMessage will publish the message in-process. The message is copied
+// before it is queued.
+func (m *MemoryBackend) PublishMessage(msg *packet.Message) error {
+	return m.Publish(nil, msg.Copy(), nil)
+}
+
+// SubscribeFunc will subscribe to the specified topic filter and call the
+// handler with every received message. The handler is called sequentially
+// from a single goroutine and should not block for long as messages are
+// queued in the meantime.
+func (m *MemoryBackend) SubscribeFunc(filter string, qos packet.QOS, handler func(*packet.Message)) (*LocalSubscription, error) {
+	return m.subscribeLocal(filter, qos, func(_ *LocalSubscription, msg *packet.Message) {
+		handler(msg)
+	})
+}
+
+// SubscribeChan will subscribe to the specified topic filter and send every
+// received message to the provided channel. Messages are queued while the
+// channel is blocked.
+func (m *MemoryBackend) SubscribeChan(filter string, qos packet.QOS, ch chan<- *packet.Message) (*LocalSubscription, error) {
+	return m.subscribeLocal(filter, qos, func(s *LocalSubscription, msg *packet.Message) {
+		select {
+		case ch <- msg:
+		case <-s.client.Closing():
+		}
+	})
+}
+
+func (m *MemoryBackend) subscribeLocal(filter string, qos packet.QOS, handler func(*LocalSubscription, *packet.Message)) (*LocalSubscription, error) {
+	// acquire global mutex
+	m.globalMutex.Lock()
+
+	// return error if closing
+	if m.closing {
+		m.globalMutex.Unlock()
+		return nil, ErrClosing
+	}
+
+	// prepare client without connection
+	client := &Client{
+		state:   clientConnected,
+		backend: m,
+		done:    make(chan struct{}),
+	}
+
+	// create session
+	sess := newMemorySession(m.SessionQueueSize)
+	sess.owner = client
+	client.session = sess
+
+	// save session
+	m.temporarySessions[client] = sess
+
+	// release global mutex
+	m.globalMutex.Unlock()
+
+	// prepare subscription
+	s := &LocalSubscription{
+		backend: m,
+		client:  client,
+		handler: handler,
+	}
+
+	// start deliverer
+	client.tomb.Go(s.deliverer)
+
+	// run cleanup goroutine
+	go func() {
+		// wait for death and cleanup
+		_ = client.tomb.Wait()
+		_ = m.Terminate(client)
+
+		// close channel
+		close(client.done)
+	}()
+
+	// subscribe to filter
+	err := s.Subscribe(filter, qos)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Subscribe will add another topic filter to the subscription. Matching
+// retained messages are queued immediately.
+func (s *LocalSubscription) Subscribe(filter string, qos packet.QOS) error {
+	return s.backend.Subscribe(s.client, []packet.Subscription{{Topic: filter, QOS: qos}}, nil)
+}
+
+// Unsubscribe will remove the topic filter from the subscription.
+func (s *LocalSubscription) Unsubscribe(filter string) error {
+	return s.backend.Unsubscribe(s.client, []string{filter}, nil)
+}
+
+// Publish will publish a message on behalf of the subscription. In contrast to
+// MemoryBackend.PublishMessage, it returns ErrQueueFull instead of blocking if
+// the message would be added to the full queue of the subscription itself,
+// which allows publishing from the handler.
+func (s *LocalSubscription) Publish(msg *packet.Message) error {
+	return s.backend.Publish(s.client, msg.Copy(), nil)
+}
+
+// Close will remove the subscription and wait until the handler returned.
+// Queued messages are dropped.
+func (s *LocalSubscription) Close() {
+	s.client.Close()
+	<-s.client.Closed()
+}
+
+func (s *LocalSubscription) deliverer() error {
+	for {
+		// get next message
+		msg, ack, err := s.backend.Dequeue(s.client)
+		if err != nil {
+			return err
+		} else if msg == nil {
+			return tomb.ErrDying
+		}
+
+		// call handler
+		s.handler(s, msg)
+
+		// call ack if provided
+		if ack != nil {
+			ack()
+		}
+	}
+}
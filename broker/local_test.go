@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/client"
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receiveMessage(t *testing.T, ch <-chan *packet.Message) *packet.Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+		return nil
+	}
+}
+
+func TestMemoryBackendSubscribeFunc(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	messages := make(chan *packet.Message, 10)
+
+	sub, err := backend.SubscribeFunc("foo/+", 1, func(msg *packet.Message) {
+		messages <- msg
+	})
+	require.NoError(t, err)
+
+	for _, payload := range []string{"1", "2", "3"} {
+		err = backend.PublishMessage(&packet.Message{
+			Topic:   "foo/bar",
+			Payload: []byte(payload),
+			QOS:     2,
+		})
+		assert.NoError(t, err)
+	}
+
+	err = backend.PublishMessage(&packet.Message{
+		Topic:   "bar",
+		Payload: []byte("4"),
+	})
+	assert.NoError(t, err)
+
+	for _, payload := range []string{"1", "2", "3"} {
+		msg := receiveMessage(t, messages)
+		assert.Equal(t, "foo/bar", msg.Topic)
+		assert.Equal(t, payload, string(msg.Payload))
+		assert.Equal(t, packet.QOS(1), msg.QOS)
+	}
+
+	err = sub.Unsubscribe("foo/+")
+	assert.NoError(t, err)
+
+	err = backend.PublishMessage(&packet.Message{
+		Topic: "foo/bar",
+	})
+	assert.NoError(t, err)
+
+	sub.Close()
+
+	select {
+	case <-messages:
+		t.Fatal("unexpected message")
+	default:
+	}
+
+	assert.Empty(t, backend.temporarySessions)
+}
+
+func TestMemoryBackendSubscribeChanRetained(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	err := backend.PublishMessage(&packet.Message{
+		Topic:   "foo",
+		Payload: []byte("bar"),
+		QOS:     1,
+		Retain:  true,
+	})
+	assert.NoError(t, err)
+
+	messages := make(chan *packet.Message)
+
+	sub, err := backend.SubscribeChan("#", 0, messages)
+	require.NoError(t, err)
+
+	msg := receiveMessage(t, messages)
+	assert.Equal(t, "foo", msg.Topic)
+	assert.Equal(t, "bar", string(msg.Payload))
+	assert.Equal(t, packet.QOS(0), msg.QOS)
+	assert.True(t, msg.Retain)
+
+	// close while the channel is blocked
+	err = backend.PublishMessage(&packet.Message{
+		Topic: "foo",
+	})
+	assert.NoError(t, err)
+
+	sub.Close()
+}
+
+func TestMemoryBackendLocalInterop(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	local := make(chan *packet.Message, 10)
+
+	sub, err := backend.SubscribeChan("local", 0, local)
+	require.NoError(t, err)
+
+	remote := make(chan *packet.Message, 10)
+
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		remote <- msg
+		return nil
+	}
+
+	cf, err := c.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("remote", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	// network to local
+	pf, err := c.Publish("local", []byte("hello"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	msg := receiveMessage(t, local)
+	assert.Equal(t, "hello", string(msg.Payload))
+
+	// local to network
+	err = sub.Publish(&packet.Message{
+		Topic:   "remote",
+		Payload: []byte("world"),
+		QOS:     1,
+	})
+	assert.NoError(t, err)
+
+	msg = receiveMessage(t, remote)
+	assert.Equal(t, "remote", msg.Topic)
+	assert.Equal(t, "world", string(msg.Payload))
+	assert.Equal(t, packet.QOS(1), msg.QOS)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+
+	// closing the backend closes local subscriptions
+	assert.True(t, backend.Close(5*time.Second))
+
+	select {
+	case <-sub.client.Closed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	_, err = backend.SubscribeFunc("foo", 0, func(*packet.Message) {})
+	assert.Equal(t, ErrClosing, err)
+}
@@ -0,0 +1,524 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ErrUnsupportedHash is returned if a password hash uses an unknown format.
+var ErrUnsupportedHash = errors.New("unsupported hash")
+
+// A HashAlgorithm selects the algorithm used to hash new passwords.
+type HashAlgorithm string
+
+// The available hash algorithms.
+const (
+	// PBKDF2 hashes passwords using PBKDF2-SHA512 in the format used by
+	// mosquitto 2.0 ("$7$").
+	PBKDF2 HashAlgorithm = "pbkdf2"
+
+	// Bcrypt hashes passwords using bcrypt ("$2a$").
+	Bcrypt HashAlgorithm = "bcrypt"
+
+	// Argon2 hashes passwords using argon2id in the PHC string format
+	// ("$argon2id$").
+	Argon2 HashAlgorithm = "argon2"
+)
+
+// The default PBKDF2 iterations used when hashing passwords.
+const pbkdf2Iterations = 10000
+
+var dummyHash string
+var dummyHashOnce sync.Once
+
+// HashPassword hashes the password using the specified algorithm.
+func HashPassword(password string, algorithm HashAlgorithm) (string, error) {
+	switch algorithm {
+	case PBKDF2, "":
+		salt, err := randomBytes(12)
+		if err != nil {
+			return "", err
+		}
+
+		key := pbkdf2.Key([]byte(password), salt, pbkdf2Iterations, sha512.Size, sha512.New)
+
+		return fmt.Sprintf("$7$%d$%s$%s", pbkdf2Iterations, base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(key)), nil
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+
+		return string(hash), nil
+	case Argon2:
+		salt, err := randomBytes(16)
+		if err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, 3, 64*1024, 4, 32)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, 64*1024, 3, 4, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+
+	return "", ErrUnsupportedHash
+}
+
+// ComparePassword returns whether the password matches the provided hash.
+// Supported are the "$6$" and "$7$" formats used by mosquitto_passwd as well
+// as bcrypt and argon2id hashes.
+func ComparePassword(hash, password string) (bool, error) {
+	// split hash
+	parts := strings.Split(hash, "$")
+	if len(parts) < 2 || parts[0] != "" {
+		return false, ErrUnsupportedHash
+	}
+
+	switch parts[1] {
+	case "6":
+		if len(parts) != 4 {
+			return false, ErrUnsupportedHash
+		}
+
+		salt, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return false, err
+		}
+
+		expected, err := base64.StdEncoding.DecodeString(parts[3])
+		if err != nil {
+			return false, err
+		}
+
+		sum := sha512.Sum512(append([]byte(password), salt...))
+
+		return subtle.ConstantTimeCompare(sum[:], expected) == 1, nil
+	case "7":
+		if len(parts) != 5 {
+			return false, ErrUnsupportedHash
+		}
+
+		iterations, err := strconv.Atoi(parts[2])
+		if err != nil || iterations <= 0 {
+			return false, ErrUnsupportedHash
+		}
+
+		salt, err := base64.StdEncoding.DecodeString(parts[3])
+		if err != nil {
+			return false, err
+		}
+
+		expected, err := base64.StdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, err
+		}
+
+		key := pbkdf2.Key([]byte(password), salt, iterations, len(expected), sha512.New)
+
+		return subtle.ConstantTimeCompare(key, expected) == 1, nil
+	case "2a", "2b", "2y":
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	case "argon2id":
+		if len(parts) != 6 {
+			return false, ErrUnsupportedHash
+		}
+
+		var version int
+		_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+		if err != nil || version != argon2.Version {
+			return false, ErrUnsupportedHash
+		}
+
+		var memory, iterations uint32
+		var threads uint8
+		_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+		if err != nil {
+			return false, ErrUnsupportedHash
+		}
+
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, err
+		}
+
+		expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+
+		return subtle.ConstantTimeCompare(key, expected) == 1, nil
+	}
+
+	return false, ErrUnsupportedHash
+}
+
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// A CredentialStore verifies the credentials supplied by clients.
+type CredentialStore interface {
+	// Verify should return whether the user and password are valid.
+	Verify(user, password string) bool
+}
+
+// A PasswordFile is a CredentialStore backed by a file of hashed passwords in
+// the format used by mosquitto_passwd. Each line contains a username and a
+// password hash separated by a colon. Empty lines and lines starting with "#"
+// are ignored.
+type PasswordFile struct {
+	// OnError is called with errors that occur while reloading the file in the
+	// background.
+	OnError func(error)
+
+	path    string
+	hashes  map[string]string
+	modTime time.Time
+	mutex   sync.RWMutex
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// NewPasswordFile returns a new and empty PasswordFile for the specified path.
+func NewPasswordFile(path string) *PasswordFile {
+	return &PasswordFile{
+		path:   path,
+		hashes: make(map[string]string),
+		quit:   make(chan struct{}),
+	}
+}
+
+// LoadPasswordFile reads the password file at the specified path.
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	// create file
+	file := NewPasswordFile(path)
+
+	// load file
+	err := file.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Reload will read the file and replace all entries.
+func (f *PasswordFile) Reload() error {
+	// get file info
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	// read file
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	// parse file
+	hashes, err := parsePasswordFile(data)
+	if err != nil {
+		return err
+	}
+
+	// acquire mutex
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// replace entries
+	f.hashes = hashes
+	f.modTime = info.ModTime()
+
+	return nil
+}
+
+func parsePasswordFile(data []byte) (map[string]string, error) {
+	// prepare map
+	hashes := make(map[string]string)
+
+	// prepare scanner
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	// parse lines
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		// get text
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// split line
+		i := strings.Index(text, ":")
+		if i <= 0 || i == len(text)-1 {
+			return nil, fmt.Errorf("invalid password file entry on line %d", line)
+		}
+
+		hashes[text[:i]] = text[i+1:]
+	}
+
+	// check error
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// Verify will return whether the password matches the stored hash of the user.
+func (f *PasswordFile) Verify(user, password string) bool {
+	// acquire mutex
+	f.mutex.RLock()
+	hash, ok := f.hashes[user]
+	f.mutex.RUnlock()
+
+	// compare against a dummy hash if the user is unknown to not reveal
+	// existing users through the response time
+	if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = HashPassword("", PBKDF2)
+		})
+
+		_, _ = ComparePassword(dummyHash, password)
+
+		return false
+	}
+
+	// compare password
+	ok, err := ComparePassword(hash, password)
+	if err != nil {
+		return false
+	}
+
+	return ok
+}
+
+// Set will hash the password using the specified algorithm and add or replace
+// the entry of the user. The file is not written until Save is called.
+func (f *PasswordFile) Set(user, password string, algorithm HashAlgorithm) error {
+	// check user
+	if user == "" || strings.Contains(user, ":") {
+		return errors.New("invalid username")
+	}
+
+	// hash password
+	hash, err := HashPassword(password, algorithm)
+	if err != nil {
+		return err
+	}
+
+	// acquire mutex
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// set hash
+	f.hashes[user] = hash
+
+	return nil
+}
+
+// Remove will remove the entry of the user. The file is not written until Save
+// is called.
+func (f *PasswordFile) Remove(user string) bool {
+	// acquire mutex
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// check entry
+	_, ok := f.hashes[user]
+	if !ok {
+		return false
+	}
+
+	// remove entry
+	delete(f.hashes, user)
+
+	return true
+}
+
+// Users returns a sorted list of all users.
+func (f *PasswordFile) Users() []string {
+	// acquire mutex
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	// collect users
+	users := make([]string, 0, len(f.hashes))
+	for user := range f.hashes {
+		users = append(users, user)
+	}
+
+	// sort users
+	sort.Strings(users)
+
+	return users
+}
+
+// Save will atomically write all entries to the file. The mode and owner of an
+// existing file are retained.
+func (f *PasswordFile) Save() error {
+	// acquire mutex
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// collect users
+	users := make([]string, 0, len(f.hashes))
+	for user := range f.hashes {
+		users = append(users, user)
+	}
+
+	// sort users
+	sort.Strings(users)
+
+	// encode entries
+	var buf bytes.Buffer
+	for _, user := range users {
+		buf.WriteString(user + ":" + f.hashes[user] + "\n")
+	}
+
+	// get existing file
+	existing, err := os.Stat(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// write temporary file
+	tmp := f.path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	// apply owner and mode of existing file
+	if existing != nil {
+		err = copyOwner(tmp, existing)
+		if err == nil {
+			err = os.Chmod(tmp, existing.Mode().Perm())
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+
+	// replace file
+	err = os.Rename(tmp, f.path)
+	if err != nil {
+		return err
+	}
+
+	// update modification time
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.modTime = info.ModTime()
+
+	return nil
+}
+
+// Watch will check the file in the specified interval and reload it if it has
+// been modified. Additionally, the file is reloaded when one of the provided
+// signals is received. Watching stops when Close is called.
+func (f *PasswordFile) Watch(interval time.Duration, signals ...os.Signal) {
+	// prepare signal channel
+	sig := make(chan os.Signal, 1)
+	if len(signals) > 0 {
+		signal.Notify(sig, signals...)
+	}
+
+	// prepare ticker
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+
+	go func() {
+		// stop signals and ticker when closed
+		defer signal.Stop(sig)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+
+		for {
+			select {
+			case <-tick:
+				// check modification time
+				info, err := os.Stat(f.path)
+				if err != nil {
+					f.handleError(err)
+					continue
+				}
+
+				// get last modification time
+				f.mutex.RLock()
+				modTime := f.modTime
+				f.mutex.RUnlock()
+
+				// skip if not changed
+				if info.ModTime().Equal(modTime) {
+					continue
+				}
+
+				f.handleError(f.Reload())
+			case <-sig:
+				f.handleError(f.Reload())
+			case <-f.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Close will stop watching the file.
+func (f *PasswordFile) Close() {
+	f.once.Do(func() {
+		close(f.quit)
+	})
+}
+
+func (f *PasswordFile) handleError(err error) {
+	if err != nil && f.OnError != nil {
+		f.OnError(err)
+	}
+}
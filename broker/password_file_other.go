@@ -0,0 +1,10 @@
+//go:build !unix
+// +build !unix
+
+package broker
+
+import "os"
+
+func copyOwner(path string, info os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, alg := range []HashAlgorithm{PBKDF2, Bcrypt, Argon2} {
+		hash, err := HashPassword("secret", alg)
+		assert.NoError(t, err)
+
+		ok, err := ComparePassword(hash, "secret")
+		assert.NoError(t, err)
+		assert.True(t, ok, alg)
+
+		ok, err = ComparePassword(hash, "foo")
+		assert.NoError(t, err)
+		assert.False(t, ok, alg)
+	}
+
+	_, err := HashPassword("secret", "foo")
+	assert.Equal(t, ErrUnsupportedHash, err)
+}
+
+func TestComparePasswordSHA512(t *testing.T) {
+	salt := []byte("0123456789ab")
+	sum := sha512.Sum512(append([]byte("secret"), salt...))
+	hash := "$6$" + base64.StdEncoding.EncodeToString(salt) + "$" + base64.StdEncoding.EncodeToString(sum[:])
+
+	ok, err := ComparePassword(hash, "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = ComparePassword(hash, "foo")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = ComparePassword("secret", "secret")
+	assert.Equal(t, ErrUnsupportedHash, err)
+}
+
+func TestPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passwd")
+
+	file := NewPasswordFile(path)
+	assert.NoError(t, file.Set("user1", "secret1", PBKDF2))
+	assert.NoError(t, file.Set("user2", "secret2", Bcrypt))
+	assert.Error(t, file.Set("foo:bar", "secret", PBKDF2))
+	assert.NoError(t, file.Save())
+
+	file, err = LoadPasswordFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user1", "user2"}, file.Users())
+	assert.True(t, file.Verify("user1", "secret1"))
+	assert.True(t, file.Verify("user2", "secret2"))
+	assert.False(t, file.Verify("user1", "secret2"))
+	assert.False(t, file.Verify("user3", "secret3"))
+	assert.NotEmpty(t, dummyHash)
+
+	assert.True(t, file.Remove("user2"))
+	assert.False(t, file.Remove("user2"))
+	assert.False(t, file.Verify("user2", "secret2"))
+
+	err = ioutil.WriteFile(path, []byte("foo"), 0600)
+	require.NoError(t, err)
+
+	_, err = LoadPasswordFile(path)
+	assert.Error(t, err)
+
+	_, err = LoadPasswordFile(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestPasswordFileSaveMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passwd")
+
+	err = ioutil.WriteFile(path, nil, 0640)
+	require.NoError(t, err)
+	require.NoError(t, os.Chmod(path, 0640))
+
+	file, err := LoadPasswordFile(path)
+	require.NoError(t, err)
+	assert.NoError(t, file.Set("user1", "secret1", PBKDF2))
+	assert.NoError(t, file.Save())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
+
+func TestPasswordFileWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passwd")
+
+	writer := NewPasswordFile(path)
+	assert.NoError(t, writer.Set("user1", "secret1", PBKDF2))
+	assert.NoError(t, writer.Save())
+
+	file, err := LoadPasswordFile(path)
+	require.NoError(t, err)
+
+	file.Watch(10 * time.Millisecond)
+	defer file.Close()
+
+	assert.True(t, file.Verify("user1", "secret1"))
+	assert.False(t, file.Verify("user2", "secret2"))
+
+	// ensure a different modification time
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NoError(t, writer.Set("user2", "secret2", PBKDF2))
+	assert.NoError(t, writer.Save())
+
+	for i := 0; i < 100 && !file.Verify("user2", "secret2"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.True(t, file.Verify("user2", "secret2"))
+}
+
+func TestMemoryBackendCredentialStore(t *testing.T) {
+	file := NewPasswordFile("")
+	assert.NoError(t, file.Set("user", "secret", PBKDF2))
+
+	backend := NewMemoryBackend()
+	backend.CredentialStore = file
+
+	ok, err := backend.Authenticate(nil, "user", "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authenticate(nil, "user", "foo")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,19 @@
+//go:build unix
+// +build unix
+
+package broker
+
+import (
+	"os"
+	"syscall"
+)
+
+func copyOwner(path string, info os.FileInfo) error {
+	// get owner
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	return os.Chown(path, int(stat.Uid), int(stat.Gid))
+}
@@ -0,0 +1,42 @@
+//go:build unix
+// +build unix
+
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordFileSaveOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "gomqtt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passwd")
+
+	err = ioutil.WriteFile(path, nil, 0600)
+	require.NoError(t, err)
+	require.NoError(t, os.Chown(path, 1, 2))
+
+	file, err := LoadPasswordFile(path)
+	require.NoError(t, err)
+	assert.NoError(t, file.Set("user1", "secret1", PBKDF2))
+	assert.NoError(t, file.Save())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	stat := info.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(1), stat.Uid)
+	assert.Equal(t, uint32(2), stat.Gid)
+}
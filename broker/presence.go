@@ -0,0 +1,259 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+)
+
+// A PresenceState denotes whether a client is online or offline.
+type PresenceState string
+
+// The available presence states.
+const (
+	PresenceOnline  PresenceState = "online"
+	PresenceOffline PresenceState = "offline"
+)
+
+// A DisconnectReason describes why a client went offline.
+type DisconnectReason string
+
+// The available disconnect reasons.
+const (
+	// DisconnectClean is used if the client sent a disconnect packet.
+	DisconnectClean DisconnectReason = "clean"
+
+	// DisconnectTimeout is used if the client exceeded its keep alive.
+	DisconnectTimeout DisconnectReason = "timeout"
+
+	// DisconnectTakeover is used if another client connected with the same
+	// client id.
+	DisconnectTakeover DisconnectReason = "takeover"
+
+	// DisconnectError is used if the connection has been closed due to any
+	// other error.
+	DisconnectError DisconnectReason = "error"
+)
+
+// A PresenceMessage is published as the JSON encoded payload of presence
+// messages.
+type PresenceMessage struct {
+	ClientID       string           `json:"client_id"`
+	State          PresenceState    `json:"state"`
+	Time           time.Time        `json:"time"`
+	ConnectedAt    time.Time        `json:"connected_at"`
+	DisconnectedAt *time.Time       `json:"disconnected_at,omitempty"`
+	RemoteAddr     string           `json:"remote_addr,omitempty"`
+	Reason         DisconnectReason `json:"reason,omitempty"`
+	Error          string           `json:"error,omitempty"`
+}
+
+type presenceClient struct {
+	connectedAt time.Time
+	remoteAddr  string
+	clean       bool
+	takeover    bool
+	err         error
+}
+
+// Presence wraps a Backend and publishes retained presence messages whenever
+// a client with a non-empty client id comes online or goes offline. All calls
+// are forwarded to the wrapped Backend.
+type Presence struct {
+	Backend
+
+	// The topic of the presence messages. The "%s" verb is replaced with the
+	// client id.
+	//
+	// Will default to "$presence/%s".
+	Topic string
+
+	// The QOS level of the presence messages.
+	//
+	// Will default to 1.
+	QOS packet.QOS
+
+	// OnError is called with errors returned by the wrapped Backend when
+	// publishing presence messages.
+	OnError func(error)
+
+	clients map[*Client]*presenceClient
+	ids     map[string]*Client
+	mutex   sync.Mutex
+	once    sync.Once
+}
+
+// NewPresence returns a new Presence that wraps the provided Backend.
+func NewPresence(backend Backend) *Presence {
+	return &Presence{
+		Backend: backend,
+		Topic:   "$presence/%s",
+		QOS:     1,
+	}
+}
+
+// Setup will detect session takeovers before forwarding the call.
+func (p *Presence) Setup(client *Client, id string, clean bool) (Session, bool, error) {
+	// mark existing client as taken over
+	if id != "" {
+		p.mutex.Lock()
+		if existing, ok := p.ids[id]; ok && existing != client {
+			if pc, ok := p.clients[existing]; ok {
+				pc.takeover = true
+			}
+		}
+		p.mutex.Unlock()
+	}
+
+	return p.Backend.Setup(client, id, clean)
+}
+
+// Log will publish presence messages for connected and disconnected clients
+// before forwarding the call.
+func (p *Presence) Log(event LogEvent, client *Client, pkt packet.Generic, msg *packet.Message, err error) {
+	// ensure defaults
+	p.start()
+
+	switch event {
+	case LoginConnectSuccess:
+		// ignore clients without id
+		if client.ID() == "" {
+			break
+		}
+
+		// prepare state
+		pc := &presenceClient{
+			connectedAt: time.Now(),
+		}
+
+		// get remote address
+		if client.Conn() != nil && client.Conn().RemoteAddr() != nil {
+			pc.remoteAddr = client.Conn().RemoteAddr().String()
+		}
+
+		// add client
+		p.mutex.Lock()
+		if p.clients == nil {
+			p.clients = make(map[*Client]*presenceClient)
+			p.ids = make(map[string]*Client)
+		}
+		p.clients[client] = pc
+		p.ids[client.ID()] = client
+		p.mutex.Unlock()
+
+		// publish message
+		p.publish(&PresenceMessage{
+			ClientID:    client.ID(),
+			State:       PresenceOnline,
+			Time:        pc.connectedAt,
+			ConnectedAt: pc.connectedAt,
+			RemoteAddr:  pc.remoteAddr,
+		})
+	case ClientDisconnected:
+		// mark disconnect as clean
+		p.mutex.Lock()
+		if pc, ok := p.clients[client]; ok {
+			pc.clean = true
+		}
+		p.mutex.Unlock()
+	case TransportError, SessionError, BackendError, ClientError:
+		// keep first error
+		p.mutex.Lock()
+		if pc, ok := p.clients[client]; ok && pc.err == nil {
+			pc.err = err
+		}
+		p.mutex.Unlock()
+	case LostConnection:
+		// get and remove client
+		p.mutex.Lock()
+		pc, ok := p.clients[client]
+		delete(p.clients, client)
+		if p.ids[client.ID()] == client {
+			delete(p.ids, client.ID())
+		}
+		p.mutex.Unlock()
+
+		// check if client has been online
+		if !ok {
+			break
+		}
+
+		// prepare message
+		now := time.Now()
+		pm := &PresenceMessage{
+			ClientID:       client.ID(),
+			State:          PresenceOffline,
+			Time:           now,
+			ConnectedAt:    pc.connectedAt,
+			DisconnectedAt: &now,
+			RemoteAddr:     pc.remoteAddr,
+			Reason:         pc.reason(),
+		}
+
+		// add error
+		if pm.Reason != DisconnectClean && pm.Reason != DisconnectTakeover && pc.err != nil {
+			pm.Error = pc.err.Error()
+		}
+
+		// publish message
+		p.publish(pm)
+	}
+
+	// forward call
+	p.Backend.Log(event, client, pkt, msg, err)
+}
+
+func (p *Presence) start() {
+	p.once.Do(func() {
+		// apply defaults
+		if p.Topic == "" {
+			p.Topic = "$presence/%s"
+		}
+	})
+}
+
+func (p *Presence) publish(pm *PresenceMessage) {
+	// encode message
+	payload, err := json.Marshal(pm)
+	if err != nil {
+		p.handleError(err)
+		return
+	}
+
+	// publish message
+	err = p.Backend.Publish(nil, &packet.Message{
+		Topic:   fmt.Sprintf(p.Topic, pm.ClientID),
+		Payload: payload,
+		QOS:     p.QOS,
+		Retain:  true,
+	}, nil)
+	if err != nil {
+		p.handleError(err)
+	}
+}
+
+func (p *Presence) handleError(err error) {
+	if p.OnError != nil {
+		p.OnError(err)
+	}
+}
+
+func (pc *presenceClient) reason() DisconnectReason {
+	// check takeover and clean disconnect
+	if pc.takeover {
+		return DisconnectTakeover
+	} else if pc.clean {
+		return DisconnectClean
+	}
+
+	// check timeout
+	if ne, ok := pc.err.(net.Error); ok && ne.Timeout() {
+		return DisconnectTimeout
+	}
+
+	return DisconnectError
+}
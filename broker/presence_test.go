@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/client"
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/qingcloudhx/gomqtt/transport"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresence(t *testing.T) {
+	presence := NewPresence(NewMemoryBackend())
+
+	port, quit, done := Run(NewEngine(presence), "tcp")
+
+	messages := make(chan *PresenceMessage, 10)
+
+	observer := client.New()
+	observer.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+
+		var pm PresenceMessage
+		assert.NoError(t, json.Unmarshal(msg.Payload, &pm))
+		assert.Equal(t, "$presence/"+pm.ClientID, msg.Topic)
+		messages <- &pm
+
+		return nil
+	}
+
+	cf, err := observer.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := observer.Subscribe("$presence/+", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	next := func() *PresenceMessage {
+		select {
+		case pm := <-messages:
+			return pm
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+			return nil
+		}
+	}
+
+	// clean disconnect
+
+	c1 := client.New()
+
+	cf, err = c1.Connect(client.NewConfigWithClientID("tcp://localhost:"+port, "c1"))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	pm := next()
+	assert.Equal(t, "c1", pm.ClientID)
+	assert.Equal(t, PresenceOnline, pm.State)
+	assert.NotEmpty(t, pm.RemoteAddr)
+	assert.False(t, pm.ConnectedAt.IsZero())
+	assert.Nil(t, pm.DisconnectedAt)
+
+	err = c1.Disconnect()
+	assert.NoError(t, err)
+
+	pm = next()
+	assert.Equal(t, "c1", pm.ClientID)
+	assert.Equal(t, PresenceOffline, pm.State)
+	assert.Equal(t, DisconnectClean, pm.Reason)
+	assert.NotNil(t, pm.DisconnectedAt)
+	assert.Empty(t, pm.Error)
+
+	// takeover
+
+	c2 := client.New()
+
+	cf, err = c2.Connect(client.NewConfigWithClientID("tcp://localhost:"+port, "c2"))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	assert.Equal(t, PresenceOnline, next().State)
+
+	c3 := client.New()
+
+	cf, err = c3.Connect(client.NewConfigWithClientID("tcp://localhost:"+port, "c2"))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	pm = next()
+	assert.Equal(t, "c2", pm.ClientID)
+	assert.Equal(t, PresenceOffline, pm.State)
+	assert.Equal(t, DisconnectTakeover, pm.Reason)
+
+	pm = next()
+	assert.Equal(t, "c2", pm.ClientID)
+	assert.Equal(t, PresenceOnline, pm.State)
+
+	err = c3.Disconnect()
+	assert.NoError(t, err)
+
+	assert.Equal(t, DisconnectClean, next().Reason)
+
+	// timeout
+
+	conn, err := transport.Dial("tcp://localhost:" + port)
+	require.NoError(t, err)
+
+	connect := packet.NewConnect()
+	connect.ClientID = "c4"
+	connect.KeepAlive = 1
+	connect.CleanSession = true
+
+	err = conn.Send(connect, false)
+	assert.NoError(t, err)
+
+	pkt, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.CONNACK, pkt.Type())
+
+	assert.Equal(t, PresenceOnline, next().State)
+
+	pm = next()
+	assert.Equal(t, "c4", pm.ClientID)
+	assert.Equal(t, PresenceOffline, pm.State)
+	assert.Equal(t, DisconnectTimeout, pm.Reason)
+	assert.NotEmpty(t, pm.Error)
+
+	// error
+
+	conn, err = transport.Dial("tcp://localhost:" + port)
+	require.NoError(t, err)
+
+	connect.ClientID = "c5"
+	connect.KeepAlive = 30
+
+	err = conn.Send(connect, false)
+	assert.NoError(t, err)
+
+	pkt, err = conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.CONNACK, pkt.Type())
+
+	assert.Equal(t, PresenceOnline, next().State)
+
+	err = conn.Send(packet.NewConnack(), false)
+	assert.NoError(t, err)
+
+	pm = next()
+	assert.Equal(t, "c5", pm.ClientID)
+	assert.Equal(t, PresenceOffline, pm.State)
+	assert.Equal(t, DisconnectError, pm.Reason)
+	assert.Equal(t, ErrUnexpectedPacket.Error(), pm.Error)
+
+	err = observer.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
+
+func TestPresenceZeroValue(t *testing.T) {
+	presence := &Presence{
+		Backend: NewMemoryBackend(),
+	}
+
+	port, quit, done := Run(NewEngine(presence), "tcp")
+
+	messages := make(chan *PresenceMessage, 10)
+
+	observer := client.New()
+	observer.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+
+		var pm PresenceMessage
+		assert.NoError(t, json.Unmarshal(msg.Payload, &pm))
+		assert.Equal(t, "$presence/"+pm.ClientID, msg.Topic)
+		messages <- &pm
+
+		return nil
+	}
+
+	cf, err := observer.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := observer.Subscribe("$presence/+", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	c1 := client.New()
+
+	cf, err = c1.Connect(client.NewConfigWithClientID("tcp://localhost:"+port, "c1"))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	err = c1.Disconnect()
+	assert.NoError(t, err)
+
+	for _, state := range []PresenceState{PresenceOnline, PresenceOffline} {
+		select {
+		case pm := <-messages:
+			assert.Equal(t, "c1", pm.ClientID)
+			assert.Equal(t, state, pm.State)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	err = observer.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
@@ -0,0 +1,220 @@
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/qingcloudhx/gomqtt/topic"
+)
+
+// ErrInvalidTopic is returned by Republish if the expanded topic is empty,
+// contains wildcards or a selected value that is empty or contains topic
+// separators or wildcards.
+var ErrInvalidTopic = errors.New("invalid republish topic")
+
+var placeholder = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// Expand will replace all "${name}" placeholders in the template with the
+// selected values of the result. Missing values are replaced with an empty
+// string.
+func Expand(template string, values map[string]interface{}) string {
+	return placeholder.ReplaceAllStringFunc(template, func(match string) string {
+		// get value
+		value, ok := values[match[2:len(match)-1]]
+		if !ok || value == nil {
+			return ""
+		}
+
+		return fmt.Sprint(value)
+	})
+}
+
+// expandTopic will replace all "${name}" placeholders in the template like
+// Expand, but returns ErrInvalidTopic if a value would alter the topic levels
+// or the resulting topic is not a valid topic.
+func expandTopic(template string, values map[string]interface{}) (string, error) {
+	// expand template
+	var invalid bool
+	expanded := placeholder.ReplaceAllStringFunc(template, func(match string) string {
+		// get value
+		value := Expand(match, values)
+		if value == "" || strings.ContainsAny(value, "/+#") {
+			invalid = true
+		}
+
+		return value
+	})
+	if invalid {
+		return "", ErrInvalidTopic
+	}
+
+	// validate topic
+	expanded, err := topic.Parse(expanded, false)
+	if err != nil {
+		return "", ErrInvalidTopic
+	}
+
+	return expanded, nil
+}
+
+// Republish is an action that publishes the JSON encoded values of the result
+// to another topic on behalf of the broker.
+type Republish struct {
+	// The topic of the published message. It may contain "${name}"
+	// placeholders that are replaced with the selected values. Results are
+	// rejected if a value is empty or contains "/", "+" or "#".
+	Topic string
+
+	// The QOS level of the published message.
+	QOS packet.QOS
+
+	// Whether the published message should be retained.
+	Retain bool
+}
+
+// Execute implements the Action interface.
+func (r *Republish) Execute(engine *Engine, result *Result) error {
+	// expand topic
+	name, err := expandTopic(r.Topic, result.Values)
+	if err != nil {
+		return err
+	}
+
+	// encode payload
+	payload, err := result.Payload()
+	if err != nil {
+		return err
+	}
+
+	// publish message
+	return engine.Republish(&packet.Message{
+		Topic:   name,
+		Payload: payload,
+		QOS:     r.QOS,
+		Retain:  r.Retain,
+	})
+}
+
+// FileSink is an action that appends the JSON encoded values of the result as
+// a single line to a file.
+type FileSink struct {
+	// The path of the file. It is created if it does not exist.
+	Path string
+
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// Execute implements the Action interface.
+func (s *FileSink) Execute(engine *Engine, result *Result) error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// encode payload
+	payload, err := result.Payload()
+	if err != nil {
+		return err
+	}
+
+	// open file
+	if s.file == nil {
+		s.file, err = os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	// write line
+	_, err = s.file.Write(append(payload, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Close will close the file.
+func (s *FileSink) Close() error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check file
+	if s.file == nil {
+		return nil
+	}
+
+	// close file
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+// HTTPSink is an action that posts the JSON encoded values of the result to
+// an HTTP endpoint.
+type HTTPSink struct {
+	// The URL of the endpoint. It may contain "${name}" placeholders that are
+	// replaced with the selected values.
+	URL string
+
+	// Additional headers that are sent with every request.
+	Header http.Header
+
+	// The HTTP client used to send requests. A client with a 10 second timeout
+	// is used if not set.
+	Client *http.Client
+}
+
+// Execute implements the Action interface.
+func (s *HTTPSink) Execute(engine *Engine, result *Result) error {
+	// encode payload
+	payload, err := result.Payload()
+	if err != nil {
+		return err
+	}
+
+	// prepare request
+	url := Expand(s.URL, result.Values)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	// set headers
+	for key, values := range s.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// get client
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	// perform request
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	// close body
+	_ = res.Body.Close()
+
+	// check status
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("rule %s: request to %s failed with status %d", result.Rule.Name, url, res.StatusCode)
+	}
+
+	return nil
+}
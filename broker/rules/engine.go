@@ -0,0 +1,353 @@
+// Package rules implements a rule engine that evaluates SQL-like statements
+// against published messages and executes actions with the results.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/broker"
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/qingcloudhx/gomqtt/topic"
+
+	"gopkg.in/tomb.v2"
+)
+
+// ErrBufferFull is reported if a result has been dropped because the buffer of
+// the engine is full.
+var ErrBufferFull = errors.New("rule engine buffer full")
+
+// A Rule combines a statement with the actions that are executed for every
+// message that is selected by the statement.
+type Rule struct {
+	// The unique name of the rule.
+	Name string
+
+	// The parsed statement.
+	Statement *Statement
+
+	// The executed actions.
+	Actions []Action
+}
+
+// NewRule will parse the statement and return a new rule.
+func NewRule(name, statement string, actions ...Action) (*Rule, error) {
+	// parse statement
+	stmt, err := Parse(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rule{
+		Name:      name,
+		Statement: stmt,
+		Actions:   actions,
+	}, nil
+}
+
+// Evaluate will evaluate the rule against the context. It returns the
+// selected values and whether the condition has been met.
+func (r *Rule) Evaluate(ctx *Context) (map[string]interface{}, bool) {
+	// check condition
+	if r.Statement.Where != nil && !truthy(r.Statement.Where.Evaluate(ctx)) {
+		return nil, false
+	}
+
+	// select fields
+	values := make(map[string]interface{})
+	for _, field := range r.Statement.Fields {
+		// handle star
+		if field.Star {
+			if obj, ok := ctx.Payload.(map[string]interface{}); ok {
+				for key, value := range obj {
+					values[key] = value
+				}
+			} else if ctx.Payload != nil {
+				values["payload"] = ctx.Payload
+			}
+
+			continue
+		}
+
+		values[field.Name] = field.Expression.Evaluate(ctx)
+	}
+
+	return values, true
+}
+
+// A Result is the output of a rule for a single message.
+type Result struct {
+	// The rule that produced the result.
+	Rule *Rule
+
+	// The publishing client.
+	Client *broker.Client
+
+	// The original message.
+	Message *packet.Message
+
+	// The selected values.
+	Values map[string]interface{}
+}
+
+// Payload returns the JSON encoded values.
+func (r *Result) Payload() ([]byte, error) {
+	return json.Marshal(r.Values)
+}
+
+// An Action is executed with the results of a rule.
+type Action interface {
+	// Execute will execute the action with the result.
+	Execute(engine *Engine, result *Result) error
+}
+
+// An Engine wraps a Backend and evaluates the configured rules against every
+// published message. Actions are executed in order by a background worker
+// after the message has been forwarded to the wrapped Backend.
+type Engine struct {
+	broker.Backend
+
+	// The number of results that can be buffered. Further results are dropped.
+	//
+	// Will default to 1000.
+	BufferSize int
+
+	// OnError is called with dropped results and failed actions.
+	OnError func(error)
+
+	rules   []*Rule
+	filters *topic.Tree
+	results chan *Result
+	mutex   sync.RWMutex
+	once    sync.Once
+	tomb    tomb.Tomb
+}
+
+// NewEngine returns a new Engine that wraps the provided Backend.
+func NewEngine(backend broker.Backend, rules ...*Rule) *Engine {
+	// prepare engine
+	e := &Engine{
+		Backend:    backend,
+		BufferSize: 1000,
+		filters:    topic.NewTree(),
+	}
+
+	// add rules
+	for _, rule := range rules {
+		e.Add(rule)
+	}
+
+	return e
+}
+
+// Add will add the rule. An existing rule with the same name is replaced.
+func (e *Engine) Add(rule *Rule) {
+	// acquire mutex
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// remove existing rule
+	e.remove(rule.Name)
+
+	// add rule
+	e.rules = append(e.rules, rule)
+	e.filters.Add(rule.Statement.Filter, rule)
+}
+
+// Remove will remove the rule with the specified name.
+func (e *Engine) Remove(name string) {
+	// acquire mutex
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// remove rule
+	e.remove(name)
+}
+
+// Rules returns the currently configured rules.
+func (e *Engine) Rules() []*Rule {
+	// acquire mutex
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return append([]*Rule(nil), e.rules...)
+}
+
+func (e *Engine) remove(name string) {
+	for i, rule := range e.rules {
+		if rule.Name == name {
+			e.filters.Remove(rule.Statement.Filter, rule)
+			e.rules = append(e.rules[:i], e.rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// Publish will evaluate the rules against the message and queue the results
+// after forwarding the call.
+func (e *Engine) Publish(client *broker.Client, msg *packet.Message, ack broker.Ack) error {
+	// evaluate rules before the message is modified by the backend
+	results := e.evaluate(client, msg.Copy())
+
+	// forward call
+	err := e.Backend.Publish(client, msg, ack)
+	if err != nil {
+		return err
+	}
+
+	// queue results
+	for _, result := range results {
+		e.queue(result)
+	}
+
+	return nil
+}
+
+// Republish will publish the message using the wrapped Backend on behalf of
+// the broker. Messages published this way are not evaluated again.
+func (e *Engine) Republish(msg *packet.Message) error {
+	// the publishing client may have disconnected in the meantime and is
+	// therefore not passed to the backend
+	return e.Backend.Publish(nil, msg, nil)
+}
+
+// Close will stop the engine and attempt to execute the actions of all
+// buffered results within the specified timeout. Actions that implement
+// io.Closer are closed afterwards. It returns false if the timeout has been
+// reached.
+func (e *Engine) Close(timeout time.Duration) bool {
+	// ensure engine is started
+	e.start()
+
+	// stop worker
+	e.tomb.Kill(nil)
+
+	// wait for worker
+	select {
+	case <-e.tomb.Dead():
+	case <-time.After(timeout):
+		return false
+	}
+
+	// close actions
+	for _, rule := range e.Rules() {
+		for _, action := range rule.Actions {
+			if closer, ok := action.(io.Closer); ok {
+				e.handleError(closer.Close())
+			}
+		}
+	}
+
+	return true
+}
+
+func (e *Engine) evaluate(client *broker.Client, msg *packet.Message) []*Result {
+	// acquire mutex
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	// get matching rules
+	matches := e.filters.Match(msg.Topic)
+	if len(matches) == 0 {
+		return nil
+	}
+
+	// prepare context
+	ctx := &Context{
+		Message: msg,
+		Time:    time.Now(),
+	}
+
+	// set client id if available
+	if client != nil {
+		ctx.ClientID = client.ID()
+	}
+
+	// decode payload
+	_ = json.Unmarshal(msg.Payload, &ctx.Payload)
+
+	// evaluate rules in order
+	var results []*Result
+	for _, rule := range e.rules {
+		if !contains(matches, rule) {
+			continue
+		}
+
+		values, ok := rule.Evaluate(ctx)
+		if !ok {
+			continue
+		}
+
+		results = append(results, &Result{
+			Rule:    rule,
+			Client:  client,
+			Message: msg,
+			Values:  values,
+		})
+	}
+
+	return results
+}
+
+func (e *Engine) queue(result *Result) {
+	// ensure engine is started
+	e.start()
+
+	// queue result or drop it if the buffer is full
+	select {
+	case e.results <- result:
+	default:
+		e.handleError(ErrBufferFull)
+	}
+}
+
+func (e *Engine) start() {
+	e.once.Do(func() {
+		e.results = make(chan *Result, e.BufferSize)
+		e.tomb.Go(e.worker)
+	})
+}
+
+func (e *Engine) worker() error {
+	for {
+		select {
+		case result := <-e.results:
+			e.execute(result)
+		case <-e.tomb.Dying():
+			// drain buffer
+			for {
+				select {
+				case result := <-e.results:
+					e.execute(result)
+				default:
+					return tomb.ErrDying
+				}
+			}
+		}
+	}
+}
+
+func (e *Engine) execute(result *Result) {
+	for _, action := range result.Rule.Actions {
+		e.handleError(action.Execute(e, result))
+	}
+}
+
+func (e *Engine) handleError(err error) {
+	if err != nil && e.OnError != nil {
+		e.OnError(err)
+	}
+}
+
+func contains(list []interface{}, value interface{}) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
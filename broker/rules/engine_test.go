@@ -0,0 +1,240 @@
+package rules
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/broker"
+	"github.com/qingcloudhx/gomqtt/client"
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-rules")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var requests []map[string]interface{}
+	var mutex sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var values map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&values))
+		assert.Equal(t, "/s1", r.URL.Path)
+		requests = append(requests, values)
+	}))
+	defer server.Close()
+
+	file := &FileSink{Path: filepath.Join(dir, "out.log")}
+
+	rule, err := NewRule("alerts", "SELECT temp, topic(2) AS device FROM 'sensors/+/data' WHERE temp > 40",
+		&Republish{Topic: "alerts/${device}", QOS: 1},
+		file,
+		&HTTPSink{URL: server.URL + "/${device}"},
+	)
+	require.NoError(t, err)
+
+	engine := NewEngine(broker.NewMemoryBackend(), rule)
+
+	port, quit, done := broker.Run(broker.NewEngine(engine), "tcp")
+
+	c := client.New()
+	wait := make(chan struct{})
+
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		assert.Equal(t, "alerts/s1", msg.Topic)
+		assert.JSONEq(t, `{"temp": 42, "device": "s1"}`, string(msg.Payload))
+		close(wait)
+		return nil
+	}
+
+	cf, err := c.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("alerts/#", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := c.Publish("sensors/s1/data", []byte(`{"temp": 20}`), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	pf, err = c.Publish("sensors/s1/data", []byte(`{"temp": 42}`), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	select {
+	case <-wait:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	<-done
+
+	assert.True(t, engine.Close(time.Second))
+
+	data, err := ioutil.ReadFile(file.Path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 1)
+	assert.JSONEq(t, `{"temp": 42, "device": "s1"}`, lines[0])
+
+	mutex.Lock()
+	assert.Equal(t, []map[string]interface{}{
+		{"temp": 42.0, "device": "s1"},
+	}, requests)
+	mutex.Unlock()
+}
+
+type recordingAction struct {
+	results []*Result
+}
+
+func (a *recordingAction) Execute(engine *Engine, result *Result) error {
+	a.results = append(a.results, result)
+	return nil
+}
+
+func TestEngineRules(t *testing.T) {
+	action := &recordingAction{}
+
+	r1, err := NewRule("r1", "SELECT a FROM 'foo/#'", action)
+	require.NoError(t, err)
+
+	r2, err := NewRule("r2", "SELECT b FROM 'foo/bar'", action)
+	require.NoError(t, err)
+
+	engine := NewEngine(broker.NewMemoryBackend(), r1, r2)
+	assert.Equal(t, []*Rule{r1, r2}, engine.Rules())
+
+	results := engine.evaluate(nil, &packet.Message{Topic: "foo/bar", Payload: []byte(`{"a": 1, "b": 2}`)})
+	assert.Len(t, results, 2)
+	assert.Equal(t, r1, results[0].Rule)
+	assert.Equal(t, r2, results[1].Rule)
+
+	r3, err := NewRule("r1", "SELECT c FROM 'bar'", action)
+	require.NoError(t, err)
+
+	engine.Add(r3)
+	assert.Equal(t, []*Rule{r2, r3}, engine.Rules())
+
+	results = engine.evaluate(nil, &packet.Message{Topic: "foo/bar"})
+	assert.Len(t, results, 1)
+	assert.Equal(t, r2, results[0].Rule)
+
+	engine.Remove("r2")
+	assert.Equal(t, []*Rule{r3}, engine.Rules())
+
+	results = engine.evaluate(nil, &packet.Message{Topic: "foo/bar"})
+	assert.Empty(t, results)
+
+	assert.True(t, engine.Close(time.Second))
+}
+
+type blockingAction struct {
+	release chan struct{}
+}
+
+func (a *blockingAction) Execute(engine *Engine, result *Result) error {
+	<-a.release
+	return nil
+}
+
+func TestEngineRepublishAfterDisconnect(t *testing.T) {
+	gate := &blockingAction{release: make(chan struct{})}
+
+	rule, err := NewRule("forward", "SELECT * FROM 'in'", gate, &Republish{Topic: "out"})
+	require.NoError(t, err)
+
+	lost := make(chan struct{})
+
+	backend := broker.NewMemoryBackend()
+	backend.Logger = func(e broker.LogEvent, c *broker.Client, pkt packet.Generic, msg *packet.Message, err error) {
+		if e == broker.LostConnection && c.ID() == "publisher" {
+			close(lost)
+		}
+	}
+
+	engine := NewEngine(backend, rule)
+
+	port, quit, done := broker.Run(broker.NewEngine(engine), "tcp")
+
+	received := make(chan struct{}, 10)
+
+	subscriber := client.New()
+	subscriber.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		assert.Equal(t, "out", msg.Topic)
+		received <- struct{}{}
+		return nil
+	}
+
+	cf, err := subscriber.Connect(client.NewConfigWithClientID("tcp://localhost:"+port, "subscriber"))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := subscriber.Subscribe("out", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	publisher := client.New()
+
+	cf, err = publisher.Connect(client.NewConfigWithClientID("tcp://localhost:"+port, "publisher"))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	for i := 0; i < 10; i++ {
+		pf, err := publisher.Publish("in", []byte(`{"n": 1}`), 0, false)
+		assert.NoError(t, err)
+		assert.NoError(t, pf.Wait(10*time.Second))
+	}
+
+	err = publisher.Disconnect()
+	assert.NoError(t, err)
+
+	select {
+	case <-lost:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	close(gate.release)
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-received:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	err = subscriber.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	<-done
+
+	assert.True(t, engine.Close(time.Second))
+}
@@ -0,0 +1,296 @@
+package rules
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+)
+
+// A Context provides the data an expression is evaluated against.
+type Context struct {
+	// The evaluated message.
+	Message *packet.Message
+
+	// The ID of the publishing client.
+	ClientID string
+
+	// The decoded JSON payload. It is nil if the payload is not valid JSON.
+	Payload interface{}
+
+	// The time the message has been received.
+	Time time.Time
+}
+
+// An Expression is a parsed expression of a statement.
+type Expression interface {
+	// Evaluate will evaluate the expression against the context.
+	Evaluate(ctx *Context) interface{}
+
+	name() string
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (l *literal) Evaluate(*Context) interface{} {
+	return l.value
+}
+
+func (l *literal) name() string {
+	return fmt.Sprintf("%v", l.value)
+}
+
+type reference struct {
+	path []string
+}
+
+func (r *reference) Evaluate(ctx *Context) interface{} {
+	// walk path
+	value := ctx.Payload
+	for _, key := range r.path {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		value = obj[key]
+	}
+
+	return value
+}
+
+func (r *reference) name() string {
+	return r.path[len(r.path)-1]
+}
+
+type unary struct {
+	op   string
+	expr Expression
+}
+
+func (u *unary) Evaluate(ctx *Context) interface{} {
+	// evaluate expression
+	value := u.expr.Evaluate(ctx)
+
+	switch u.op {
+	case "NOT":
+		b, ok := value.(bool)
+		if !ok {
+			return nil
+		}
+
+		return !b
+	case "-":
+		n, ok := value.(float64)
+		if !ok {
+			return nil
+		}
+
+		return -n
+	}
+
+	return nil
+}
+
+func (u *unary) name() string {
+	return u.expr.name()
+}
+
+type binary struct {
+	op    string
+	left  Expression
+	right Expression
+}
+
+func (b *binary) Evaluate(ctx *Context) interface{} {
+	// handle logical operators
+	switch b.op {
+	case "AND":
+		return truthy(b.left.Evaluate(ctx)) && truthy(b.right.Evaluate(ctx))
+	case "OR":
+		return truthy(b.left.Evaluate(ctx)) || truthy(b.right.Evaluate(ctx))
+	}
+
+	// evaluate operands
+	left := b.left.Evaluate(ctx)
+	right := b.right.Evaluate(ctx)
+
+	// handle equality
+	switch b.op {
+	case "=":
+		return reflect.DeepEqual(left, right)
+	case "!=", "<>":
+		return !reflect.DeepEqual(left, right)
+	}
+
+	// handle strings
+	if ls, ok := left.(string); ok {
+		rs, ok := right.(string)
+		if !ok {
+			return nil
+		}
+
+		switch b.op {
+		case "<":
+			return ls < rs
+		case "<=":
+			return ls <= rs
+		case ">":
+			return ls > rs
+		case ">=":
+			return ls >= rs
+		case "+":
+			return ls + rs
+		}
+
+		return nil
+	}
+
+	// handle numbers
+	ln, ok1 := left.(float64)
+	rn, ok2 := right.(float64)
+	if !ok1 || !ok2 {
+		return nil
+	}
+
+	switch b.op {
+	case "<":
+		return ln < rn
+	case "<=":
+		return ln <= rn
+	case ">":
+		return ln > rn
+	case ">=":
+		return ln >= rn
+	case "+":
+		return ln + rn
+	case "-":
+		return ln - rn
+	case "*":
+		return ln * rn
+	case "/":
+		if rn == 0 {
+			return nil
+		}
+
+		return ln / rn
+	case "%":
+		if rn == 0 {
+			return nil
+		}
+
+		return math.Mod(ln, rn)
+	}
+
+	return nil
+}
+
+func (b *binary) name() string {
+	return b.left.name()
+}
+
+type function func(ctx *Context, args []interface{}) interface{}
+
+var functions = map[string]function{
+	"topic": func(ctx *Context, args []interface{}) interface{} {
+		// return full topic
+		if len(args) == 0 {
+			return ctx.Message.Topic
+		}
+
+		// get index
+		n, ok := args[0].(float64)
+		if !ok {
+			return nil
+		}
+
+		// get segment (1-based)
+		segments := strings.Split(ctx.Message.Topic, "/")
+		if n < 1 || int(n) > len(segments) {
+			return nil
+		}
+
+		return segments[int(n)-1]
+	},
+	"clientid": func(ctx *Context, args []interface{}) interface{} {
+		return ctx.ClientID
+	},
+	"qos": func(ctx *Context, args []interface{}) interface{} {
+		return float64(ctx.Message.QOS)
+	},
+	"retain": func(ctx *Context, args []interface{}) interface{} {
+		return ctx.Message.Retain
+	},
+	"payload": func(ctx *Context, args []interface{}) interface{} {
+		return string(ctx.Message.Payload)
+	},
+	"timestamp": func(ctx *Context, args []interface{}) interface{} {
+		return float64(ctx.Time.UnixNano() / int64(time.Millisecond))
+	},
+	"lower": func(ctx *Context, args []interface{}) interface{} {
+		if len(args) != 1 {
+			return nil
+		}
+
+		s, ok := args[0].(string)
+		if !ok {
+			return nil
+		}
+
+		return strings.ToLower(s)
+	},
+	"upper": func(ctx *Context, args []interface{}) interface{} {
+		if len(args) != 1 {
+			return nil
+		}
+
+		s, ok := args[0].(string)
+		if !ok {
+			return nil
+		}
+
+		return strings.ToUpper(s)
+	},
+	"abs": func(ctx *Context, args []interface{}) interface{} {
+		if len(args) != 1 {
+			return nil
+		}
+
+		n, ok := args[0].(float64)
+		if !ok {
+			return nil
+		}
+
+		return math.Abs(n)
+	},
+}
+
+type call struct {
+	fname string
+	fn    function
+	args  []Expression
+}
+
+func (c *call) Evaluate(ctx *Context) interface{} {
+	// evaluate arguments
+	args := make([]interface{}, 0, len(c.args))
+	for _, arg := range c.args {
+		args = append(args, arg.Evaluate(ctx))
+	}
+
+	return c.fn(ctx, args)
+}
+
+func (c *call) name() string {
+	return c.fname
+}
+
+func truthy(value interface{}) bool {
+	b, ok := value.(bool)
+	return ok && b
+}
@@ -0,0 +1,561 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/qingcloudhx/gomqtt/topic"
+)
+
+// A Statement is a parsed rule of the form:
+//
+//	SELECT <fields> FROM '<topic filter>' [WHERE <condition>]
+//
+// Fields are expressions with optional aliases, "*" selects all fields of the
+// JSON payload.
+type Statement struct {
+	// The selected fields.
+	Fields []Field
+
+	// The topic filter that selects messages.
+	Filter string
+
+	// The optional condition.
+	Where Expression
+}
+
+// A Field is a selected expression.
+type Field struct {
+	// Star is set if the field selects all fields of the payload.
+	Star bool
+
+	// The expression of the field.
+	Expression Expression
+
+	// The name of the field in the result.
+	Name string
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	if t.kind != kind {
+		return false
+	}
+
+	if kind == tokenIdent {
+		return strings.EqualFold(t.text, text)
+	}
+
+	return t.text == text
+}
+
+func lex(input string) ([]token, error) {
+	// prepare list
+	var tokens []token
+
+	// prepare position
+	i := 0
+
+	for i < len(input) {
+		// get character
+		c := rune(input[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			// read quoted string or identifier
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(input) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+
+				if rune(input[i]) == c {
+					// handle escaped quote
+					if i+1 < len(input) && rune(input[i+1]) == c {
+						sb.WriteByte(input[i])
+						i += 2
+						continue
+					}
+
+					i++
+					break
+				}
+
+				sb.WriteByte(input[i])
+				i++
+			}
+
+			if c == '\'' {
+				tokens = append(tokens, token{kind: tokenString, text: sb.String(), value: sb.String(), pos: start})
+			} else {
+				tokens = append(tokens, token{kind: tokenIdent, text: sb.String(), value: true, pos: start})
+			}
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(input) && unicode.IsDigit(rune(input[i+1]))):
+			// read number
+			start := i
+			for i < len(input) && (unicode.IsDigit(rune(input[i])) || input[i] == '.' || input[i] == 'e' || input[i] == 'E' ||
+				((input[i] == '-' || input[i] == '+') && (input[i-1] == 'e' || input[i-1] == 'E'))) {
+				i++
+			}
+
+			num, err := strconv.ParseFloat(input[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at %d", start)
+			}
+
+			tokens = append(tokens, token{kind: tokenNumber, text: input[start:i], value: num, pos: start})
+		case unicode.IsLetter(c) || c == '_' || c == '$':
+			// read identifier
+			start := i
+			for i < len(input) && (unicode.IsLetter(rune(input[i])) || unicode.IsDigit(rune(input[i])) || input[i] == '_' || input[i] == '$') {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenIdent, text: input[start:i], pos: start})
+		default:
+			// read operator
+			start := i
+			op := string(c)
+			if i+1 < len(input) {
+				switch input[i : i+2] {
+				case "<=", ">=", "!=", "<>":
+					op = input[i : i+2]
+				}
+			}
+
+			if !strings.Contains("=<>!+-*/%(),.", string(c)) {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, start)
+			}
+
+			i += len(op)
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: start})
+		}
+	}
+
+	// add end token
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(input)})
+
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse will parse the provided rule statement.
+func Parse(input string) (*Statement, error) {
+	// lex input
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare parser
+	p := &parser{tokens: tokens}
+
+	// parse statement
+	stmt, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+
+	return stmt, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if p.peek().is(kind, text) {
+		p.next()
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		return p.unexpected()
+	}
+
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokenEOF {
+		return fmt.Errorf("unexpected end of statement")
+	}
+
+	return fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+func (p *parser) statement() (*Statement, error) {
+	// prepare statement
+	stmt := &Statement{}
+
+	// parse select
+	err := p.expect(tokenIdent, "SELECT")
+	if err != nil {
+		return nil, err
+	}
+
+	// parse fields
+	for {
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+
+		stmt.Fields = append(stmt.Fields, field)
+
+		if !p.accept(tokenOperator, ",") {
+			break
+		}
+	}
+
+	// parse from
+	err = p.expect(tokenIdent, "FROM")
+	if err != nil {
+		return nil, err
+	}
+
+	// parse filter
+	t := p.next()
+	if t.kind != tokenString {
+		p.pos--
+		return nil, p.unexpected()
+	}
+	// validate filter
+	stmt.Filter, err = topic.Parse(t.text, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", t.text, err.Error())
+	}
+
+	// parse where
+	if p.accept(tokenIdent, "WHERE") {
+		stmt.Where, err = p.expression()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// check end
+	if p.peek().kind != tokenEOF {
+		return nil, p.unexpected()
+	}
+
+	return stmt, nil
+}
+
+func (p *parser) field() (Field, error) {
+	// check star
+	if p.accept(tokenOperator, "*") {
+		return Field{Star: true}, nil
+	}
+
+	// parse expression
+	expr, err := p.expression()
+	if err != nil {
+		return Field{}, err
+	}
+
+	// prepare field
+	field := Field{
+		Expression: expr,
+		Name:       expr.name(),
+	}
+
+	// parse alias
+	if p.accept(tokenIdent, "AS") {
+		t := p.next()
+		if t.kind != tokenIdent {
+			p.pos--
+			return Field{}, p.unexpected()
+		}
+
+		field.Name = t.text
+	}
+
+	return field, nil
+}
+
+func (p *parser) expression() (Expression, error) {
+	return p.or()
+}
+
+func (p *parser) or() (Expression, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokenIdent, "OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binary{op: "OR", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) and() (Expression, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokenIdent, "AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binary{op: "AND", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) not() (Expression, error) {
+	if p.accept(tokenIdent, "NOT") {
+		expr, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+
+		return &unary{op: "NOT", expr: expr}, nil
+	}
+
+	return p.comparison()
+}
+
+func (p *parser) comparison() (Expression, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+
+	// check operator
+	t := p.peek()
+	if t.kind == tokenOperator {
+		switch t.text {
+		case "=", "!=", "<>", "<", "<=", ">", ">=":
+			p.next()
+
+			right, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+
+			return &binary{op: t.text, left: left, right: right}, nil
+		}
+	}
+
+	// check is null
+	if p.accept(tokenIdent, "IS") {
+		negate := p.accept(tokenIdent, "NOT")
+
+		err = p.expect(tokenIdent, "NULL")
+		if err != nil {
+			return nil, err
+		}
+
+		var expr Expression = &binary{op: "=", left: left, right: &literal{}}
+		if negate {
+			expr = &unary{op: "NOT", expr: expr}
+		}
+
+		return expr, nil
+	}
+
+	return left, nil
+}
+
+func (p *parser) additive() (Expression, error) {
+	left, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator || (t.text != "+" && t.text != "-") {
+			return left, nil
+		}
+
+		p.next()
+
+		right, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binary{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) multiplicative() (Expression, error) {
+	left, err := p.negation()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator || (t.text != "*" && t.text != "/" && t.text != "%") {
+			return left, nil
+		}
+
+		p.next()
+
+		right, err := p.negation()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binary{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) negation() (Expression, error) {
+	if p.accept(tokenOperator, "-") {
+		expr, err := p.negation()
+		if err != nil {
+			return nil, err
+		}
+
+		return &unary{op: "-", expr: expr}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *parser) primary() (Expression, error) {
+	// get token
+	t := p.next()
+
+	switch t.kind {
+	case tokenNumber, tokenString:
+		return &literal{value: t.value}, nil
+	case tokenIdent:
+		// handle keywords
+		if t.value == nil {
+			switch strings.ToUpper(t.text) {
+			case "TRUE":
+				return &literal{value: true}, nil
+			case "FALSE":
+				return &literal{value: false}, nil
+			case "NULL":
+				return &literal{}, nil
+			}
+		}
+
+		// handle function calls
+		if t.value == nil && p.accept(tokenOperator, "(") {
+			return p.call(strings.ToLower(t.text))
+		}
+
+		// parse path
+		path := []string{t.text}
+		for p.accept(tokenOperator, ".") {
+			t := p.next()
+			if t.kind != tokenIdent {
+				p.pos--
+				return nil, p.unexpected()
+			}
+
+			path = append(path, t.text)
+		}
+
+		return &reference{path: path}, nil
+	case tokenOperator:
+		if t.text == "(" {
+			expr, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+
+			err = p.expect(tokenOperator, ")")
+			if err != nil {
+				return nil, err
+			}
+
+			return expr, nil
+		}
+	}
+
+	p.pos--
+	return nil, p.unexpected()
+}
+
+func (p *parser) call(name string) (Expression, error) {
+	// check function
+	fn, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+
+	// prepare call
+	c := &call{fname: name, fn: fn}
+
+	// parse arguments
+	if !p.accept(tokenOperator, ")") {
+		for {
+			arg, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+
+			c.args = append(c.args, arg)
+
+			if p.accept(tokenOperator, ")") {
+				break
+			}
+
+			err = p.expect(tokenOperator, ",")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,197 @@
+package rules
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testContext(topic, payload string) *Context {
+	ctx := &Context{
+		Message: &packet.Message{
+			Topic:   topic,
+			Payload: []byte(payload),
+			QOS:     1,
+		},
+		ClientID: "c1",
+		Time:     time.Unix(1, 0),
+	}
+
+	_ = json.Unmarshal(ctx.Message.Payload, &ctx.Payload)
+
+	return ctx
+}
+
+func TestParse(t *testing.T) {
+	stmt, err := Parse("SELECT temp, device.name AS name, topic(2) FROM 'sensors/+/data' WHERE temp > 40")
+	require.NoError(t, err)
+	assert.Equal(t, "sensors/+/data", stmt.Filter)
+	assert.Len(t, stmt.Fields, 3)
+	assert.Equal(t, "temp", stmt.Fields[0].Name)
+	assert.Equal(t, "name", stmt.Fields[1].Name)
+	assert.Equal(t, "topic", stmt.Fields[2].Name)
+	assert.NotNil(t, stmt.Where)
+
+	stmt, err = Parse("select * from '#'")
+	require.NoError(t, err)
+	assert.True(t, stmt.Fields[0].Star)
+	assert.Nil(t, stmt.Where)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"SELECT",
+		"SELECT temp",
+		"SELECT temp FROM",
+		"SELECT temp FROM foo",
+		"SELECT temp FROM 'foo' WHERE",
+		"SELECT temp FROM 'foo' WHERE temp >",
+		"SELECT temp FROM 'foo' bar",
+		"SELECT foo(1) FROM 'foo'",
+		"SELECT 'foo FROM 'foo'",
+		"SELECT temp AS 1 FROM 'foo'",
+		"SELECT temp FROM 'foo' WHERE temp ? 1",
+		"SELECT temp FROM ''",
+		"SELECT temp FROM 'foo/#/bar'",
+		"SELECT temp FROM 'foo+'",
+	} {
+		_, err := Parse(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	ctx := testContext("sensors/s1/data", `{"temp": 42.5, "unit": "C", "device": {"name": "d1"}, "ok": true}`)
+
+	table := []struct {
+		expr  string
+		value interface{}
+	}{
+		{"temp", 42.5},
+		{"device.name", "d1"},
+		{"missing", nil},
+		{"device.missing.deep", nil},
+		{"temp > 40", true},
+		{"temp <= 40", false},
+		{"temp * 2 - 5", 80.0},
+		{"-temp", -42.5},
+		{"temp / 0", nil},
+		{"7 % 4", 3.0},
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"unit = 'C'", true},
+		{"unit <> 'C'", false},
+		{"unit + 'elsius'", "Celsius"},
+		{"unit < 'D'", true},
+		{"unit > 1", nil},
+		{"ok AND temp > 40", true},
+		{"NOT ok OR temp < 40", false},
+		{"missing IS NULL", true},
+		{"temp IS NOT NULL", true},
+		{"topic()", "sensors/s1/data"},
+		{"topic(2)", "s1"},
+		{"topic(4)", nil},
+		{"clientid()", "c1"},
+		{"qos()", 1.0},
+		{"retain()", false},
+		{"timestamp()", 1000.0},
+		{"upper(unit)", "C"},
+		{"lower(unit)", "c"},
+		{"abs(-temp)", 42.5},
+		{`"unit"`, "C"},
+		{"'it''s'", "it's"},
+		{"1e2", 100.0},
+		{"TRUE", true},
+	}
+
+	for _, item := range table {
+		stmt, err := Parse("SELECT " + item.expr + " FROM '#'")
+		require.NoError(t, err, item.expr)
+		assert.Equal(t, item.value, stmt.Fields[0].Expression.Evaluate(ctx), item.expr)
+	}
+}
+
+func TestRuleEvaluate(t *testing.T) {
+	rule, err := NewRule("r1", "SELECT temp, topic(2) AS device FROM 'sensors/+/data' WHERE temp > 40")
+	require.NoError(t, err)
+
+	values, ok := rule.Evaluate(testContext("sensors/s1/data", `{"temp": 42}`))
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{
+		"temp":   42.0,
+		"device": "s1",
+	}, values)
+
+	values, ok = rule.Evaluate(testContext("sensors/s1/data", `{"temp": 12}`))
+	assert.False(t, ok)
+	assert.Nil(t, values)
+
+	values, ok = rule.Evaluate(testContext("sensors/s1/data", `invalid`))
+	assert.False(t, ok)
+	assert.Nil(t, values)
+
+	rule, err = NewRule("r2", "SELECT *, clientid() AS client FROM '#'")
+	require.NoError(t, err)
+
+	values, ok = rule.Evaluate(testContext("foo", `{"a": 1}`))
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{
+		"a":      1.0,
+		"client": "c1",
+	}, values)
+
+	values, ok = rule.Evaluate(testContext("foo", `"bar"`))
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{
+		"payload": "bar",
+		"client":  "c1",
+	}, values)
+}
+
+func TestExpand(t *testing.T) {
+	assert.Equal(t, "alerts/s1/42", Expand("alerts/${device}/${temp}", map[string]interface{}{
+		"device": "s1",
+		"temp":   42.0,
+	}))
+	assert.Equal(t, "alerts//", Expand("alerts/${device}/${none}", map[string]interface{}{
+		"device": nil,
+	}))
+}
+
+func TestExpandTopic(t *testing.T) {
+	values := map[string]interface{}{
+		"device":   "s1",
+		"temp":     42.0,
+		"empty":    "",
+		"level":    "a/b",
+		"single":   "+",
+		"multi":    "#",
+		"wildcard": "a#",
+	}
+
+	name, err := expandTopic("alerts/${device}/${temp}", values)
+	assert.NoError(t, err)
+	assert.Equal(t, "alerts/s1/42", name)
+
+	for _, template := range []string{
+		"",
+		"${empty}",
+		"alerts/${none}",
+		"alerts/${empty}",
+		"alerts/${level}",
+		"alerts/${single}",
+		"alerts/${multi}",
+		"alerts/${wildcard}",
+		"alerts/#",
+		"alerts/+/${device}",
+	} {
+		_, err = expandTopic(template, values)
+		assert.Equal(t, ErrInvalidTopic, err, template)
+	}
+}
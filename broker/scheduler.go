@@ -0,0 +1,364 @@
+package broker
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"gopkg.in/tomb.v2"
+)
+
+// ErrInvalidDelay is returned if a delayed publish is malformed or exceeds the
+// maximum delay.
+var ErrInvalidDelay = errors.New("invalid delay")
+
+// ErrSchedulerClosed is returned if a message is scheduled after the scheduler
+// has been closed.
+var ErrSchedulerClosed = errors.New("scheduler closed")
+
+type scheduledMessage struct {
+	id     uint64
+	msg    *packet.Message
+	cron   *CronSchedule
+	at     time.Time
+	slot   int
+	rounds int
+}
+
+// A Scheduler wraps a Backend and delays the publishing of messages. Clients
+// may delay a message by publishing it to a topic of the form:
+//
+//	$delayed/<seconds>/<topic>
+//
+// Messages may also be scheduled programmatically to be published once or
+// recurring according to a cron expression. Scheduled messages are held in
+// memory using a hashed timer wheel and published using the wrapped Backend
+// without a client once they are due. All other calls are forwarded to the
+// wrapped Backend.
+type Scheduler struct {
+	Backend
+
+	// The prefix that denotes delayed publishes.
+	//
+	// Will default to "$delayed/".
+	Prefix string
+
+	// The maximum delay of a delayed publish. No limit is applied if zero.
+	MaxDelay time.Duration
+
+	// The interval in which the timer wheel advances. Messages are published
+	// with this precision.
+	//
+	// Will default to 100 milliseconds.
+	Resolution time.Duration
+
+	// The number of slots in the timer wheel.
+	//
+	// Will default to 512.
+	Slots int
+
+	// The location used to evaluate cron expressions.
+	//
+	// Will default to the local time zone.
+	Location *time.Location
+
+	// OnError is called with errors returned by the wrapped Backend when
+	// publishing scheduled messages.
+	OnError func(error)
+
+	wheel    []map[uint64]*scheduledMessage
+	messages map[uint64]*scheduledMessage
+	cursor   int
+	nextID   uint64
+	mutex    sync.Mutex
+	once     sync.Once
+	tomb     tomb.Tomb
+}
+
+// NewScheduler returns a new Scheduler that wraps the provided Backend.
+func NewScheduler(backend Backend) *Scheduler {
+	return &Scheduler{
+		Backend:    backend,
+		Prefix:     "$delayed/",
+		Resolution: 100 * time.Millisecond,
+		Slots:      512,
+		Location:   time.Local,
+	}
+}
+
+// Publish will schedule delayed publishes and forward all other calls.
+func (s *Scheduler) Publish(client *Client, msg *packet.Message, ack Ack) error {
+	// ensure scheduler is started
+	s.start()
+
+	// forward call if not delayed
+	if !strings.HasPrefix(msg.Topic, s.Prefix) {
+		return s.Backend.Publish(client, msg, ack)
+	}
+
+	// split topic
+	segments := strings.SplitN(strings.TrimPrefix(msg.Topic, s.Prefix), "/", 2)
+	if len(segments) != 2 || segments[1] == "" {
+		return ErrInvalidDelay
+	}
+
+	// parse delay
+	seconds, err := strconv.ParseUint(segments[0], 10, 32)
+	if err != nil {
+		return ErrInvalidDelay
+	}
+
+	// check delay
+	delay := time.Duration(seconds) * time.Second
+	if s.MaxDelay > 0 && delay > s.MaxDelay {
+		return ErrInvalidDelay
+	}
+
+	// prepare message
+	msg = msg.Copy()
+	msg.Topic = segments[1]
+
+	// schedule message
+	_, err = s.PublishAfter(msg, delay)
+	if err != nil {
+		return err
+	}
+
+	// call ack if provided
+	if ack != nil {
+		ack()
+	}
+
+	return nil
+}
+
+// PublishAfter will schedule the message to be published after the specified
+// delay. It returns an ID that can be used to cancel the message.
+func (s *Scheduler) PublishAfter(msg *packet.Message, delay time.Duration) (uint64, error) {
+	return s.PublishAt(msg, time.Now().Add(delay))
+}
+
+// PublishAt will schedule the message to be published at the specified time.
+// It returns an ID that can be used to cancel the message.
+func (s *Scheduler) PublishAt(msg *packet.Message, at time.Time) (uint64, error) {
+	return s.schedule(&scheduledMessage{
+		msg: msg.Copy(),
+		at:  at,
+	})
+}
+
+// PublishCron will schedule the message to be published repeatedly according
+// to the specified cron expression. It returns an ID that can be used to
+// cancel the message.
+func (s *Scheduler) PublishCron(msg *packet.Message, spec string) (uint64, error) {
+	// ensure scheduler is started
+	s.start()
+
+	// parse cron expression
+	cron, err := ParseCron(spec)
+	if err != nil {
+		return 0, err
+	}
+
+	// get next time
+	at := cron.Next(time.Now().In(s.Location))
+	if at.IsZero() {
+		return 0, ErrInvalidDelay
+	}
+
+	return s.schedule(&scheduledMessage{
+		msg:  msg.Copy(),
+		cron: cron,
+		at:   at,
+	})
+}
+
+// Cancel will cancel the scheduled message with the specified ID. It returns
+// false if the message has already been published or does not exist.
+func (s *Scheduler) Cancel(id uint64) bool {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// get message
+	sm, ok := s.messages[id]
+	if !ok {
+		return false
+	}
+
+	// remove message
+	delete(s.messages, id)
+	delete(s.wheel[sm.slot], id)
+
+	return true
+}
+
+// Pending returns the number of scheduled messages.
+func (s *Scheduler) Pending() int {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.messages)
+}
+
+// Close will stop the scheduler and drop all scheduled messages.
+func (s *Scheduler) Close() {
+	// ensure scheduler is started
+	s.start()
+
+	// stop worker
+	s.tomb.Kill(nil)
+	_ = s.tomb.Wait()
+
+	// drop messages
+	s.mutex.Lock()
+	s.messages = make(map[uint64]*scheduledMessage)
+	for i := range s.wheel {
+		s.wheel[i] = make(map[uint64]*scheduledMessage)
+	}
+	s.mutex.Unlock()
+}
+
+func (s *Scheduler) start() {
+	s.once.Do(func() {
+		// apply defaults
+		if s.Prefix == "" {
+			s.Prefix = "$delayed/"
+		}
+		if s.Resolution <= 0 {
+			s.Resolution = 100 * time.Millisecond
+		}
+		if s.Slots <= 0 {
+			s.Slots = 512
+		}
+		if s.Location == nil {
+			s.Location = time.Local
+		}
+
+		// prepare wheel
+		s.messages = make(map[uint64]*scheduledMessage)
+		s.wheel = make([]map[uint64]*scheduledMessage, s.Slots)
+		for i := range s.wheel {
+			s.wheel[i] = make(map[uint64]*scheduledMessage)
+		}
+
+		// run worker
+		s.tomb.Go(s.worker)
+	})
+}
+
+func (s *Scheduler) schedule(sm *scheduledMessage) (uint64, error) {
+	// ensure scheduler is started
+	s.start()
+
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check if closed
+	if !s.tomb.Alive() {
+		return 0, ErrSchedulerClosed
+	}
+
+	// assign id
+	s.nextID++
+	sm.id = s.nextID
+
+	// insert message
+	s.insert(sm)
+
+	return sm.id, nil
+}
+
+func (s *Scheduler) insert(sm *scheduledMessage) {
+	// calculate ticks (at least one)
+	ticks := int((time.Until(sm.at) + s.Resolution - 1) / s.Resolution)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	// calculate slot and rounds
+	sm.slot = (s.cursor + ticks) % len(s.wheel)
+	sm.rounds = (ticks - 1) / len(s.wheel)
+
+	// add message
+	s.messages[sm.id] = sm
+	s.wheel[sm.slot][sm.id] = sm
+}
+
+func (s *Scheduler) worker() error {
+	// prepare ticker
+	ticker := time.NewTicker(s.Resolution)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// publish due messages
+			for _, sm := range s.advance() {
+				err := s.Backend.Publish(nil, sm.msg.Copy(), nil)
+				if err != nil && s.OnError != nil {
+					s.OnError(err)
+				}
+			}
+		case <-s.tomb.Dying():
+			return tomb.ErrDying
+		}
+	}
+}
+
+func (s *Scheduler) advance() []*scheduledMessage {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// advance cursor
+	s.cursor = (s.cursor + 1) % len(s.wheel)
+
+	// collect due messages
+	var due []*scheduledMessage
+	for id, sm := range s.wheel[s.cursor] {
+		// decrement rounds if not yet due
+		if sm.rounds > 0 {
+			sm.rounds--
+			continue
+		}
+
+		// remove message
+		delete(s.wheel[s.cursor], id)
+		delete(s.messages, id)
+		due = append(due, sm)
+	}
+
+	// sort by time and id
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].at.Equal(due[j].at) {
+			return due[i].id < due[j].id
+		}
+
+		return due[i].at.Before(due[j].at)
+	})
+
+	// reschedule recurring messages
+	for i, sm := range due {
+		if sm.cron != nil {
+			// keep current message
+			due[i] = &scheduledMessage{id: sm.id, msg: sm.msg, at: sm.at}
+
+			// insert with next time
+			next := sm.cron.Next(sm.at)
+			if !next.IsZero() {
+				sm.at = next
+				s.insert(sm)
+			}
+		}
+	}
+
+	return due
+}
@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/client"
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	scheduler := NewScheduler(NewMemoryBackend())
+	scheduler.Resolution = 10 * time.Millisecond
+	defer scheduler.Close()
+
+	port, quit, done := Run(NewEngine(scheduler), "tcp")
+
+	c := client.New()
+	wait := make(chan struct{})
+	var received time.Time
+
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		assert.Equal(t, "test", msg.Topic)
+		assert.Equal(t, []byte("test"), msg.Payload)
+		received = time.Now()
+		close(wait)
+		return nil
+	}
+
+	cf, err := c.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("test", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	published := time.Now()
+
+	pf, err := c.Publish("$delayed/1/test", []byte("test"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	assert.Equal(t, 1, scheduler.Pending())
+
+	safeReceive(wait)
+
+	assert.True(t, received.Sub(published) >= time.Second)
+	assert.Equal(t, 0, scheduler.Pending())
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
+
+func TestSchedulerPublishAt(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	scheduler := NewScheduler(backend)
+	scheduler.Resolution = time.Millisecond
+	scheduler.Slots = 8
+	defer scheduler.Close()
+
+	published := make(chan string, 10)
+
+	recorder := &recordingBackend{Backend: backend, published: published}
+	scheduler.Backend = recorder
+
+	id1, err := scheduler.PublishAfter(&packet.Message{Topic: "c"}, 30*time.Millisecond)
+	assert.NoError(t, err)
+
+	_, err = scheduler.PublishAfter(&packet.Message{Topic: "b"}, 20*time.Millisecond)
+	assert.NoError(t, err)
+
+	_, err = scheduler.PublishAt(&packet.Message{Topic: "a"}, time.Now().Add(-time.Second))
+	assert.NoError(t, err)
+
+	id4, err := scheduler.PublishAfter(&packet.Message{Topic: "d"}, time.Hour)
+	assert.NoError(t, err)
+
+	assert.True(t, scheduler.Cancel(id4))
+	assert.False(t, scheduler.Cancel(id4))
+
+	assert.Equal(t, "a", <-published)
+	assert.Equal(t, "b", <-published)
+	assert.Equal(t, "c", <-published)
+
+	assert.False(t, scheduler.Cancel(id1))
+	assert.Equal(t, 0, scheduler.Pending())
+
+	id, err := scheduler.PublishCron(&packet.Message{Topic: "e"}, "0 0 * * *")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, scheduler.Pending())
+	assert.True(t, scheduler.Cancel(id))
+
+	_, err = scheduler.PublishCron(&packet.Message{Topic: "e"}, "invalid")
+	assert.Error(t, err)
+}
+
+func TestSchedulerInvalidDelay(t *testing.T) {
+	scheduler := NewScheduler(NewMemoryBackend())
+	scheduler.MaxDelay = time.Minute
+	defer scheduler.Close()
+
+	for _, topic := range []string{"$delayed/", "$delayed/1", "$delayed/1/", "$delayed/x/foo", "$delayed/61/foo"} {
+		err := scheduler.Publish(nil, &packet.Message{Topic: topic}, nil)
+		assert.Equal(t, ErrInvalidDelay, err, topic)
+	}
+
+	assert.Equal(t, 0, scheduler.Pending())
+}
+
+func TestSchedulerZeroValue(t *testing.T) {
+	published := make(chan string, 10)
+
+	scheduler := &Scheduler{
+		Backend: &recordingBackend{Backend: NewMemoryBackend(), published: published},
+	}
+	defer scheduler.Close()
+
+	assert.Equal(t, 0, scheduler.Pending())
+	assert.False(t, scheduler.Cancel(1))
+
+	err := scheduler.Publish(nil, &packet.Message{Topic: "a"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", <-published)
+
+	err = scheduler.Publish(nil, &packet.Message{Topic: "$delayed/0/b"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", <-published)
+
+	id, err := scheduler.PublishCron(&packet.Message{Topic: "c"}, "0 0 * * *")
+	assert.NoError(t, err)
+	assert.True(t, scheduler.Cancel(id))
+
+	assert.Equal(t, "$delayed/", scheduler.Prefix)
+	assert.Equal(t, 100*time.Millisecond, scheduler.Resolution)
+	assert.Equal(t, 512, scheduler.Slots)
+	assert.Equal(t, time.Local, scheduler.Location)
+}
+
+func TestSchedulerClosed(t *testing.T) {
+	scheduler := NewScheduler(NewMemoryBackend())
+	scheduler.Close()
+
+	_, err := scheduler.PublishAfter(&packet.Message{Topic: "foo"}, time.Second)
+	assert.Equal(t, ErrSchedulerClosed, err)
+}
+
+type recordingBackend struct {
+	Backend
+
+	published chan string
+}
+
+func (b *recordingBackend) Publish(client *Client, msg *packet.Message, ack Ack) error {
+	b.published <- msg.Topic
+	return b.Backend.Publish(client, msg, ack)
+}
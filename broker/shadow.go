@@ -0,0 +1,466 @@
+package broker
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+)
+
+// A ShadowState contains the sections of a shadow document.
+type ShadowState struct {
+	Desired  map[string]interface{} `json:"desired,omitempty"`
+	Reported map[string]interface{} `json:"reported,omitempty"`
+	Delta    map[string]interface{} `json:"delta,omitempty"`
+}
+
+// A ShadowDocument is the persisted state of a thing.
+type ShadowDocument struct {
+	State     ShadowState `json:"state"`
+	Version   uint64      `json:"version"`
+	Timestamp int64       `json:"timestamp"`
+}
+
+// A ShadowRequest is the payload of update, get and delete requests.
+type ShadowRequest struct {
+	State       ShadowState `json:"state"`
+	Version     uint64      `json:"version,omitempty"`
+	ClientToken string      `json:"client_token,omitempty"`
+}
+
+// A ShadowResponse is the payload of accepted, rejected and delta messages.
+type ShadowResponse struct {
+	State       *ShadowState `json:"state,omitempty"`
+	Version     uint64       `json:"version,omitempty"`
+	Timestamp   int64        `json:"timestamp"`
+	ClientToken string       `json:"client_token,omitempty"`
+	Code        int          `json:"code,omitempty"`
+	Message     string       `json:"message,omitempty"`
+}
+
+// Shadow wraps a Backend and maintains a JSON document with a desired and a
+// reported section for every thing. Clients interact with the documents by
+// publishing requests to the following topics:
+//
+//	$shadow/<thing>/update
+//	$shadow/<thing>/get
+//	$shadow/<thing>/delete
+//
+// Updates are merged into the document, keys set to null are removed and
+// sections set to null are cleared. If a request specifies a version, it must
+// match the current version of the document. Responses are published on behalf
+// of the requesting client to the "/accepted" and "/rejected" sub topics of the
+// request topic. The difference between the desired and the reported section
+// is published as a retained message to "$shadow/<thing>/update/delta" and
+// cleared once the sections match. Requests are not forwarded, all other calls
+// are forwarded to the wrapped Backend.
+type Shadow struct {
+	Backend
+
+	// The store used to persist documents.
+	//
+	// Will default to a MemoryShadowStore.
+	Store ShadowStore
+
+	// The prefix of shadow topics.
+	//
+	// Will default to "$shadow/".
+	Prefix string
+
+	// OnError is called with errors returned by the wrapped Backend when
+	// publishing responses.
+	OnError func(error)
+
+	mutex sync.Mutex
+}
+
+// NewShadow returns a new Shadow that wraps the provided Backend.
+func NewShadow(backend Backend) *Shadow {
+	return &Shadow{
+		Backend: backend,
+		Store:   NewMemoryShadowStore(),
+		Prefix:  "$shadow/",
+	}
+}
+
+// Publish will handle shadow requests and forward all other calls.
+func (s *Shadow) Publish(client *Client, msg *packet.Message, ack Ack) error {
+	// check prefix
+	if !strings.HasPrefix(msg.Topic, s.Prefix) {
+		return s.Backend.Publish(client, msg, ack)
+	}
+
+	// split topic
+	segments := strings.Split(strings.TrimPrefix(msg.Topic, s.Prefix), "/")
+	if len(segments) != 2 || segments[0] == "" {
+		return s.Backend.Publish(client, msg, ack)
+	}
+
+	// get thing and action
+	thing, action := segments[0], segments[1]
+	if action != "update" && action != "get" && action != "delete" {
+		return s.Backend.Publish(client, msg, ack)
+	}
+
+	// decode request
+	var req ShadowRequest
+	if len(msg.Payload) > 0 {
+		err := json.Unmarshal(msg.Payload, &req)
+		if err != nil {
+			s.respond(client, msg, shadowRejected, &ShadowResponse{
+				Code:    400,
+				Message: "invalid JSON",
+			})
+
+			if ack != nil {
+				ack()
+			}
+
+			return nil
+		}
+	}
+
+	// handle request
+	var err error
+	switch action {
+	case "update":
+		err = s.update(client, thing, msg, &req)
+	case "get":
+		err = s.get(client, thing, msg, &req)
+	case "delete":
+		err = s.delete(client, thing, msg, &req)
+	}
+	if err != nil {
+		return err
+	}
+
+	// call ack if provided
+	if ack != nil {
+		ack()
+	}
+
+	return nil
+}
+
+// Document returns the current document of the specified thing or nil if no
+// document exists.
+func (s *Shadow) Document(thing string) (*ShadowDocument, error) {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// load document
+	doc, err := s.Store.Load(thing)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	// compute delta
+	doc.State.Delta = ShadowDelta(doc.State.Desired, doc.State.Reported)
+
+	return doc, nil
+}
+
+const (
+	shadowAccepted = "/accepted"
+	shadowRejected = "/rejected"
+)
+
+func (s *Shadow) update(client *Client, thing string, msg *packet.Message, req *ShadowRequest) error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// get provided sections
+	var raw struct {
+		State map[string]json.RawMessage `json:"state"`
+	}
+	_ = json.Unmarshal(msg.Payload, &raw)
+	_, hasDesired := raw.State["desired"]
+	_, hasReported := raw.State["reported"]
+
+	// check request
+	if !hasDesired && !hasReported {
+		s.respond(client, msg, shadowRejected, &ShadowResponse{
+			Code:        400,
+			Message:     "missing state",
+			ClientToken: req.ClientToken,
+		})
+		return nil
+	}
+
+	// load document
+	doc, err := s.Store.Load(thing)
+	if err != nil {
+		return err
+	}
+
+	// get current delta
+	var oldDelta map[string]interface{}
+	if doc != nil {
+		oldDelta = ShadowDelta(doc.State.Desired, doc.State.Reported)
+	} else {
+		doc = &ShadowDocument{}
+	}
+
+	// check version
+	if req.Version != 0 && req.Version != doc.Version {
+		s.respond(client, msg, shadowRejected, &ShadowResponse{
+			Code:        409,
+			Message:     "version conflict",
+			ClientToken: req.ClientToken,
+		})
+		return nil
+	}
+
+	// clear sections set to null
+	if hasDesired && req.State.Desired == nil {
+		doc.State.Desired = nil
+	}
+	if hasReported && req.State.Reported == nil {
+		doc.State.Reported = nil
+	}
+
+	// merge state
+	doc.State.Desired = mergeShadowState(doc.State.Desired, req.State.Desired)
+	doc.State.Reported = mergeShadowState(doc.State.Reported, req.State.Reported)
+	doc.State.Delta = nil
+	doc.Version++
+	doc.Timestamp = time.Now().Unix()
+
+	// save document
+	err = s.Store.Save(thing, doc)
+	if err != nil {
+		return err
+	}
+
+	// publish accepted response
+	s.respond(client, msg, shadowAccepted, &ShadowResponse{
+		State: &ShadowState{
+			Desired:  req.State.Desired,
+			Reported: req.State.Reported,
+		},
+		Version:     doc.Version,
+		Timestamp:   doc.Timestamp,
+		ClientToken: req.ClientToken,
+	})
+
+	// publish delta if changed
+	delta := ShadowDelta(doc.State.Desired, doc.State.Reported)
+	if !reflect.DeepEqual(delta, oldDelta) {
+		s.publishDelta(client, thing, msg.QOS, delta, doc)
+	}
+
+	return nil
+}
+
+func (s *Shadow) get(client *Client, thing string, msg *packet.Message, req *ShadowRequest) error {
+	// load document
+	doc, err := s.Document(thing)
+	if err != nil {
+		return err
+	}
+
+	// check document
+	if doc == nil {
+		s.respond(client, msg, shadowRejected, &ShadowResponse{
+			Code:        404,
+			Message:     "no shadow exists",
+			ClientToken: req.ClientToken,
+		})
+		return nil
+	}
+
+	// publish document
+	s.respond(client, msg, shadowAccepted, &ShadowResponse{
+		State:       &doc.State,
+		Version:     doc.Version,
+		Timestamp:   doc.Timestamp,
+		ClientToken: req.ClientToken,
+	})
+
+	return nil
+}
+
+func (s *Shadow) delete(client *Client, thing string, msg *packet.Message, req *ShadowRequest) error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// load document
+	doc, err := s.Store.Load(thing)
+	if err != nil {
+		return err
+	}
+
+	// check document
+	if doc == nil {
+		s.respond(client, msg, shadowRejected, &ShadowResponse{
+			Code:        404,
+			Message:     "no shadow exists",
+			ClientToken: req.ClientToken,
+		})
+		return nil
+	}
+
+	// delete document
+	err = s.Store.Delete(thing)
+	if err != nil {
+		return err
+	}
+
+	// publish response
+	s.respond(client, msg, shadowAccepted, &ShadowResponse{
+		Version:     doc.Version,
+		Timestamp:   time.Now().Unix(),
+		ClientToken: req.ClientToken,
+	})
+
+	// clear delta
+	if len(ShadowDelta(doc.State.Desired, doc.State.Reported)) > 0 {
+		s.publishDelta(client, thing, msg.QOS, nil, doc)
+	}
+
+	return nil
+}
+
+func (s *Shadow) publishDelta(client *Client, thing string, qos packet.QOS, delta map[string]interface{}, doc *ShadowDocument) {
+	// prepare message
+	reply := &packet.Message{
+		Topic:  s.Prefix + thing + "/update/delta",
+		QOS:    qos,
+		Retain: true,
+	}
+
+	// encode delta if available
+	if len(delta) > 0 {
+		payload, err := json.Marshal(&ShadowResponse{
+			State:     &ShadowState{Desired: delta},
+			Version:   doc.Version,
+			Timestamp: doc.Timestamp,
+		})
+		if err != nil {
+			s.handleError(err)
+			return
+		}
+
+		reply.Payload = payload
+	}
+
+	// publish message
+	s.publish(client, reply)
+}
+
+func (s *Shadow) respond(client *Client, msg *packet.Message, suffix string, res *ShadowResponse) {
+	// set timestamp
+	if res.Timestamp == 0 {
+		res.Timestamp = time.Now().Unix()
+	}
+
+	// encode response
+	payload, err := json.Marshal(res)
+	if err != nil {
+		s.handleError(err)
+		return
+	}
+
+	// publish response
+	s.publish(client, &packet.Message{
+		Topic:   msg.Topic + suffix,
+		Payload: payload,
+		QOS:     msg.QOS,
+	})
+}
+
+func (s *Shadow) publish(client *Client, msg *packet.Message) {
+	err := s.Backend.Publish(client, msg, nil)
+	if err != nil {
+		s.handleError(err)
+	}
+}
+
+func (s *Shadow) handleError(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+// ShadowDelta returns all desired values that differ from the reported
+// values. Nested objects are compared recursively.
+func ShadowDelta(desired, reported map[string]interface{}) map[string]interface{} {
+	var delta map[string]interface{}
+	for key, value := range desired {
+		// get reported value
+		rep, ok := reported[key]
+
+		// compare nested objects
+		obj1, ok1 := value.(map[string]interface{})
+		obj2, ok2 := rep.(map[string]interface{})
+		if ok1 && ok2 {
+			if sub := ShadowDelta(obj1, obj2); len(sub) > 0 {
+				if delta == nil {
+					delta = make(map[string]interface{})
+				}
+
+				delta[key] = sub
+			}
+
+			continue
+		}
+
+		// compare values
+		if !ok || !reflect.DeepEqual(value, rep) {
+			if delta == nil {
+				delta = make(map[string]interface{})
+			}
+
+			delta[key] = value
+		}
+	}
+
+	return delta
+}
+
+func mergeShadowState(state, update map[string]interface{}) map[string]interface{} {
+	// check update
+	if update == nil {
+		return state
+	}
+
+	// ensure state
+	if state == nil {
+		state = make(map[string]interface{})
+	}
+
+	for key, value := range update {
+		// remove null values
+		if value == nil {
+			delete(state, key)
+			continue
+		}
+
+		// merge nested objects
+		if obj, ok := value.(map[string]interface{}); ok {
+			current, _ := state[key].(map[string]interface{})
+			if merged := mergeShadowState(current, obj); merged != nil {
+				state[key] = merged
+			} else {
+				delete(state, key)
+			}
+
+			continue
+		}
+
+		state[key] = value
+	}
+
+	// unset empty state
+	if len(state) == 0 {
+		return nil
+	}
+
+	return state
+}
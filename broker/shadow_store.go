@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A ShadowStore persists shadow documents.
+type ShadowStore interface {
+	// Load should return the document of the specified thing or nil if no
+	// document exists.
+	Load(thing string) (*ShadowDocument, error)
+
+	// Save should store the document of the specified thing.
+	Save(thing string, doc *ShadowDocument) error
+
+	// Delete should remove the document of the specified thing. It should not
+	// return an error if no document exists.
+	Delete(thing string) error
+}
+
+// MemoryShadowStore is a ShadowStore that keeps documents in memory.
+type MemoryShadowStore struct {
+	docs  map[string][]byte
+	mutex sync.Mutex
+}
+
+// NewMemoryShadowStore returns a new MemoryShadowStore.
+func NewMemoryShadowStore() *MemoryShadowStore {
+	return &MemoryShadowStore{
+		docs: make(map[string][]byte),
+	}
+}
+
+// Load implements the ShadowStore interface.
+func (s *MemoryShadowStore) Load(thing string) (*ShadowDocument, error) {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// get document
+	data, ok := s.docs[thing]
+	if !ok {
+		return nil, nil
+	}
+
+	// decode document
+	var doc ShadowDocument
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// Save implements the ShadowStore interface.
+func (s *MemoryShadowStore) Save(thing string, doc *ShadowDocument) error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// encode document
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	// store document
+	s.docs[thing] = data
+
+	return nil
+}
+
+// Delete implements the ShadowStore interface.
+func (s *MemoryShadowStore) Delete(thing string) error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// remove document
+	delete(s.docs, thing)
+
+	return nil
+}
+
+// FileShadowStore is a ShadowStore that keeps every document in a JSON file
+// in a directory.
+type FileShadowStore struct {
+	dir string
+}
+
+// NewFileShadowStore returns a new FileShadowStore that uses the specified
+// directory. The directory is created if it does not exist.
+func NewFileShadowStore(dir string) (*FileShadowStore, error) {
+	// create directory
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileShadowStore{
+		dir: dir,
+	}, nil
+}
+
+// Load implements the ShadowStore interface.
+func (s *FileShadowStore) Load(thing string) (*ShadowDocument, error) {
+	// read file
+	data, err := ioutil.ReadFile(s.path(thing))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// decode document
+	var doc ShadowDocument
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// Save implements the ShadowStore interface.
+func (s *FileShadowStore) Save(thing string, doc *ShadowDocument) error {
+	// encode document
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	// write temporary file
+	tmp := s.path(thing) + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	// replace file
+	return os.Rename(tmp, s.path(thing))
+}
+
+// Delete implements the ShadowStore interface.
+func (s *FileShadowStore) Delete(thing string) error {
+	// remove file
+	err := os.Remove(s.path(thing))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileShadowStore) path(thing string) string {
+	return filepath.Join(s.dir, url.PathEscape(thing)+".json")
+}
@@ -0,0 +1,370 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/client"
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/qingcloudhx/gomqtt/transport"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeJSON(t *testing.T, data string) map[string]interface{} {
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(data), &m))
+	return m
+}
+
+func TestShadowDelta(t *testing.T) {
+	desired := decodeJSON(t, `{"a": 1, "b": "x", "c": {"d": true, "e": [1, 2]}, "f": 2}`)
+	reported := decodeJSON(t, `{"a": 1, "b": "y", "c": {"d": true, "e": [1]}, "g": 3}`)
+
+	assert.Equal(t, decodeJSON(t, `{"b": "x", "c": {"e": [1, 2]}, "f": 2}`), ShadowDelta(desired, reported))
+	assert.Nil(t, ShadowDelta(reported, reported))
+	assert.Nil(t, ShadowDelta(nil, reported))
+}
+
+func TestMergeShadowState(t *testing.T) {
+	state := decodeJSON(t, `{"a": 1, "b": {"c": 2, "d": 3}}`)
+
+	state = mergeShadowState(state, decodeJSON(t, `{"a": null, "b": {"c": null, "e": 4}, "f": {"g": null}}`))
+	assert.Equal(t, decodeJSON(t, `{"b": {"d": 3, "e": 4}}`), state)
+
+	state = mergeShadowState(state, decodeJSON(t, `{"b": null}`))
+	assert.Nil(t, state)
+
+	assert.Nil(t, mergeShadowState(nil, nil))
+}
+
+func TestShadow(t *testing.T) {
+	shadow := NewShadow(NewMemoryBackend())
+
+	port, quit, done := Run(NewEngine(shadow), "tcp")
+
+	messages := make(chan *packet.Message, 10)
+
+	app := client.New()
+	app.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		messages <- msg
+		return nil
+	}
+
+	next := func() (string, map[string]interface{}) {
+		select {
+		case msg := <-messages:
+			var m map[string]interface{}
+			if len(msg.Payload) > 0 {
+				assert.NoError(t, json.Unmarshal(msg.Payload, &m))
+				delete(m, "timestamp")
+			}
+
+			return msg.Topic, m
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+			return "", nil
+		}
+	}
+
+	cf, err := app.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := app.Subscribe("$shadow/lamp/+/+", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	// get missing shadow
+
+	pf, err := app.Publish("$shadow/lamp/get", nil, 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	topic, res := next()
+	assert.Equal(t, "$shadow/lamp/get/rejected", topic)
+	assert.Equal(t, decodeJSON(t, `{"code": 404, "message": "no shadow exists"}`), res)
+
+	// set desired state while device is offline
+
+	pf, err = app.Publish("$shadow/lamp/update", []byte(`{"state": {"desired": {"on": true}}, "client_token": "t1"}`), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	topic, res = next()
+	assert.Equal(t, "$shadow/lamp/update/accepted", topic)
+	assert.Equal(t, decodeJSON(t, `{"state": {"desired": {"on": true}}, "version": 1, "client_token": "t1"}`), res)
+
+	topic, res = next()
+	assert.Equal(t, "$shadow/lamp/update/delta", topic)
+	assert.Equal(t, decodeJSON(t, `{"state": {"desired": {"on": true}}, "version": 1}`), res)
+
+	// device connects and receives retained delta
+
+	deltas := make(chan *packet.Message, 10)
+
+	device := client.New()
+	device.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		deltas <- msg
+		return nil
+	}
+
+	cf, err = device.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err = device.Subscribe("$shadow/lamp/update/delta", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	select {
+	case msg := <-deltas:
+		res = decodeJSON(t, string(msg.Payload))
+		delete(res, "timestamp")
+		assert.Equal(t, decodeJSON(t, `{"state": {"desired": {"on": true}}, "version": 1}`), res)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// device reports state
+
+	pf, err = device.Publish("$shadow/lamp/update", []byte(`{"state": {"reported": {"on": true}}, "version": 1}`), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	topic, res = next()
+	assert.Equal(t, "$shadow/lamp/update/accepted", topic)
+	assert.Equal(t, decodeJSON(t, `{"state": {"reported": {"on": true}}, "version": 2}`), res)
+
+	topic, res = next()
+	assert.Equal(t, "$shadow/lamp/update/delta", topic)
+	assert.Nil(t, res)
+
+	// version conflict
+
+	pf, err = app.Publish("$shadow/lamp/update", []byte(`{"state": {"desired": {"on": false}}, "version": 1}`), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	topic, res = next()
+	assert.Equal(t, "$shadow/lamp/update/rejected", topic)
+	assert.Equal(t, decodeJSON(t, `{"code": 409, "message": "version conflict"}`), res)
+
+	// invalid request
+
+	pf, err = app.Publish("$shadow/lamp/update", []byte(`invalid`), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	topic, res = next()
+	assert.Equal(t, "$shadow/lamp/update/rejected", topic)
+	assert.Equal(t, decodeJSON(t, `{"code": 400, "message": "invalid JSON"}`), res)
+
+	// get shadow
+
+	pf, err = app.Publish("$shadow/lamp/get", nil, 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	topic, res = next()
+	assert.Equal(t, "$shadow/lamp/get/accepted", topic)
+	assert.Equal(t, decodeJSON(t, `{"state": {"desired": {"on": true}, "reported": {"on": true}}, "version": 2}`), res)
+
+	// delete shadow
+
+	pf, err = app.Publish("$shadow/lamp/delete", nil, 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	topic, res = next()
+	assert.Equal(t, "$shadow/lamp/delete/accepted", topic)
+	assert.Equal(t, decodeJSON(t, `{"version": 2}`), res)
+
+	doc, err := shadow.Document("lamp")
+	assert.NoError(t, err)
+	assert.Nil(t, doc)
+
+	err = device.Disconnect()
+	assert.NoError(t, err)
+
+	err = app.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
+
+type shadowBackend struct {
+	Backend
+
+	clients []*Client
+}
+
+func (b *shadowBackend) Publish(client *Client, msg *packet.Message, ack Ack) error {
+	b.clients = append(b.clients, client)
+	return b.Backend.Publish(client, msg, ack)
+}
+
+func TestShadowRequests(t *testing.T) {
+	backend := &shadowBackend{Backend: NewMemoryBackend()}
+	shadow := NewShadow(backend)
+
+	c := fakeClient("c1")
+
+	update := func(payload string) {
+		err := shadow.Publish(c, &packet.Message{Topic: "$shadow/lamp/update", Payload: []byte(payload)}, nil)
+		assert.NoError(t, err)
+	}
+
+	update(`{"state": {}}`)
+	doc, err := shadow.Document("lamp")
+	assert.NoError(t, err)
+	assert.Nil(t, doc)
+
+	update(`{"state": {"desired": {"on": true}, "reported": {"on": false}}}`)
+	doc, err = shadow.Document("lamp")
+	assert.NoError(t, err)
+	assert.Equal(t, decodeJSON(t, `{"on": true}`), doc.State.Desired)
+
+	update(`{"state": {"desired": null}}`)
+	doc, err = shadow.Document("lamp")
+	assert.NoError(t, err)
+	assert.Nil(t, doc.State.Desired)
+	assert.Equal(t, decodeJSON(t, `{"on": false}`), doc.State.Reported)
+	assert.Equal(t, uint64(2), doc.Version)
+
+	update(`{"state": {"reported": null}}`)
+	doc, err = shadow.Document("lamp")
+	assert.NoError(t, err)
+	assert.Nil(t, doc.State.Reported)
+	assert.Equal(t, uint64(3), doc.Version)
+
+	assert.NotEmpty(t, backend.clients)
+	for _, client := range backend.clients {
+		assert.Equal(t, c, client)
+	}
+}
+
+func TestShadowSmallQueue(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.SessionQueueSize = 1
+
+	var errs []error
+	var mutex sync.Mutex
+
+	shadow := NewShadow(backend)
+	shadow.OnError = func(err error) {
+		mutex.Lock()
+		errs = append(errs, err)
+		mutex.Unlock()
+	}
+
+	port, quit, done := Run(NewEngine(shadow), "tcp")
+
+	conn, err := transport.Dial("tcp://localhost:" + port)
+	require.NoError(t, err)
+	conn.SetReadTimeout(10 * time.Second)
+
+	connect := packet.NewConnect()
+	connect.ClientID = "app"
+	require.NoError(t, conn.Send(connect, false))
+
+	pkt, err := conn.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, packet.CONNACK, pkt.Type())
+
+	subscribe := packet.NewSubscribe()
+	subscribe.ID = 1
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "$shadow/lamp/+/+", QOS: 1}}
+	require.NoError(t, conn.Send(subscribe, false))
+
+	pkt, err = conn.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, packet.SUBACK, pkt.Type())
+
+	// never acknowledge responses so that the requesters own queue fills up
+	for i := 0; i < 20; i++ {
+		publish := packet.NewPublish()
+		publish.ID = packet.ID(i + 2)
+		publish.Message = packet.Message{
+			Topic:   "$shadow/lamp/update",
+			Payload: []byte(`{"state": {"desired": {"on": true}}}`),
+			QOS:     1,
+		}
+		require.NoError(t, conn.Send(publish, false))
+
+		for {
+			pkt, err = conn.Receive()
+			require.NoError(t, err)
+			if pkt.Type() == packet.PUBACK {
+				assert.Equal(t, publish.ID, pkt.(*packet.Puback).ID)
+				break
+			}
+		}
+	}
+
+	doc, err := shadow.Document("lamp")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(20), doc.Version)
+
+	mutex.Lock()
+	assert.NotEmpty(t, errs)
+	for _, err := range errs {
+		assert.Equal(t, ErrQueueFull, err)
+	}
+	mutex.Unlock()
+
+	require.NoError(t, conn.Close())
+
+	close(quit)
+
+	safeReceive(done)
+}
+
+func TestFileShadowStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-shadow")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileShadowStore(dir)
+	require.NoError(t, err)
+
+	doc, err := store.Load("foo/bar")
+	assert.NoError(t, err)
+	assert.Nil(t, doc)
+
+	err = store.Save("foo/bar", &ShadowDocument{
+		State: ShadowState{
+			Desired: map[string]interface{}{"a": 1.0},
+		},
+		Version: 3,
+	})
+	assert.NoError(t, err)
+
+	doc, err = store.Load("foo/bar")
+	assert.NoError(t, err)
+	assert.Equal(t, &ShadowDocument{
+		State: ShadowState{
+			Desired: map[string]interface{}{"a": 1.0},
+		},
+		Version: 3,
+	}, doc)
+
+	err = store.Delete("foo/bar")
+	assert.NoError(t, err)
+
+	err = store.Delete("foo/bar")
+	assert.NoError(t, err)
+
+	doc, err = store.Load("foo/bar")
+	assert.NoError(t, err)
+	assert.Nil(t, doc)
+}
@@ -1,6 +1,12 @@
 package broker
 
-import "time"
+import (
+	"crypto/x509"
+	"net"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/transport"
+)
 
 func safeReceive(ch chan struct{}) {
 	select {
@@ -9,3 +15,24 @@ func safeReceive(ch chan struct{}) {
 	case <-ch:
 	}
 }
+
+type fakeConn struct {
+	transport.Conn
+
+	chain []*x509.Certificate
+}
+
+func (c *fakeConn) PeerCertificates() []*x509.Certificate {
+	return c.chain
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1883}
+}
+
+func fakeClient(id string, chain ...*x509.Certificate) *Client {
+	return &Client{
+		id:   id,
+		conn: &fakeConn{chain: chain},
+	}
+}
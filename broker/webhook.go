@@ -0,0 +1,484 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/qingcloudhx/gomqtt/topic"
+
+	"github.com/jpillora/backoff"
+	"gopkg.in/tomb.v2"
+)
+
+// ErrWebhookBufferFull is reported if an event has been dropped because the
+// buffer of the webhook is full.
+var ErrWebhookBufferFull = errors.New("webhook buffer full")
+
+// A WebhookEventType denotes the type of a WebhookEvent.
+type WebhookEventType string
+
+// The available webhook event types.
+const (
+	// WebhookClientConnected is emitted when a client has been connected.
+	WebhookClientConnected WebhookEventType = "client_connected"
+
+	// WebhookClientDisconnected is emitted when a connected client goes offline.
+	WebhookClientDisconnected WebhookEventType = "client_disconnected"
+
+	// WebhookSubscribed is emitted when a client has subscribed to topics.
+	WebhookSubscribed WebhookEventType = "subscribed"
+
+	// WebhookUnsubscribed is emitted when a client has unsubscribed from topics.
+	WebhookUnsubscribed WebhookEventType = "unsubscribed"
+
+	// WebhookMessagePublished is emitted when a message matching one of the
+	// filters has been published.
+	WebhookMessagePublished WebhookEventType = "message_published"
+)
+
+// A WebhookEvent is delivered as part of a JSON encoded batch to the
+// configured URLs.
+type WebhookEvent struct {
+	Type       WebhookEventType `json:"type"`
+	Time       time.Time        `json:"time"`
+	ClientID   string           `json:"client_id,omitempty"`
+	RemoteAddr string           `json:"remote_addr,omitempty"`
+	Clean      bool             `json:"clean,omitempty"`
+	Topics     []string         `json:"topics,omitempty"`
+	Topic      string           `json:"topic,omitempty"`
+	Payload    []byte           `json:"payload,omitempty"`
+	QOS        packet.QOS       `json:"qos,omitempty"`
+	Retain     bool             `json:"retain,omitempty"`
+}
+
+// A Webhook wraps a Backend and delivers lifecycle events of clients and
+// published messages as HTTP POST requests to the configured URLs. Events are
+// buffered, batched and retried in the background. All calls are forwarded to
+// the wrapped Backend.
+type Webhook struct {
+	Backend
+
+	// The URLs that receive the events.
+	URLs []string
+
+	// The event types that are delivered. All event types are delivered if
+	// empty.
+	Events []WebhookEventType
+
+	// The topic filters that select published messages. No message events are
+	// delivered if empty.
+	Filters []string
+
+	// The maximum number of events sent in one request.
+	//
+	// Will default to 100.
+	BatchSize int
+
+	// The maximum time an event is buffered before the batch is sent.
+	//
+	// Will default to one second.
+	BatchInterval time.Duration
+
+	// The number of events that can be buffered. Further events are dropped.
+	//
+	// Will default to 10000.
+	BufferSize int
+
+	// The number of retries of a failed request. A zero value disables retries
+	// for webhooks not created using NewWebhook.
+	//
+	// Will default to 5.
+	MaxRetries int
+
+	// The minimum and maximum delays between retries.
+	//
+	// Will default to 100 milliseconds and 10 seconds.
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+
+	// Secret enables signing of the request body using HMAC-SHA256. The hex
+	// encoded signature is sent in the "X-Gomqtt-Signature" header.
+	Secret []byte
+
+	// The HTTP client used to send requests.
+	//
+	// Will default to a client with a 10 second timeout.
+	Client *http.Client
+
+	// OnError is called with dropped events and failed requests.
+	OnError func(error)
+
+	connected map[*Client]bool
+	filters   *topic.Tree
+	events    chan *WebhookEvent
+	mutex     sync.Mutex
+	once      sync.Once
+	tomb      tomb.Tomb
+}
+
+// NewWebhook returns a new Webhook that wraps the provided Backend and delivers
+// events to the specified URLs.
+func NewWebhook(backend Backend, urls ...string) *Webhook {
+	return &Webhook{
+		Backend:       backend,
+		URLs:          urls,
+		BatchSize:     100,
+		BatchInterval: time.Second,
+		BufferSize:    10000,
+		MaxRetries:    5,
+		MinRetryDelay: 100 * time.Millisecond,
+		MaxRetryDelay: 10 * time.Second,
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// Subscribe will emit an event after forwarding the call.
+func (w *Webhook) Subscribe(client *Client, subs []packet.Subscription, ack Ack) error {
+	// forward call
+	err := w.Backend.Subscribe(client, subs, ack)
+	if err != nil {
+		return err
+	}
+
+	// collect topics
+	topics := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		topics = append(topics, sub.Topic)
+	}
+
+	// emit event
+	w.emit(&WebhookEvent{
+		Type:   WebhookSubscribed,
+		Topics: topics,
+	}, client)
+
+	return nil
+}
+
+// Unsubscribe will emit an event after forwarding the call.
+func (w *Webhook) Unsubscribe(client *Client, topics []string, ack Ack) error {
+	// forward call
+	err := w.Backend.Unsubscribe(client, topics, ack)
+	if err != nil {
+		return err
+	}
+
+	// emit event
+	w.emit(&WebhookEvent{
+		Type:   WebhookUnsubscribed,
+		Topics: topics,
+	}, client)
+
+	return nil
+}
+
+// Log will emit events for connected and disconnected clients and published
+// messages before forwarding the call.
+func (w *Webhook) Log(event LogEvent, client *Client, pkt packet.Generic, msg *packet.Message, err error) {
+	switch event {
+	case LoginConnectSuccess:
+		// mark client as connected
+		w.mutex.Lock()
+		if w.connected == nil {
+			w.connected = make(map[*Client]bool)
+		}
+		w.connected[client] = false
+		w.mutex.Unlock()
+
+		w.emit(&WebhookEvent{
+			Type: WebhookClientConnected,
+		}, client)
+	case ClientDisconnected:
+		// mark disconnect as clean
+		w.mutex.Lock()
+		if _, ok := w.connected[client]; ok {
+			w.connected[client] = true
+		}
+		w.mutex.Unlock()
+	case LostConnection:
+		// get and remove client
+		w.mutex.Lock()
+		clean, ok := w.connected[client]
+		delete(w.connected, client)
+		w.mutex.Unlock()
+
+		// emit event if client has been connected
+		if ok {
+			w.emit(&WebhookEvent{
+				Type:  WebhookClientDisconnected,
+				Clean: clean,
+			}, client)
+		}
+	case MessagePublished:
+		// check filters
+		if w.matches(msg.Topic) {
+			w.emit(&WebhookEvent{
+				Type:    WebhookMessagePublished,
+				Topic:   msg.Topic,
+				Payload: msg.Payload,
+				QOS:     msg.QOS,
+				Retain:  msg.Retain,
+			}, client)
+		}
+	}
+
+	// forward call
+	w.Backend.Log(event, client, pkt, msg, err)
+}
+
+// Close will stop the webhook and attempt to deliver all buffered events
+// within the specified timeout. It returns false if the timeout has been
+// reached.
+func (w *Webhook) Close(timeout time.Duration) bool {
+	// ensure webhook is started
+	w.start()
+
+	// stop worker
+	w.tomb.Kill(nil)
+
+	// wait for worker
+	select {
+	case <-w.tomb.Dead():
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (w *Webhook) matches(name string) bool {
+	// acquire mutex
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// build tree
+	if w.filters == nil {
+		w.filters = topic.NewTree()
+		for _, filter := range w.Filters {
+			w.filters.Set(filter, true)
+		}
+	}
+
+	return w.filters.MatchFirst(name) != nil
+}
+
+func (w *Webhook) enabled(typ WebhookEventType) bool {
+	// check list
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, t := range w.Events {
+		if t == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *Webhook) emit(event *WebhookEvent, client *Client) {
+	// check type
+	if !w.enabled(event.Type) {
+		return
+	}
+
+	// ensure webhook is started
+	w.start()
+
+	// set time and client info
+	event.Time = time.Now()
+	if client != nil {
+		event.ClientID = client.ID()
+
+		if client.Conn() != nil && client.Conn().RemoteAddr() != nil {
+			event.RemoteAddr = client.Conn().RemoteAddr().String()
+		}
+	}
+
+	// queue event or drop it if the buffer is full
+	select {
+	case w.events <- event:
+	default:
+		w.handleError(ErrWebhookBufferFull)
+	}
+}
+
+func (w *Webhook) start() {
+	w.once.Do(func() {
+		// apply defaults
+		if w.BatchSize <= 0 {
+			w.BatchSize = 100
+		}
+		if w.BatchInterval <= 0 {
+			w.BatchInterval = time.Second
+		}
+		if w.BufferSize <= 0 {
+			w.BufferSize = 10000
+		}
+		if w.MinRetryDelay <= 0 {
+			w.MinRetryDelay = 100 * time.Millisecond
+		}
+		if w.MaxRetryDelay <= 0 {
+			w.MaxRetryDelay = 10 * time.Second
+		}
+		if w.Client == nil {
+			w.Client = &http.Client{
+				Timeout: 10 * time.Second,
+			}
+		}
+
+		w.events = make(chan *WebhookEvent, w.BufferSize)
+		w.tomb.Go(w.worker)
+	})
+}
+
+func (w *Webhook) worker() error {
+	// prepare batch
+	batch := make([]*WebhookEvent, 0, w.BatchSize)
+
+	// prepare timer
+	timer := time.NewTimer(w.BatchInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event := <-w.events:
+			// add event
+			batch = append(batch, event)
+
+			// send batch if full
+			if len(batch) >= w.BatchSize {
+				w.deliver(batch)
+				batch = batch[:0]
+			}
+		case <-timer.C:
+			// send batch if not empty
+			if len(batch) > 0 {
+				w.deliver(batch)
+				batch = batch[:0]
+			}
+
+			// reset timer
+			timer.Reset(w.BatchInterval)
+		case <-w.tomb.Dying():
+			// drain buffer
+		drain:
+			for {
+				select {
+				case event := <-w.events:
+					batch = append(batch, event)
+					if len(batch) >= w.BatchSize {
+						w.deliver(batch)
+						batch = batch[:0]
+					}
+				default:
+					break drain
+				}
+			}
+
+			// send remaining events
+			if len(batch) > 0 {
+				w.deliver(batch)
+			}
+
+			return tomb.ErrDying
+		}
+	}
+}
+
+func (w *Webhook) deliver(batch []*WebhookEvent) {
+	// encode batch
+	body, err := json.Marshal(batch)
+	if err != nil {
+		w.handleError(err)
+		return
+	}
+
+	// deliver to all urls
+	for _, url := range w.URLs {
+		w.post(url, body)
+	}
+}
+
+func (w *Webhook) post(url string, body []byte) {
+	// prepare backoff
+	b := &backoff.Backoff{
+		Min:    w.MinRetryDelay,
+		Max:    w.MaxRetryDelay,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	for attempt := 0; ; attempt++ {
+		// send request
+		err := w.send(url, body)
+		if err == nil {
+			return
+		}
+
+		// give up after the last retry
+		if attempt >= w.MaxRetries {
+			w.handleError(err)
+			return
+		}
+
+		// wait before next retry or give up when closing
+		select {
+		case <-time.After(b.Duration()):
+		case <-w.tomb.Dying():
+			w.handleError(err)
+			return
+		}
+	}
+}
+
+func (w *Webhook) send(url string, body []byte) error {
+	// prepare request
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// set content type
+	req.Header.Set("Content-Type", "application/json")
+
+	// sign body if enabled
+	if len(w.Secret) > 0 {
+		mac := hmac.New(sha256.New, w.Secret)
+		_, _ = mac.Write(body)
+		req.Header.Set("X-Gomqtt-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	// perform request
+	res, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	// close body
+	_ = res.Body.Close()
+
+	// check status
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook request to %s failed with status %d", url, res.StatusCode)
+	}
+
+	return nil
+}
+
+func (w *Webhook) handleError(err error) {
+	if w.OnError != nil {
+		w.OnError(err)
+	}
+}
@@ -0,0 +1,218 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/client"
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookReceiver struct {
+	events   []WebhookEvent
+	failures int
+	mutex    sync.Mutex
+}
+
+func (r *webhookReceiver) handler(t *testing.T, secret []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		if r.failures > 0 {
+			r.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+
+		if secret != nil {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(body)
+			assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), req.Header.Get("X-Gomqtt-Signature"))
+		}
+
+		var batch []WebhookEvent
+		assert.NoError(t, json.Unmarshal(body, &batch))
+		r.events = append(r.events, batch...)
+	})
+}
+
+func (r *webhookReceiver) types() []WebhookEventType {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var list []WebhookEventType
+	for _, e := range r.events {
+		list = append(list, e.Type)
+	}
+
+	return list
+}
+
+func TestWebhook(t *testing.T) {
+	receiver := &webhookReceiver{}
+
+	server := httptest.NewServer(receiver.handler(t, []byte("secret")))
+	defer server.Close()
+
+	lost := make(chan struct{})
+
+	backend := NewMemoryBackend()
+	backend.Logger = func(e LogEvent, c *Client, pkt packet.Generic, msg *packet.Message, err error) {
+		if e == LostConnection {
+			close(lost)
+		}
+	}
+
+	webhook := NewWebhook(backend, server.URL)
+	webhook.Filters = []string{"foo/#"}
+	webhook.Secret = []byte("secret")
+	webhook.BatchInterval = 10 * time.Millisecond
+
+	port, quit, done := Run(NewEngine(webhook), "tcp")
+
+	c := client.New()
+
+	cf, err := c.Connect(client.NewConfigWithClientID("tcp://localhost:"+port, "c1"))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("foo/bar", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := c.Publish("foo/bar", []byte("baz"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	pf, err = c.Publish("bar", []byte("baz"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	uf, err := c.Unsubscribe("foo/bar")
+	assert.NoError(t, err)
+	assert.NoError(t, uf.Wait(10*time.Second))
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(lost)
+
+	close(quit)
+
+	safeReceive(done)
+
+	assert.True(t, webhook.Close(time.Second))
+
+	assert.Equal(t, []WebhookEventType{
+		WebhookClientConnected,
+		WebhookSubscribed,
+		WebhookMessagePublished,
+		WebhookUnsubscribed,
+		WebhookClientDisconnected,
+	}, receiver.types())
+
+	assert.Equal(t, "c1", receiver.events[0].ClientID)
+	assert.NotEmpty(t, receiver.events[0].RemoteAddr)
+	assert.Equal(t, []string{"foo/bar"}, receiver.events[1].Topics)
+	assert.Equal(t, "foo/bar", receiver.events[2].Topic)
+	assert.Equal(t, []byte("baz"), receiver.events[2].Payload)
+	assert.Equal(t, packet.QOS(1), receiver.events[2].QOS)
+	assert.True(t, receiver.events[4].Clean)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	receiver := &webhookReceiver{failures: 2}
+
+	server := httptest.NewServer(receiver.handler(t, nil))
+	defer server.Close()
+
+	webhook := NewWebhook(NewMemoryBackend(), server.URL)
+	webhook.Events = []WebhookEventType{WebhookSubscribed}
+	webhook.MinRetryDelay = time.Millisecond
+	webhook.MaxRetryDelay = time.Millisecond
+	webhook.BatchInterval = time.Millisecond
+
+	c := fakeClient("c1")
+	c.session = newMemorySession(10)
+
+	err := webhook.Subscribe(c, []packet.Subscription{{Topic: "foo"}}, nil)
+	assert.NoError(t, err)
+
+	err = webhook.Unsubscribe(c, []string{"foo"}, nil)
+	assert.NoError(t, err)
+
+	for i := 0; i < 100 && len(receiver.types()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.True(t, webhook.Close(time.Second))
+	assert.Equal(t, []WebhookEventType{WebhookSubscribed}, receiver.types())
+}
+
+func TestWebhookBufferFull(t *testing.T) {
+	var errs []error
+
+	webhook := NewWebhook(NewMemoryBackend())
+	webhook.BufferSize = 1
+	webhook.BatchInterval = time.Hour
+	webhook.BatchSize = 100
+	webhook.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+
+	c := fakeClient("c1")
+	c.session = newMemorySession(10)
+
+	webhook.emit(&WebhookEvent{Type: WebhookSubscribed}, c)
+	webhook.emit(&WebhookEvent{Type: WebhookSubscribed}, c)
+	webhook.emit(&WebhookEvent{Type: WebhookSubscribed}, c)
+
+	assert.True(t, webhook.Close(time.Second))
+	assert.Contains(t, errs, ErrWebhookBufferFull)
+}
+
+func TestWebhookZeroValue(t *testing.T) {
+	receiver := &webhookReceiver{}
+
+	server := httptest.NewServer(receiver.handler(t, nil))
+	defer server.Close()
+
+	webhook := &Webhook{
+		Backend:       NewMemoryBackend(),
+		URLs:          []string{server.URL},
+		BatchInterval: time.Millisecond,
+	}
+
+	c := fakeClient("c1")
+	c.session = newMemorySession(10)
+
+	assert.NotPanics(t, func() {
+		webhook.Log(LoginConnectSuccess, c, nil, nil, nil)
+		webhook.Log(ClientDisconnected, c, nil, nil, nil)
+		webhook.Log(LostConnection, c, nil, nil, nil)
+	})
+
+	for i := 0; i < 100 && len(receiver.types()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.True(t, webhook.Close(time.Second))
+	assert.Equal(t, []WebhookEventType{
+		WebhookClientConnected,
+		WebhookClientDisconnected,
+	}, receiver.types())
+}
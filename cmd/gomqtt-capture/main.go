@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/qingcloudhx/gomqtt/transport"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: gomqtt-capture record [-listen url] [-target url] [-dir directory]")
+	fmt.Fprintln(os.Stderr, "       gomqtt-capture replay [-broker url] [-speed factor] [-received] [-conn id] file")
+	fmt.Fprintln(os.Stderr, "       gomqtt-capture dump file")
+	os.Exit(2)
+}
+
+func main() {
+	// check arguments
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	// run command
+	switch os.Args[1] {
+	case "record":
+		record(os.Args[2:])
+	case "replay":
+		replay(os.Args[2:])
+	case "dump":
+		dump(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func record(args []string) {
+	// parse flags
+	flags := flag.NewFlagSet("record", flag.ExitOnError)
+	listen := flags.String("listen", "tcp://0.0.0.0:1884", "the listen url")
+	target := flags.String("target", "tcp://localhost:1883", "the target broker url")
+	dir := flags.String("dir", ".", "the directory capture files are written to")
+	_ = flags.Parse(args)
+
+	// launch server
+	server, err := transport.Launch(*listen)
+	if err != nil {
+		fail(err)
+	}
+
+	fmt.Printf("Recording connections from %s to %s...\n", server.Addr().String(), *target)
+
+	go func() {
+		finish := make(chan os.Signal, 1)
+		signal.Notify(finish, syscall.SIGINT, syscall.SIGTERM)
+
+		<-finish
+		fmt.Println("Closing...")
+		_ = server.Close()
+	}()
+
+	// accept connections
+	var counter int32
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+
+		// get file name
+		name := fmt.Sprintf("%s-%d.mqttcap", time.Now().Format("20060102-150405"), atomic.AddInt32(&counter, 1))
+
+		go proxy(conn, *target, filepath.Join(*dir, name))
+	}
+}
+
+func proxy(client transport.Conn, target, path string) {
+	// dial target
+	broker, err := transport.Dial(target)
+	if err != nil {
+		fmt.Printf("Failed to dial target: %s\n", err.Error())
+		_ = client.Close()
+		return
+	}
+
+	// create file
+	file, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("Failed to create capture: %s\n", err.Error())
+		_ = client.Close()
+		_ = broker.Close()
+		return
+	}
+	defer file.Close()
+
+	fmt.Printf("Recording %s to %s\n", client.RemoteAddr().String(), path)
+
+	// record broker connection to capture the client perspective
+	captureConn := transport.NewCaptureConn(broker, transport.NewCaptureWriter(file), map[string]string{
+		"client": client.RemoteAddr().String(),
+	})
+
+	// forward packets in both directions
+	errs := make(chan error, 2)
+	go pipe(client, captureConn, errs)
+	go pipe(captureConn, client, errs)
+
+	// wait for first error
+	<-errs
+	_ = client.Close()
+	_ = captureConn.Close()
+	<-errs
+
+	fmt.Printf("Finished recording %s\n", path)
+}
+
+func pipe(src, dst transport.Conn, errs chan<- error) {
+	for {
+		pkt, err := src.Receive()
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		err = dst.Send(pkt, false)
+		if err != nil {
+			errs <- err
+			return
+		}
+	}
+}
+
+func replay(args []string) {
+	// parse flags
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	broker := flags.String("broker", "tcp://localhost:1883", "the broker url")
+	speed := flags.Float64("speed", 1, "the timing factor (0 sends without delays)")
+	received := flags.Bool("received", false, "replay received packets of a broker side capture")
+	conn := flags.Uint64("conn", 0, "the replayed connection (0 selects the first connection)")
+	_ = flags.Parse(args)
+	if flags.NArg() < 1 {
+		usage()
+	}
+
+	// open file
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer file.Close()
+
+	// dial broker
+	brokerConn, err := transport.Dial(*broker)
+	if err != nil {
+		fail(err)
+	}
+
+	// prepare replayer
+	replayer := transport.NewReplayer()
+	replayer.Speed = *speed
+	replayer.Conn = *conn
+	if *received {
+		replayer.Kind = transport.CaptureReceived
+	}
+	replayer.Callback = func(pkt packet.Generic) {
+		fmt.Printf("Received: %s\n", pkt.String())
+	}
+
+	// replay capture
+	err = replayer.Replay(transport.NewCaptureReader(file), brokerConn)
+	if err != nil {
+		fail(err)
+	}
+}
+
+func dump(args []string) {
+	// check arguments
+	if len(args) < 1 {
+		usage()
+	}
+
+	// open file
+	file, err := os.Open(args[0])
+	if err != nil {
+		fail(err)
+	}
+	defer file.Close()
+
+	// print records
+	reader := transport.NewCaptureReader(file)
+	var start time.Time
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fail(err)
+		}
+
+		// get offset
+		if start.IsZero() {
+			start = record.Time
+		}
+		offset := record.Time.Sub(start)
+
+		switch record.Kind {
+		case transport.CaptureMetadata:
+			fmt.Printf("%12s %4d %-8s local=%s remote=%s labels=%v\n", offset, record.Conn, record.Kind, record.Meta.LocalAddr, record.Meta.RemoteAddr, record.Meta.Labels)
+		case transport.CaptureClosed:
+			fmt.Printf("%12s %4d %-8s %s\n", offset, record.Conn, record.Kind, record.Error)
+		default:
+			fmt.Printf("%12s %4d %-8s %s\n", offset, record.Conn, record.Kind, record.Packet.String())
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/qingcloudhx/gomqtt/transport"
+)
+
+var listen = flag.String("listen", "tcp://0.0.0.0:1884", "the listen url")
+var target = flag.String("target", "tcp://localhost:1883", "the target broker url")
+var direction = flag.String("direction", "both", "the direction faults are injected (up, down or both)")
+var seed = flag.Int64("seed", 1, "the seed used for random decisions")
+var latency = flag.Duration("latency", 0, "the latency added to every packet")
+var jitter = flag.Duration("jitter", 0, "the maximum random delay added to every packet")
+var bandwidth = flag.Int64("bandwidth", 0, "the maximum bytes per second")
+var dropRate = flag.Float64("drop-rate", 0, "the probability a packet is dropped")
+var dropTypes = flag.String("drop-types", "", "the comma separated packet types that may be dropped (e.g. puback,pubrec)")
+var corruptRate = flag.Float64("corrupt-rate", 0, "the probability a byte is corrupted")
+var resetAfterPackets = flag.Int("reset-after-packets", 0, "the number of packets after which a connection is reset")
+var resetAfterBytes = flag.Int64("reset-after-bytes", 0, "the number of bytes after which a connection is reset")
+var hangAfterPackets = flag.Int("hang-after-packets", 0, "the number of packets after which a connection hangs")
+
+func main() {
+	flag.Parse()
+
+	// prepare rules
+	rules := transport.FaultRules{
+		Latency:     *latency,
+		Jitter:      *jitter,
+		Bandwidth:   *bandwidth,
+		DropRate:    *dropRate,
+		CorruptRate: *corruptRate,
+	}
+
+	// parse drop types
+	if *dropTypes != "" {
+		for _, name := range strings.Split(*dropTypes, ",") {
+			typ, ok := parseType(strings.TrimSpace(name))
+			if !ok {
+				fail(fmt.Errorf("unknown packet type %q", name))
+			}
+
+			rules.DropTypes = append(rules.DropTypes, typ)
+		}
+	}
+
+	// prepare config
+	config := transport.FaultConfig{
+		Seed:              *seed,
+		ResetAfterPackets: *resetAfterPackets,
+		ResetAfterBytes:   *resetAfterBytes,
+		HangAfterPackets:  *hangAfterPackets,
+	}
+
+	// apply rules to client side connections
+	switch *direction {
+	case "up":
+		config.Receive = rules
+	case "down":
+		config.Send = rules
+	case "both":
+		config.Send = rules
+		config.Receive = rules
+	default:
+		fail(fmt.Errorf("unknown direction %q", *direction))
+	}
+
+	// launch server
+	server, err := transport.Launch(*listen)
+	if err != nil {
+		fail(err)
+	}
+
+	fmt.Printf("Proxying %s to %s...\n", server.Addr().String(), *target)
+
+	go func() {
+		finish := make(chan os.Signal, 1)
+		signal.Notify(finish, syscall.SIGINT, syscall.SIGTERM)
+
+		<-finish
+		fmt.Println("Closing...")
+		_ = server.Close()
+	}()
+
+	// accept connections
+	faultServer := transport.NewFaultServer(server, config)
+	for {
+		conn, err := faultServer.Accept()
+		if err != nil {
+			return
+		}
+
+		go proxy(conn)
+	}
+}
+
+func proxy(client transport.Conn) {
+	fmt.Printf("Accepted connection from %s\n", client.RemoteAddr().String())
+
+	// dial target
+	broker, err := transport.Dial(*target)
+	if err != nil {
+		fmt.Printf("Failed to dial target: %s\n", err.Error())
+		_ = client.Close()
+		return
+	}
+
+	// forward packets in both directions
+	errs := make(chan error, 2)
+	go pipe(client, broker, errs)
+	go pipe(broker, client, errs)
+
+	// wait for first error
+	err = <-errs
+	_ = client.Close()
+	_ = broker.Close()
+
+	fmt.Printf("Closed connection from %s: %s\n", client.RemoteAddr().String(), err.Error())
+}
+
+func pipe(src, dst transport.Conn, errs chan<- error) {
+	for {
+		pkt, err := src.Receive()
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		err = dst.Send(pkt, false)
+		if err != nil {
+			errs <- err
+			return
+		}
+	}
+}
+
+func parseType(name string) (packet.Type, bool) {
+	for typ := packet.CONNECT; typ <= packet.DISCONNECT; typ++ {
+		if strings.EqualFold(typ.String(), name) {
+			return typ, true
+		}
+	}
+
+	return 0, false
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
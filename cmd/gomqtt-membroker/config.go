@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+type config struct {
+	Listeners   []listenerConfig  `yaml:"listeners" toml:"listeners"`
+	Credentials credentialsConfig `yaml:"credentials" toml:"credentials"`
+	Limits      limitsConfig      `yaml:"limits" toml:"limits"`
+	Logging     loggingConfig     `yaml:"logging" toml:"logging"`
+	Admin       adminConfig       `yaml:"admin" toml:"admin"`
+}
+
+type listenerConfig struct {
+	// The URL of the listener e.g. "tls://0.0.0.0:8883".
+	URL string `yaml:"url" toml:"url"`
+
+	// The certificate and key files for tls and wss listeners.
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+
+	// An optional CA file used to verify client certificates.
+	ClientCAFile string `yaml:"client_ca_file" toml:"client_ca_file"`
+
+	// Whether clients must present a valid certificate.
+	RequireClientCert bool `yaml:"require_client_cert" toml:"require_client_cert"`
+}
+
+type credentialsConfig struct {
+	// Plaintext usernames and passwords.
+	Users map[string]string `yaml:"users" toml:"users"`
+
+	// A mosquitto compatible password file.
+	PasswordFile string `yaml:"password_file" toml:"password_file"`
+
+	// The interval in which the password file is checked for changes.
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+}
+
+type limitsConfig struct {
+	SessionQueueSize   int           `yaml:"session_queue_size" toml:"session_queue_size"`
+	KillTimeout        time.Duration `yaml:"kill_timeout" toml:"kill_timeout"`
+	MaximumKeepAlive   time.Duration `yaml:"maximum_keep_alive" toml:"maximum_keep_alive"`
+	ParallelPublishes  int           `yaml:"parallel_publishes" toml:"parallel_publishes"`
+	ParallelSubscribes int           `yaml:"parallel_subscribes" toml:"parallel_subscribes"`
+	InflightMessages   int           `yaml:"inflight_messages" toml:"inflight_messages"`
+	TokenTimeout       time.Duration `yaml:"token_timeout" toml:"token_timeout"`
+	ConnectTimeout     time.Duration `yaml:"connect_timeout" toml:"connect_timeout"`
+	ReadLimit          int64         `yaml:"read_limit" toml:"read_limit"`
+}
+
+type loggingConfig struct {
+	// Whether publish and forward rates are printed every second.
+	Stats bool `yaml:"stats" toml:"stats"`
+
+	// Whether all broker events are printed.
+	Events bool `yaml:"events" toml:"events"`
+}
+
+type adminConfig struct {
+	// The address of the pprof endpoint.
+	Pprof string `yaml:"pprof" toml:"pprof"`
+
+	// The address of the metrics endpoint.
+	Metrics string `yaml:"metrics" toml:"metrics"`
+}
+
+// defaultConfig returns the config used if no config file is provided. It is
+// also used as the base of loaded config files.
+func defaultConfig() *config {
+	return &config{
+		Limits: limitsConfig{
+			SessionQueueSize: 100,
+		},
+		Logging: loggingConfig{
+			Stats: true,
+		},
+		Admin: adminConfig{
+			Pprof: "localhost:6060",
+		},
+	}
+}
+
+// loadConfig reads a TOML, YAML or JSON config file. Files with a ".toml"
+// extension are decoded as TOML, all other files as YAML.
+func loadConfig(path string) (*config, error) {
+	// read file
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare config with defaults
+	cfg := defaultConfig()
+
+	// decode config
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = decodeTOML(data, cfg)
+	} else {
+		// JSON is a subset of YAML
+		err = yaml.UnmarshalStrict(data, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// validate config
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func decodeTOML(data []byte, cfg *config) error {
+	// decode config
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return err
+	}
+
+	// check unknown keys
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return fmt.Errorf("unknown config key %s", keys[0].String())
+	}
+
+	return nil
+}
+
+func (c *config) validate() error {
+	// check listeners
+	if len(c.Listeners) == 0 {
+		return errors.New("no listeners configured")
+	}
+
+	// check listeners
+	for _, l := range c.Listeners {
+		u, err := neturl.ParseRequestURI(l.URL)
+		if err != nil {
+			return err
+		}
+
+		switch u.Scheme {
+		case "tls", "mqtts", "wss":
+			if l.CertFile == "" || l.KeyFile == "" {
+				return fmt.Errorf("listener %s requires a certificate and key file", l.URL)
+			}
+		default:
+			if l.CertFile != "" || l.KeyFile != "" || l.ClientCAFile != "" || l.RequireClientCert {
+				return fmt.Errorf("listener %s does not support TLS settings", l.URL)
+			}
+		}
+	}
+
+	// check credentials
+	if c.Credentials.Users != nil && c.Credentials.PasswordFile != "" {
+		return errors.New("users and password file cannot be configured both")
+	}
+
+	return nil
+}
+
+// tlsConfig returns the TLS configuration of the listener or nil if no
+// certificate has been configured.
+func (l *listenerConfig) tlsConfig() (*tls.Config, error) {
+	// check certificate
+	if l.CertFile == "" {
+		return nil, nil
+	}
+
+	// load certificate
+	cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare config
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	// load client ca
+	if l.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(l.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", l.ClientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// require client certificates
+	if l.RequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
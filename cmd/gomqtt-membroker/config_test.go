@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigExamples(t *testing.T) {
+	yamlConfig, err := loadConfig("example.yml")
+	require.NoError(t, err)
+
+	tomlConfig, err := loadConfig("example.toml")
+	require.NoError(t, err)
+
+	assert.Equal(t, yamlConfig, tomlConfig)
+	assert.Len(t, yamlConfig.Listeners, 4)
+	assert.Equal(t, "passwd", yamlConfig.Credentials.PasswordFile)
+	assert.Equal(t, 10*time.Second, yamlConfig.Credentials.ReloadInterval)
+	assert.Equal(t, 5*time.Minute, yamlConfig.Limits.MaximumKeepAlive)
+	assert.Equal(t, "localhost:9100", yamlConfig.Admin.Metrics)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-membroker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	table := []struct {
+		name   string
+		data   string
+		err    string
+		config func(*config)
+	}{
+		{
+			name: "defaults.yml",
+			data: "listeners:\n  - url: tcp://0.0.0.0:1883\n",
+			config: func(c *config) {
+				c.Listeners = []listenerConfig{{URL: "tcp://0.0.0.0:1883"}}
+			},
+		},
+		{
+			name: "defaults.json",
+			data: `{"listeners": [{"url": "tcp://0.0.0.0:1883"}], "limits": {"session_queue_size": 10}}`,
+			config: func(c *config) {
+				c.Listeners = []listenerConfig{{URL: "tcp://0.0.0.0:1883"}}
+				c.Limits.SessionQueueSize = 10
+			},
+		},
+		{
+			name: "defaults.toml",
+			data: "[[listeners]]\nurl = \"tcp://0.0.0.0:1883\"\n\n[credentials]\nusers = { user = \"secret\" }\n",
+			config: func(c *config) {
+				c.Listeners = []listenerConfig{{URL: "tcp://0.0.0.0:1883"}}
+				c.Credentials.Users = map[string]string{"user": "secret"}
+			},
+		},
+		{
+			name: "unknown.yml",
+			data: "listeners:\n  - url: tcp://0.0.0.0:1883\nfoo: bar\n",
+			err:  "field foo not found",
+		},
+		{
+			name: "unknown.toml",
+			data: "foo = \"bar\"\n\n[[listeners]]\nurl = \"tcp://0.0.0.0:1883\"\n",
+			err:  "unknown config key foo",
+		},
+		{
+			name: "empty.json",
+			data: `{}`,
+			err:  "no listeners configured",
+		},
+		{
+			name: "missing-cert.yml",
+			data: "listeners:\n  - url: tls://0.0.0.0:8883\n",
+			err:  "listener tls://0.0.0.0:8883 requires a certificate and key file",
+		},
+		{
+			name: "plain-cert.yml",
+			data: "listeners:\n  - url: ws://0.0.0.0:8080\n    cert_file: server.pem\n",
+			err:  "listener ws://0.0.0.0:8080 does not support TLS settings",
+		},
+		{
+			name: "plain-ca.toml",
+			data: "[[listeners]]\nurl = \"tcp://0.0.0.0:1883\"\nclient_ca_file = \"ca.pem\"\n",
+			err:  "listener tcp://0.0.0.0:1883 does not support TLS settings",
+		},
+		{
+			name: "credentials.json",
+			data: `{"listeners": [{"url": "tcp://0.0.0.0:1883"}], "credentials": {"users": {"user": "secret"}, "password_file": "passwd"}}`,
+			err:  "users and password file cannot be configured both",
+		},
+	}
+
+	for _, item := range table {
+		path := filepath.Join(dir, item.name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(item.data), 0600))
+
+		cfg, err := loadConfig(path)
+		if item.err != "" {
+			assert.Nil(t, cfg, item.name)
+			if assert.Error(t, err, item.name) {
+				assert.Contains(t, err.Error(), item.err, item.name)
+			}
+
+			continue
+		}
+
+		expected := defaultConfig()
+		item.config(expected)
+
+		assert.NoError(t, err, item.name)
+		assert.Equal(t, expected, cfg, item.name)
+	}
+}
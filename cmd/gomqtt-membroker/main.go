@@ -4,7 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"sync/atomic"
@@ -18,57 +18,164 @@ import (
 
 var url = flag.String("url", "tcp://0.0.0.0:1883", "broker url")
 var sqz = flag.Int("sqz", 100, "session queue size")
+var cfg = flag.String("config", "", "config file (TOML, YAML or JSON)")
 
 func main() {
 	flag.Parse()
 
-	go func() {
-		panic(http.ListenAndServe("localhost:6060", nil))
-	}()
-
-	fmt.Printf("Starting broker on URL %s... ", *url)
+	// get config
+	config := defaultConfig()
+	config.Listeners = []listenerConfig{{URL: *url}}
+	config.Limits.SessionQueueSize = *sqz
+	if *cfg != "" {
+		var err error
+		config, err = loadConfig(*cfg)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	server, err := transport.Launch(*url)
-	if err != nil {
-		panic(err)
+	var published int32
+	var forwarded int32
+	var clients int32
+	var totalPublished int64
+	var totalForwarded int64
+
+	// run pprof endpoint
+	if config.Admin.Pprof != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		go func() {
+			panic(http.ListenAndServe(config.Admin.Pprof, mux))
+		}()
 	}
 
-	fmt.Println("Done!")
+	// run metrics endpoint
+	if config.Admin.Metrics != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			fmt.Fprintf(w, "gomqtt_clients %d\n", atomic.LoadInt32(&clients))
+			fmt.Fprintf(w, "gomqtt_messages_published_total %d\n", atomic.LoadInt64(&totalPublished))
+			fmt.Fprintf(w, "gomqtt_messages_forwarded_total %d\n", atomic.LoadInt64(&totalForwarded))
+		})
+
+		go func() {
+			panic(http.ListenAndServe(config.Admin.Metrics, mux))
+		}()
+	}
 
 	backend := broker.NewMemoryBackend()
-	backend.SessionQueueSize = *sqz
+	backend.ClientMaximumKeepAlive = config.Limits.MaximumKeepAlive
+	backend.ClientParallelPublishes = config.Limits.ParallelPublishes
+	backend.ClientParallelSubscribes = config.Limits.ParallelSubscribes
+	backend.ClientInflightMessages = config.Limits.InflightMessages
+	backend.ClientTokenTimeout = config.Limits.TokenTimeout
+
+	if config.Limits.SessionQueueSize > 0 {
+		backend.SessionQueueSize = config.Limits.SessionQueueSize
+	}
 
-	var published int32
-	var forwarded int32
-	var clients int32
+	if config.Limits.KillTimeout > 0 {
+		backend.KillTimeout = config.Limits.KillTimeout
+	}
+
+	if config.Credentials.Users != nil {
+		backend.Credentials = config.Credentials.Users
+	}
+
+	if config.Credentials.PasswordFile != "" {
+		file, err := broker.LoadPasswordFile(config.Credentials.PasswordFile)
+		if err != nil {
+			panic(err)
+		}
+
+		file.OnError = func(err error) {
+			fmt.Printf("Password file reload failed: %s\n", err.Error())
+		}
+
+		file.Watch(config.Credentials.ReloadInterval, syscall.SIGHUP)
+		defer file.Close()
+
+		backend.CredentialStore = file
+	}
 
 	backend.Logger = func(event broker.LogEvent, client *broker.Client, pkt packet.Generic, msg *packet.Message, err error) {
 		if event == broker.NewConnection {
 			atomic.AddInt32(&clients, 1)
 		} else if event == broker.MessagePublished {
 			atomic.AddInt32(&published, 1)
+			atomic.AddInt64(&totalPublished, 1)
 		} else if event == broker.MessageForwarded {
 			atomic.AddInt32(&forwarded, 1)
+			atomic.AddInt64(&totalForwarded, 1)
 		} else if event == broker.LostConnection {
 			atomic.AddInt32(&clients, -1)
 		}
+
+		if config.Logging.Events {
+			if err != nil {
+				fmt.Printf("[%s] %s\n", event, err.Error())
+			} else if msg != nil {
+				fmt.Printf("[%s] %s\n", event, msg.String())
+			} else if pkt != nil {
+				fmt.Printf("[%s] %s\n", event, pkt.String())
+			} else {
+				fmt.Printf("[%s]\n", event)
+			}
+		}
 	}
 
 	engine := broker.NewEngine(backend)
-	engine.Accept(server)
+	engine.DefaultReadLimit = config.Limits.ReadLimit
+
+	if config.Limits.ConnectTimeout > 0 {
+		engine.ConnectTimeout = config.Limits.ConnectTimeout
+	}
+
+	var servers []transport.Server
+
+	for _, listener := range config.Listeners {
+		fmt.Printf("Starting broker on URL %s... ", listener.URL)
 
-	go func() {
-		for {
-			<-time.After(1 * time.Second)
+		tlsConfig, err := listener.tlsConfig()
+		if err != nil {
+			panic(err)
+		}
 
-			pub := atomic.LoadInt32(&published)
-			fwd := atomic.LoadInt32(&forwarded)
-			fmt.Printf("Publish Rate: %d msg/s, Forward Rate: %d msg/s, Clients: %d\n", pub, fwd, clients)
+		launcher := transport.NewLauncher()
+		launcher.TLSConfig = tlsConfig
 
-			atomic.StoreInt32(&published, 0)
-			atomic.StoreInt32(&forwarded, 0)
+		server, err := launcher.Launch(listener.URL)
+		if err != nil {
+			panic(err)
 		}
-	}()
+
+		fmt.Println("Done!")
+
+		engine.Accept(server)
+		servers = append(servers, server)
+	}
+
+	if config.Logging.Stats {
+		go func() {
+			for {
+				<-time.After(1 * time.Second)
+
+				pub := atomic.LoadInt32(&published)
+				fwd := atomic.LoadInt32(&forwarded)
+				fmt.Printf("Publish Rate: %d msg/s, Forward Rate: %d msg/s, Clients: %d\n", pub, fwd, atomic.LoadInt32(&clients))
+
+				atomic.StoreInt32(&published, 0)
+				atomic.StoreInt32(&forwarded, 0)
+			}
+		}()
+	}
 
 	finish := make(chan os.Signal, 1)
 	signal.Notify(finish, syscall.SIGINT, syscall.SIGTERM)
@@ -82,7 +189,9 @@ func main() {
 
 	backend.Close(5 * time.Second)
 
-	server.Close()
+	for _, server := range servers {
+		server.Close()
+	}
 
 	engine.OnError = nil
 	engine.Close()
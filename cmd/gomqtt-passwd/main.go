@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/qingcloudhx/gomqtt/broker"
+	"golang.org/x/term"
+)
+
+var create = flag.Bool("c", false, "create a new password file")
+var remove = flag.Bool("D", false, "remove the user from the password file")
+var list = flag.Bool("l", false, "list all users of the password file")
+var algorithm = flag.String("alg", "pbkdf2", "the hash algorithm (pbkdf2, bcrypt or argon2)")
+var stdin = flag.Bool("stdin", false, "read the password from the first line of stdin")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: gomqtt-passwd [-c] [-alg algorithm] [-stdin] file user")
+	fmt.Fprintln(os.Stderr, "       gomqtt-passwd -D file user")
+	fmt.Fprintln(os.Stderr, "       gomqtt-passwd -l file")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	// get arguments
+	args := flag.Args()
+	if len(args) < 1 || (!*list && len(args) != 2) {
+		usage()
+	}
+
+	// open file
+	var file *broker.PasswordFile
+	var err error
+	if *create {
+		file = broker.NewPasswordFile(args[0])
+	} else {
+		file, err = broker.LoadPasswordFile(args[0])
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	// list users
+	if *list {
+		for _, user := range file.Users() {
+			fmt.Println(user)
+		}
+
+		return
+	}
+
+	// remove user
+	if *remove {
+		if !file.Remove(args[1]) {
+			fail(fmt.Errorf("user %s not found", args[1]))
+		}
+
+		err = file.Save()
+		if err != nil {
+			fail(err)
+		}
+
+		return
+	}
+
+	// get password
+	password := readPassword()
+
+	// set user
+	err = file.Set(args[1], password, broker.HashAlgorithm(*algorithm))
+	if err != nil {
+		fail(err)
+	}
+
+	// save file
+	err = file.Save()
+	if err != nil {
+		fail(err)
+	}
+}
+
+func readPassword() string {
+	// read line from stdin if requested
+	if *stdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fail(err)
+		}
+
+		return checkPassword(strings.TrimRight(line, "\r\n"))
+	}
+
+	// check terminal
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		fail(fmt.Errorf("stdin is not a terminal, use -stdin to read the password from stdin"))
+	}
+
+	// prompt for password
+	fmt.Fprint(os.Stderr, "Password: ")
+	password := readTerminal(fd)
+
+	// prompt for confirmation
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	if readTerminal(fd) != password {
+		fail(fmt.Errorf("passwords do not match"))
+	}
+
+	return checkPassword(password)
+}
+
+func readTerminal(fd int) string {
+	// read password without echo
+	buf, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		fail(err)
+	}
+
+	return string(buf)
+}
+
+func checkPassword(password string) string {
+	// check password
+	if password == "" {
+		fail(fmt.Errorf("empty password"))
+	}
+
+	return password
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err.Error())
+	os.Exit(1)
+}
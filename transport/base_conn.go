@@ -3,6 +3,7 @@ package transport
 import (
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/qingcloudhx/gomqtt/packet"
@@ -21,6 +22,8 @@ type BaseConn struct {
 	carrier Carrier
 
 	stream *packet.Stream
+	meter  *trafficMeter
+	sched  atomic.Value
 
 	sMutex sync.Mutex
 	rMutex sync.Mutex
@@ -30,9 +33,13 @@ type BaseConn struct {
 
 // NewBaseConn creates a new BaseConn using the specified Carrier.
 func NewBaseConn(c Carrier, maxWriteDelay time.Duration) *BaseConn {
+	// prepare meter
+	meter := newTrafficMeter()
+
 	return &BaseConn{
 		carrier: c,
-		stream:  packet.NewStream(c, c, maxWriteDelay),
+		stream:  packet.NewStream(c, &meteredWriter{writer: c, meter: meter}, maxWriteDelay),
+		meter:   meter,
 	}
 }
 
@@ -41,11 +48,77 @@ func NewBaseConn(c Carrier, maxWriteDelay time.Duration) *BaseConn {
 // stale. Encoding errors are directly returned, but any network errors caught
 // while flushing the buffer asynchronously will be returned on the next call.
 //
-// Note: Only one goroutine can Send at the same time.
+// If the scheduler has been enabled, the packet is queued instead and written
+// by a background goroutine. Synchronous sends still wait until the packet
+// has been written.
+//
+// Note: Only one goroutine can Send at the same time unless the scheduler has
+// been enabled.
 func (c *BaseConn) Send(pkt packet.Generic, async bool) error {
+	// queue packet if scheduled
+	if sched := c.scheduler(); sched != nil {
+		return sched.send(pkt, async, false)
+	}
+
+	// acquire mutex
+	c.sMutex.Lock()
+
+	// check scheduler again
+	if sched := c.scheduler(); sched != nil {
+		c.sMutex.Unlock()
+		return sched.send(pkt, async, false)
+	}
+
+	// write packet
+	defer c.sMutex.Unlock()
+	return c.write(pkt, async)
+}
+
+// TrySend will queue the packet like an asynchronous Send but will return
+// ErrSendQueueFull instead of blocking if the queue is full. Without an
+// enabled scheduler the packet is buffered if no other send is in progress.
+func (c *BaseConn) TrySend(pkt packet.Generic) error {
+	// queue packet if scheduled
+	if sched := c.scheduler(); sched != nil {
+		return sched.send(pkt, true, true)
+	}
+
+	// acquire mutex without waiting
+	if !c.sMutex.TryLock() {
+		return ErrSendQueueFull
+	}
+
+	// check scheduler again
+	if sched := c.scheduler(); sched != nil {
+		c.sMutex.Unlock()
+		return sched.send(pkt, true, true)
+	}
+
+	// write packet
+	defer c.sMutex.Unlock()
+	return c.write(pkt, true)
+}
+
+// EnableScheduler will enable the send scheduler. Queued control and
+// acknowledgement packets will then be written before queued PUBLISH packets
+// while the order of PUBLISH packets is kept. Sends block if the queue of
+// the packet is full. Calling it again has no effect.
+func (c *BaseConn) EnableScheduler(config SchedulerConfig) {
 	c.sMutex.Lock()
 	defer c.sMutex.Unlock()
 
+	// create scheduler once
+	if c.scheduler() == nil {
+		c.sched.Store(newSendScheduler(c, config))
+	}
+}
+
+func (c *BaseConn) scheduler() *sendScheduler {
+	sched, _ := c.sched.Load().(*sendScheduler)
+	return sched
+}
+
+func (c *BaseConn) write(pkt packet.Generic, async bool) error {
 	// write packet
 	err := c.stream.Write(pkt, async)
 	if err != nil {
@@ -55,6 +128,9 @@ func (c *BaseConn) Send(pkt packet.Generic, async bool) error {
 		return err
 	}
 
+	// count packet
+	c.meter.countSent(pkt)
+
 	return nil
 }
 
@@ -76,6 +152,9 @@ func (c *BaseConn) Receive() (packet.Generic, error) {
 		return nil, err
 	}
 
+	// count packet
+	c.meter.countReceived(pkt)
+
 	// reset timeout
 	err = c.resetTimeout()
 	if err != nil {
@@ -87,13 +166,19 @@ func (c *BaseConn) Receive() (packet.Generic, error) {
 
 // Close will close the underlying connection and cleanup resources. It will
 // return an Error if there was an error while closing the underlying
-// connection.
+// connection. If the scheduler has been enabled, queued packets are written
+// before for at most the configured close timeout.
 func (c *BaseConn) Close() error {
 	c.sMutex.Lock()
 	defer c.sMutex.Unlock()
 
-	// flush buffer
-	err1 := c.stream.Flush()
+	// flush buffer or queued packets
+	var err1 error
+	if sched := c.scheduler(); sched != nil {
+		err1 = sched.close()
+	} else {
+		err1 = c.stream.Flush()
+	}
 
 	// close carrier
 	err2 := c.carrier.Close()
@@ -125,6 +210,20 @@ func (c *BaseConn) SetReadTimeout(timeout time.Duration) {
 	_ = c.resetTimeout()
 }
 
+// Stats returns a snapshot of the traffic carried by the connection. Sent
+// packets that have not yet been flushed are reported as buffered.
+func (c *BaseConn) Stats() TrafficStats {
+	// get stats
+	stats := c.meter.stats(true)
+
+	// add queued packets
+	if sched := c.scheduler(); sched != nil {
+		stats.Buffered += atomic.LoadInt64(&sched.queued)
+	}
+
+	return stats
+}
+
 func (c *BaseConn) resetTimeout() error {
 	if c.readTimeout > 0 {
 		return c.carrier.SetReadDeadline(time.Now().Add(c.readTimeout))
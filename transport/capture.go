@@ -0,0 +1,561 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+)
+
+// ErrInvalidCapture is returned by the CaptureReader if the data is not a
+// valid capture.
+var ErrInvalidCapture = errors.New("invalid capture")
+
+var captureMagic = []byte("MQTTCAP\x02")
+
+// CaptureKind denotes the kind of a capture record.
+type CaptureKind byte
+
+// The available capture record kinds.
+const (
+	// CaptureMetadata records hold the connection metadata.
+	CaptureMetadata CaptureKind = iota + 1
+
+	// CaptureSent records hold a packet sent by the recorded connection.
+	CaptureSent
+
+	// CaptureReceived records hold a packet received by the recorded
+	// connection.
+	CaptureReceived
+
+	// CaptureClosed records mark the end of the connection.
+	CaptureClosed
+)
+
+// String returns the name of the kind.
+func (k CaptureKind) String() string {
+	switch k {
+	case CaptureMetadata:
+		return "Metadata"
+	case CaptureSent:
+		return "Sent"
+	case CaptureReceived:
+		return "Received"
+	case CaptureClosed:
+		return "Closed"
+	}
+
+	return "Unknown"
+}
+
+// CaptureMeta holds information about the recorded connection.
+type CaptureMeta struct {
+	LocalAddr  string            `json:"local_addr,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// A CaptureRecord is a single entry of a capture.
+type CaptureRecord struct {
+	Kind CaptureKind
+	Time time.Time
+
+	// The id of the recorded connection. Connections recorded with the same
+	// CaptureWriter have distinct ids.
+	Conn uint64
+
+	// The packet of sent and received records.
+	Packet packet.Generic
+
+	// The metadata of metadata records.
+	Meta *CaptureMeta
+
+	// The error that caused the connection to close.
+	Error string
+}
+
+// A CaptureWriter writes capture records to a writer. A capture starts with a
+// magic header followed by the records. Every record starts with its kind, the
+// connection id as a big endian uint64 and the timestamp in nanoseconds as a
+// big endian int64. Packets are stored in their encoded form while metadata and
+// close records store a length prefixed payload. Multiple connections may be
+// recorded with the same writer, their records are interleaved.
+type CaptureWriter struct {
+	writer  io.Writer
+	encoder *packet.Encoder
+	header  bool
+	nextID  uint64
+	mutex   sync.Mutex
+}
+
+// NewCaptureWriter returns a new CaptureWriter.
+func NewCaptureWriter(writer io.Writer) *CaptureWriter {
+	return &CaptureWriter{
+		writer:  writer,
+		encoder: packet.NewEncoder(writer, 0),
+	}
+}
+
+// Write will write the provided record.
+func (w *CaptureWriter) Write(record *CaptureRecord) error {
+	// acquire mutex
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// prepare buffer
+	var buf bytes.Buffer
+
+	// add magic header once
+	if !w.header {
+		buf.Write(captureMagic)
+	}
+
+	// add kind, connection and time
+	buf.WriteByte(byte(record.Kind))
+	_ = binary.Write(&buf, binary.BigEndian, record.Conn)
+	_ = binary.Write(&buf, binary.BigEndian, record.Time.UnixNano())
+
+	// add payload
+	switch record.Kind {
+	case CaptureMetadata:
+		data, err := json.Marshal(record.Meta)
+		if err != nil {
+			return err
+		}
+
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		buf.Write(data)
+	case CaptureClosed:
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(record.Error)))
+		buf.WriteString(record.Error)
+	case CaptureSent, CaptureReceived:
+	default:
+		return ErrInvalidCapture
+	}
+
+	// write header
+	_, err := w.writer.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// set flag
+	w.header = true
+
+	// write packet
+	if record.Kind == CaptureSent || record.Kind == CaptureReceived {
+		err = w.encoder.Write(record.Packet, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *CaptureWriter) allocate() uint64 {
+	// acquire mutex
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// increment id
+	w.nextID++
+
+	return w.nextID
+}
+
+// A CaptureReader reads capture records from a reader.
+type CaptureReader struct {
+	reader  *bufio.Reader
+	decoder *packet.Decoder
+	header  bool
+}
+
+// NewCaptureReader returns a new CaptureReader.
+func NewCaptureReader(reader io.Reader) *CaptureReader {
+	// the decoder reuses the buffered reader as it is large enough
+	bufReader := bufio.NewReader(reader)
+
+	return &CaptureReader{
+		reader:  bufReader,
+		decoder: packet.NewDecoder(bufReader),
+	}
+}
+
+// Read will return the next record or io.EOF if no more records are
+// available.
+func (r *CaptureReader) Read() (*CaptureRecord, error) {
+	// check magic header once
+	if !r.header {
+		magic := make([]byte, len(captureMagic))
+		_, err := io.ReadFull(r.reader, magic)
+		if err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil || !bytes.Equal(magic, captureMagic) {
+			return nil, ErrInvalidCapture
+		}
+
+		r.header = true
+	}
+
+	// read kind
+	kind, err := r.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// read connection
+	var conn uint64
+	err = binary.Read(r.reader, binary.BigEndian, &conn)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// read time
+	var nanos int64
+	err = binary.Read(r.reader, binary.BigEndian, &nanos)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// prepare record
+	record := &CaptureRecord{
+		Kind: CaptureKind(kind),
+		Time: time.Unix(0, nanos),
+		Conn: conn,
+	}
+
+	switch record.Kind {
+	case CaptureMetadata, CaptureClosed:
+		// read payload
+		payload, err := r.readPayload()
+		if err != nil {
+			return nil, err
+		}
+
+		// parse payload
+		if record.Kind == CaptureMetadata {
+			record.Meta = &CaptureMeta{}
+			err = json.Unmarshal(payload, record.Meta)
+			if err != nil {
+				return nil, ErrInvalidCapture
+			}
+		} else {
+			record.Error = string(payload)
+		}
+	case CaptureSent, CaptureReceived:
+		// decode packet
+		record.Packet, err = r.decoder.Read()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrInvalidCapture
+	}
+
+	return record, nil
+}
+
+func (r *CaptureReader) readPayload() ([]byte, error) {
+	// read length
+	var length uint32
+	err := binary.Read(r.reader, binary.BigEndian, &length)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// read payload
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r.reader, payload)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return payload, nil
+}
+
+// A CaptureConn wraps a Conn and records all sent and received packets.
+// Errors while writing records are ignored to not affect the connection.
+type CaptureConn struct {
+	conn   Conn
+	writer *CaptureWriter
+	id     uint64
+	once   sync.Once
+}
+
+// NewCaptureConn wraps the provided connection and writes the connection
+// metadata with the optional labels. The records of the connection are tagged
+// with a connection id allocated from the writer.
+func NewCaptureConn(conn Conn, writer *CaptureWriter, labels map[string]string) *CaptureConn {
+	// allocate id
+	id := writer.allocate()
+
+	// prepare metadata
+	meta := &CaptureMeta{
+		Labels: labels,
+	}
+	if addr := conn.LocalAddr(); addr != nil {
+		meta.LocalAddr = addr.String()
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		meta.RemoteAddr = addr.String()
+	}
+
+	// write metadata
+	_ = writer.Write(&CaptureRecord{
+		Kind: CaptureMetadata,
+		Time: time.Now(),
+		Conn: id,
+		Meta: meta,
+	})
+
+	return &CaptureConn{
+		conn:   conn,
+		writer: writer,
+		id:     id,
+	}
+}
+
+// ID returns the connection id used for the records of the connection.
+func (c *CaptureConn) ID() uint64 {
+	return c.id
+}
+
+// Send will send the packet using the underlying connection and record it.
+func (c *CaptureConn) Send(pkt packet.Generic, async bool) error {
+	// get time
+	now := time.Now()
+
+	// send packet
+	err := c.conn.Send(pkt, async)
+	if err != nil {
+		c.closed(err)
+		return err
+	}
+
+	// record packet
+	_ = c.writer.Write(&CaptureRecord{
+		Kind:   CaptureSent,
+		Time:   now,
+		Conn:   c.id,
+		Packet: pkt,
+	})
+
+	return nil
+}
+
+// Receive will receive the next packet from the underlying connection and
+// record it.
+func (c *CaptureConn) Receive() (packet.Generic, error) {
+	// receive packet
+	pkt, err := c.conn.Receive()
+	if err != nil {
+		c.closed(err)
+		return nil, err
+	}
+
+	// record packet
+	_ = c.writer.Write(&CaptureRecord{
+		Kind:   CaptureReceived,
+		Time:   time.Now(),
+		Conn:   c.id,
+		Packet: pkt,
+	})
+
+	return pkt, nil
+}
+
+// Close will close the underlying connection.
+func (c *CaptureConn) Close() error {
+	err := c.conn.Close()
+	c.closed(err)
+
+	return err
+}
+
+// Unwrap returns the underlying connection.
+func (c *CaptureConn) Unwrap() Conn {
+	return c.conn
+}
+
+// SetReadLimit will set the read limit of the underlying connection.
+func (c *CaptureConn) SetReadLimit(limit int64) {
+	c.conn.SetReadLimit(limit)
+}
+
+// SetReadTimeout will set the read timeout of the underlying connection.
+func (c *CaptureConn) SetReadTimeout(timeout time.Duration) {
+	c.conn.SetReadTimeout(timeout)
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (c *CaptureConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (c *CaptureConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// PeerCertificates returns the peer certificates of the underlying connection.
+func (c *CaptureConn) PeerCertificates() []*x509.Certificate {
+	return c.conn.PeerCertificates()
+}
+
+// Stats returns the traffic stats of the underlying connection.
+func (c *CaptureConn) Stats() TrafficStats {
+	return c.conn.Stats()
+}
+
+func (c *CaptureConn) closed(err error) {
+	c.once.Do(func() {
+		// prepare record
+		record := &CaptureRecord{
+			Kind: CaptureClosed,
+			Time: time.Now(),
+			Conn: c.id,
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+
+		// write record
+		_ = c.writer.Write(record)
+	})
+}
+
+// The Replayer sends the packets of a recorded session using a connection
+// while keeping the original timing between them. It is used to reproduce the
+// behaviour of a recorded client against a broker.
+type Replayer struct {
+	// The factor by which the timing is accelerated. Packets are sent
+	// without any delay if zero.
+	Speed float64
+
+	// The kind of records that are sent. CaptureSent must be used for
+	// captures recorded on the client side and CaptureReceived for captures
+	// recorded on the broker side.
+	//
+	// Will default to CaptureSent.
+	Kind CaptureKind
+
+	// The id of the replayed connection. Records of other connections are
+	// skipped.
+	//
+	// Will default to the connection of the first record.
+	Conn uint64
+
+	// The optional callback that is called with packets received from the
+	// connection.
+	Callback func(packet.Generic)
+}
+
+// NewReplayer returns a new Replayer that keeps the original timing.
+func NewReplayer() *Replayer {
+	return &Replayer{
+		Speed: 1,
+	}
+}
+
+// Replay will send the recorded packets read from the reader using the
+// provided connection. The connection is closed once all records have been
+// read or the first closed record has been reached.
+func (r *Replayer) Replay(reader *CaptureReader, conn Conn) error {
+	// receive packets in background
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for {
+			pkt, err := conn.Receive()
+			if err != nil {
+				return
+			}
+
+			if r.Callback != nil {
+				r.Callback(pkt)
+			}
+		}
+	}()
+
+	// send packets
+	err := r.send(reader, conn)
+
+	// close connection
+	closeErr := conn.Close()
+	<-done
+
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+func (r *Replayer) send(reader *CaptureReader, conn Conn) error {
+	// get kind
+	kind := r.Kind
+	if kind == 0 {
+		kind = CaptureSent
+	}
+
+	// get connection
+	id := r.Conn
+	selected := id != 0
+
+	// prepare timing
+	var first time.Time
+	var start time.Time
+
+	for {
+		// read next record
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// select connection of first record by default
+		if !selected {
+			id = record.Conn
+			selected = true
+		}
+
+		// skip other records
+		if record.Conn != id || (record.Kind != kind && record.Kind != CaptureClosed) {
+			continue
+		}
+
+		// delay record according to timing
+		if first.IsZero() {
+			first = record.Time
+			start = time.Now()
+		} else if r.Speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(first)) / r.Speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+
+		// stop at end of connection
+		if record.Kind == CaptureClosed {
+			return nil
+		}
+
+		// send packet
+		err = conn.Send(record.Packet, false)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureWriterReader(t *testing.T) {
+	var buf bytes.Buffer
+
+	now := time.Now()
+
+	publish := packet.NewPublish()
+	publish.ID = 1
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("payload")
+	publish.Message.QOS = 1
+
+	records := []*CaptureRecord{
+		{Kind: CaptureMetadata, Time: now, Conn: 1, Meta: &CaptureMeta{
+			LocalAddr:  "127.0.0.1:1883",
+			RemoteAddr: "127.0.0.1:5678",
+			Labels:     map[string]string{"device": "foo"},
+		}},
+		{Kind: CaptureSent, Time: now.Add(time.Millisecond), Conn: 1, Packet: packet.NewConnect()},
+		{Kind: CaptureReceived, Time: now.Add(2 * time.Millisecond), Conn: 1, Packet: packet.NewConnack()},
+		{Kind: CaptureSent, Time: now.Add(3 * time.Millisecond), Conn: 2, Packet: publish},
+		{Kind: CaptureClosed, Time: now.Add(4 * time.Millisecond), Conn: 1, Error: "EOF"},
+	}
+
+	writer := NewCaptureWriter(&buf)
+	for _, record := range records {
+		err := writer.Write(record)
+		require.NoError(t, err)
+	}
+
+	err := writer.Write(&CaptureRecord{Kind: 42})
+	assert.Equal(t, ErrInvalidCapture, err)
+
+	data := buf.Bytes()
+
+	reader := NewCaptureReader(bytes.NewReader(data))
+	for _, record := range records {
+		read, err := reader.Read()
+		require.NoError(t, err)
+		assert.Equal(t, record.Kind, read.Kind)
+		assert.Equal(t, record.Conn, read.Conn)
+		assert.True(t, record.Time.Equal(read.Time))
+		assert.Equal(t, record.Packet, read.Packet)
+		assert.Equal(t, record.Meta, read.Meta)
+		assert.Equal(t, record.Error, read.Error)
+	}
+
+	record, err := reader.Read()
+	assert.Nil(t, record)
+	assert.Equal(t, io.EOF, err)
+
+	reader = NewCaptureReader(bytes.NewReader(data[:len(data)-5]))
+	for {
+		_, err = reader.Read()
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	reader = NewCaptureReader(bytes.NewReader([]byte("invalid capture data")))
+	record, err = reader.Read()
+	assert.Nil(t, record)
+	assert.Equal(t, ErrInvalidCapture, err)
+
+	reader = NewCaptureReader(bytes.NewReader(nil))
+	record, err = reader.Read()
+	assert.Nil(t, record)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCaptureConn(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewCaptureWriter(&buf)
+
+	conn, peer, cleanup := faultPair(t, FaultConfig{})
+	defer cleanup()
+
+	captureConn := NewCaptureConn(conn, writer, map[string]string{"foo": "bar"})
+
+	err := captureConn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	pkt, err := peer.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewPingreq(), pkt)
+
+	err = peer.Send(packet.NewPingresp(), false)
+	assert.NoError(t, err)
+
+	pkt, err = captureConn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewPingresp(), pkt)
+
+	err = peer.Close()
+	assert.NoError(t, err)
+
+	pkt, err = captureConn.Receive()
+	assert.Nil(t, pkt)
+	assert.Equal(t, io.EOF, err)
+
+	// the connection has already been closed by the failed receive
+	_ = captureConn.Close()
+
+	reader := NewCaptureReader(&buf)
+
+	record, err := reader.Read()
+	require.NoError(t, err)
+	assert.Equal(t, CaptureMetadata, record.Kind)
+	assert.Equal(t, conn.LocalAddr().String(), record.Meta.LocalAddr)
+	assert.Equal(t, conn.RemoteAddr().String(), record.Meta.RemoteAddr)
+	assert.Equal(t, map[string]string{"foo": "bar"}, record.Meta.Labels)
+
+	record, err = reader.Read()
+	require.NoError(t, err)
+	assert.Equal(t, CaptureSent, record.Kind)
+	assert.Equal(t, packet.NewPingreq(), record.Packet)
+
+	record, err = reader.Read()
+	require.NoError(t, err)
+	assert.Equal(t, CaptureReceived, record.Kind)
+	assert.Equal(t, packet.NewPingresp(), record.Packet)
+
+	record, err = reader.Read()
+	require.NoError(t, err)
+	assert.Equal(t, CaptureClosed, record.Kind)
+	assert.Equal(t, io.EOF.Error(), record.Error)
+
+	record, err = reader.Read()
+	assert.Nil(t, record)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCaptureConnMultiple(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewCaptureWriter(&buf)
+
+	conn1, peer1, cleanup1 := faultPair(t, FaultConfig{})
+	defer cleanup1()
+
+	conn2, peer2, cleanup2 := faultPair(t, FaultConfig{})
+	defer cleanup2()
+
+	captureConn1 := NewCaptureConn(conn1, writer, nil)
+	captureConn2 := NewCaptureConn(conn2, writer, nil)
+	assert.NotEqual(t, captureConn1.ID(), captureConn2.ID())
+
+	err := captureConn1.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	err = captureConn2.Send(packet.NewDisconnect(), false)
+	assert.NoError(t, err)
+
+	_, err = peer1.Receive()
+	assert.NoError(t, err)
+
+	_, err = peer2.Receive()
+	assert.NoError(t, err)
+
+	_ = captureConn2.Close()
+	_ = captureConn1.Close()
+
+	// separate records by connection
+	kinds := map[uint64][]CaptureKind{}
+	packets := map[uint64][]packet.Type{}
+	reader := NewCaptureReader(&buf)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		kinds[record.Conn] = append(kinds[record.Conn], record.Kind)
+		if record.Packet != nil {
+			packets[record.Conn] = append(packets[record.Conn], record.Packet.Type())
+		}
+	}
+
+	for _, id := range []uint64{captureConn1.ID(), captureConn2.ID()} {
+		assert.Equal(t, []CaptureKind{CaptureMetadata, CaptureSent, CaptureClosed}, kinds[id])
+	}
+	assert.Equal(t, []packet.Type{packet.PINGREQ}, packets[captureConn1.ID()])
+	assert.Equal(t, []packet.Type{packet.DISCONNECT}, packets[captureConn2.ID()])
+}
+
+func replayCapture(t *testing.T, kind CaptureKind) []byte {
+	var buf bytes.Buffer
+	writer := NewCaptureWriter(&buf)
+
+	start := time.Now()
+
+	publish := packet.NewPublish()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("payload")
+
+	other := CaptureReceived
+	if kind == CaptureReceived {
+		other = CaptureSent
+	}
+
+	records := []*CaptureRecord{
+		{Kind: CaptureMetadata, Time: start, Conn: 1, Meta: &CaptureMeta{}},
+		{Kind: kind, Time: start, Conn: 1, Packet: packet.NewConnect()},
+		{Kind: CaptureMetadata, Time: start, Conn: 2, Meta: &CaptureMeta{}},
+		{Kind: other, Time: start.Add(10 * time.Millisecond), Conn: 1, Packet: packet.NewConnack()},
+		{Kind: kind, Time: start.Add(50 * time.Millisecond), Conn: 2, Packet: packet.NewConnect()},
+		{Kind: kind, Time: start.Add(100 * time.Millisecond), Conn: 1, Packet: publish},
+		{Kind: CaptureClosed, Time: start.Add(150 * time.Millisecond), Conn: 2},
+		{Kind: kind, Time: start.Add(200 * time.Millisecond), Conn: 1, Packet: packet.NewDisconnect()},
+		{Kind: CaptureClosed, Time: start.Add(300 * time.Millisecond), Conn: 1},
+		{Kind: kind, Time: start.Add(400 * time.Millisecond), Conn: 1, Packet: packet.NewPingreq()},
+	}
+
+	for _, record := range records {
+		err := writer.Write(record)
+		require.NoError(t, err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReplayer(t *testing.T) {
+	table := []struct {
+		kind     CaptureKind
+		speed    float64
+		duration time.Duration
+	}{
+		{CaptureSent, 1, 300 * time.Millisecond},
+		{CaptureReceived, 2, 150 * time.Millisecond},
+		{CaptureSent, 0, 0},
+	}
+
+	for _, item := range table {
+		capture := replayCapture(t, item.kind)
+
+		server, err := testLauncher.Launch("tcp://localhost:0")
+		require.NoError(t, err)
+
+		var received []packet.Generic
+		done := make(chan struct{})
+
+		go func() {
+			conn, err := server.Accept()
+			require.NoError(t, err)
+
+			for {
+				pkt, err := conn.Receive()
+				if err != nil {
+					break
+				}
+
+				received = append(received, pkt)
+
+				if pkt.Type() == packet.CONNECT {
+					err = conn.Send(packet.NewConnack(), false)
+					assert.NoError(t, err)
+				}
+			}
+
+			close(done)
+		}()
+
+		conn, err := testDialer.Dial(getURL(server, "tcp"))
+		require.NoError(t, err)
+
+		var callback []packet.Generic
+
+		replayer := NewReplayer()
+		replayer.Speed = item.speed
+		replayer.Kind = item.kind
+		replayer.Callback = func(pkt packet.Generic) {
+			callback = append(callback, pkt)
+		}
+
+		start := time.Now()
+		err = replayer.Replay(NewCaptureReader(bytes.NewReader(capture)), conn)
+		assert.NoError(t, err)
+
+		elapsed := time.Since(start)
+		assert.True(t, elapsed >= item.duration, elapsed.String())
+		assert.True(t, elapsed < item.duration+100*time.Millisecond, elapsed.String())
+
+		safeReceive(done)
+
+		if assert.Len(t, received, 3) {
+			assert.Equal(t, packet.CONNECT, received[0].Type())
+			assert.Equal(t, packet.PUBLISH, received[1].Type())
+			assert.Equal(t, packet.DISCONNECT, received[2].Type())
+		}
+
+		if item.speed > 0 {
+			assert.Equal(t, []packet.Generic{packet.NewConnack()}, callback)
+		}
+
+		err = server.Close()
+		assert.NoError(t, err)
+	}
+}
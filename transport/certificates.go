@@ -0,0 +1,411 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoCertificate is returned by the CertificateManager if no certificate has
+// been added.
+var ErrNoCertificate = errors.New("no certificate available")
+
+// ErrNoClientCAs is returned by the CertificateManager if the client CA file
+// does not contain any certificate.
+var ErrNoClientCAs = errors.New("no client certificate authorities found")
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampFiles(files ...string) ([]fileStamp, error) {
+	// stat all files
+	stamps := make([]fileStamp, 0, len(files))
+	for _, file := range files {
+		if file == "" {
+			stamps = append(stamps, fileStamp{})
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+
+		stamps = append(stamps, fileStamp{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		})
+	}
+
+	return stamps, nil
+}
+
+func stampsEqual(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+
+	return true
+}
+
+type managedCertificate struct {
+	certFile string
+	keyFile  string
+	ocspFile string
+	stamps   []fileStamp
+	cert     *tls.Certificate
+}
+
+func (c *managedCertificate) load() error {
+	// get stamps
+	stamps, err := stampFiles(c.certFile, c.keyFile, c.ocspFile)
+	if err != nil {
+		return err
+	}
+
+	// load key pair
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	// parse leaf
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	// load ocsp staple
+	if c.ocspFile != "" {
+		cert.OCSPStaple, err = ioutil.ReadFile(c.ocspFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// set certificate
+	c.stamps = stamps
+	c.cert = &cert
+
+	return nil
+}
+
+// The CertificateManager provides certificates and client certificate
+// authorities for TLS servers and reloads them when the files change on disk.
+// Multiple certificates may be added which are selected using the server name
+// requested by the client (SNI). The first added certificate is used if no
+// certificate matches the requested name.
+//
+// The manager is used by setting the config returned by TLSConfig on the
+// Launcher or passing it to CreateSecureNetServer and
+// CreateSecureWebSocketServer. Changes are picked up by calling Reload or
+// automatically after calling Watch.
+type CertificateManager struct {
+	// The optional config used as the base for all connections. Certificates
+	// and client certificate authorities are always provided by the manager.
+	Config *tls.Config
+
+	// The optional Logger callback is called with errors that occur while
+	// files are reloaded in the background. The previously loaded
+	// certificates remain in use if a reload fails.
+	Logger func(error)
+
+	certificates []*managedCertificate
+	clientCAFile string
+	clientStamps []fileStamp
+	clientCAs    *x509.CertPool
+	mutex        sync.RWMutex
+	reloading    sync.Mutex
+
+	watching bool
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// NewCertificateManager returns a new CertificateManager.
+func NewCertificateManager() *CertificateManager {
+	return &CertificateManager{
+		closed: make(chan struct{}),
+	}
+}
+
+// AddCertificate will load and add the certificate from the provided PEM
+// encoded certificate and key files. An optional file that contains a DER
+// encoded OCSP response may be provided to staple it to the handshake.
+func (m *CertificateManager) AddCertificate(certFile, keyFile, ocspFile string) error {
+	// prepare certificate
+	certificate := &managedCertificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+		ocspFile: ocspFile,
+	}
+
+	// load certificate
+	err := certificate.load()
+	if err != nil {
+		return err
+	}
+
+	// acquire mutex
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// add certificate
+	m.certificates = append(m.certificates, certificate)
+
+	return nil
+}
+
+// SetClientCAs will load the PEM encoded certificate authorities from the
+// provided file that are used to verify client certificates. The ClientAuth
+// setting of the base config must be set to request client certificates.
+func (m *CertificateManager) SetClientCAs(file string) error {
+	// load pool
+	pool, stamps, err := loadCertPool(file)
+	if err != nil {
+		return err
+	}
+
+	// acquire mutex
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// set pool
+	m.clientCAFile = file
+	m.clientStamps = stamps
+	m.clientCAs = pool
+
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, []fileStamp, error) {
+	// get stamps
+	stamps, err := stampFiles(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// read file
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// parse certificates
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, nil, ErrNoClientCAs
+	}
+
+	return pool, stamps, nil
+}
+
+// Reload will reload all files that changed since they have been loaded. The
+// previously loaded data is kept for files that fail to load and the first
+// error is returned.
+func (m *CertificateManager) Reload() error {
+	// prevent concurrent reloads
+	m.reloading.Lock()
+	defer m.reloading.Unlock()
+
+	// get state
+	m.mutex.RLock()
+	certificates := append([]*managedCertificate(nil), m.certificates...)
+	clientCAFile := m.clientCAFile
+	clientStamps := m.clientStamps
+	m.mutex.RUnlock()
+
+	var firstErr error
+
+	// reload certificates
+	for _, certificate := range certificates {
+		// check files
+		stamps, err := stampFiles(certificate.certFile, certificate.keyFile, certificate.ocspFile)
+		if err == nil && stampsEqual(stamps, certificate.stamps) {
+			continue
+		}
+
+		// load certificate
+		reloaded := *certificate
+		if err == nil {
+			err = reloaded.load()
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		// replace certificate
+		m.mutex.Lock()
+		*certificate = reloaded
+		m.mutex.Unlock()
+	}
+
+	// reload client certificate authorities
+	if clientCAFile != "" {
+		stamps, err := stampFiles(clientCAFile)
+		if err != nil || !stampsEqual(stamps, clientStamps) {
+			var pool *x509.CertPool
+			if err == nil {
+				pool, stamps, err = loadCertPool(clientCAFile)
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else {
+				m.mutex.Lock()
+				m.clientStamps = stamps
+				m.clientCAs = pool
+				m.mutex.Unlock()
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// Watch will check the files for changes in the provided interval and reload
+// them until the manager is closed. Errors are reported to the Logger.
+func (m *CertificateManager) Watch(interval time.Duration) {
+	// acquire mutex
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// check state
+	if m.watching {
+		return
+	}
+
+	// set flag
+	m.watching = true
+
+	// check files in background
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := m.Reload()
+				if err != nil && m.Logger != nil {
+					m.Logger(err)
+				}
+			case <-m.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Close will stop watching the files.
+func (m *CertificateManager) Close() {
+	m.once.Do(func() {
+		close(m.closed)
+	})
+}
+
+// GetCertificate returns the certificate that matches the requested server
+// name or the first added certificate. It may be used as the GetCertificate
+// callback of a tls.Config.
+func (m *CertificateManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// acquire mutex
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	// check certificates
+	if len(m.certificates) == 0 {
+		return nil, ErrNoCertificate
+	}
+
+	// find matching certificate
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		for _, certificate := range m.certificates {
+			if matchCertificate(certificate.cert.Leaf, name) {
+				return certificate.cert, nil
+			}
+		}
+	}
+
+	return m.certificates[0].cert, nil
+}
+
+func matchCertificate(leaf *x509.Certificate, name string) bool {
+	// get names
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+
+	for _, pattern := range names {
+		pattern = strings.ToLower(pattern)
+
+		// check exact match
+		if pattern == name {
+			return true
+		}
+
+		// check wildcard match of a single label
+		if strings.HasPrefix(pattern, "*.") {
+			i := strings.IndexByte(name, '.')
+			if i > 0 && name[i:] == pattern[1:] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ClientCAs returns the currently loaded client certificate authorities.
+func (m *CertificateManager) ClientCAs() *x509.CertPool {
+	// acquire mutex
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.clientCAs
+}
+
+// TLSConfig returns a config that uses the current certificates and client
+// certificate authorities for every new connection.
+func (m *CertificateManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: m.configForClient,
+	}
+}
+
+func (m *CertificateManager) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	// prepare config
+	var config *tls.Config
+	if m.Config != nil {
+		config = m.Config.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	// set callbacks and pool
+	config.Certificates = nil
+	config.GetCertificate = m.GetCertificate
+	config.GetConfigForClient = nil
+	config.ClientCAs = m.ClientCAs()
+
+	return config, nil
+}
@@ -0,0 +1,372 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var testSerial int64
+
+func newTestAuthority(t *testing.T) *testAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testAuthority{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (a *testAuthority) issue(t *testing.T, names ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM
+}
+
+func writeTestFile(t *testing.T, file string, data []byte, age time.Duration) {
+	err := ioutil.WriteFile(file, data, 0600)
+	require.NoError(t, err)
+
+	// ensure distinct modification times
+	stamp := time.Now().Add(-age)
+	err = os.Chtimes(file, stamp, stamp)
+	require.NoError(t, err)
+}
+
+func testCertificateDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gomqtt-certificates")
+	require.NoError(t, err)
+
+	return dir
+}
+
+func TestCertificateManagerSNI(t *testing.T) {
+	dir := testCertificateDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newTestAuthority(t)
+
+	manager := NewCertificateManager()
+
+	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, cert)
+	assert.Equal(t, ErrNoCertificate, err)
+
+	for i, name := range []string{"default.example.com", "a.example.com", "*.b.example.com"} {
+		certFile := filepath.Join(dir, fmt.Sprintf("%d.crt", i))
+		keyFile := filepath.Join(dir, fmt.Sprintf("%d.key", i))
+
+		certPEM, keyPEM := ca.issue(t, name)
+		writeTestFile(t, certFile, certPEM, 0)
+		writeTestFile(t, keyFile, keyPEM, 0)
+
+		err = manager.AddCertificate(certFile, keyFile, "")
+		require.NoError(t, err)
+	}
+
+	table := []struct {
+		serverName string
+		commonName string
+	}{
+		{"", "default.example.com"},
+		{"unknown.example.com", "default.example.com"},
+		{"a.example.com", "a.example.com"},
+		{"A.Example.Com.", "a.example.com"},
+		{"x.b.example.com", "*.b.example.com"},
+		{"b.example.com", "default.example.com"},
+		{"x.y.b.example.com", "default.example.com"},
+	}
+
+	for _, item := range table {
+		cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: item.serverName})
+		assert.NoError(t, err)
+		assert.Equal(t, item.commonName, cert.Leaf.Subject.CommonName, item.serverName)
+	}
+}
+
+func TestCertificateManagerReload(t *testing.T) {
+	dir := testCertificateDir(t)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	ca := newTestAuthority(t)
+
+	certPEM, keyPEM := ca.issue(t, "example.com")
+	writeTestFile(t, certFile, certPEM, time.Hour)
+	writeTestFile(t, keyFile, keyPEM, time.Hour)
+
+	manager := NewCertificateManager()
+
+	err := manager.AddCertificate(certFile, keyFile, "")
+	require.NoError(t, err)
+
+	cert1, err := manager.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+
+	err = manager.Reload()
+	assert.NoError(t, err)
+
+	cert2, err := manager.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.True(t, cert1 == cert2)
+
+	writeTestFile(t, certFile, []byte("invalid"), 0)
+
+	err = manager.Reload()
+	assert.Error(t, err)
+
+	cert2, err = manager.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.True(t, cert1 == cert2)
+
+	certPEM, keyPEM = ca.issue(t, "example.com")
+	writeTestFile(t, certFile, certPEM, 0)
+	writeTestFile(t, keyFile, keyPEM, 0)
+
+	err = manager.Reload()
+	assert.NoError(t, err)
+
+	cert2, err = manager.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.NotEqual(t, cert1.Leaf.SerialNumber, cert2.Leaf.SerialNumber)
+}
+
+func TestCertificateManagerWatch(t *testing.T) {
+	dir := testCertificateDir(t)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	ocspFile := filepath.Join(dir, "server.ocsp")
+
+	ca := newTestAuthority(t)
+
+	certPEM, keyPEM := ca.issue(t, "example.com")
+	writeTestFile(t, certFile, certPEM, time.Hour)
+	writeTestFile(t, keyFile, keyPEM, time.Hour)
+	writeTestFile(t, ocspFile, []byte("response1"), time.Hour)
+
+	manager := NewCertificateManager()
+	defer manager.Close()
+
+	err := manager.AddCertificate(certFile, keyFile, ocspFile)
+	require.NoError(t, err)
+
+	errs := make(chan error, 10)
+	manager.Logger = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	manager.Watch(10 * time.Millisecond)
+
+	launcher := NewLauncher()
+	launcher.TLSConfig = manager.TLSConfig()
+
+	server, err := launcher.Launch("tls://localhost:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			// complete handshake and wait for the client to close
+			go func() {
+				_, _ = conn.Receive()
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+
+	handshake := func() tls.ConnectionState {
+		conn, err := tls.Dial("tcp", server.Addr().String(), &tls.Config{
+			ServerName: "example.com",
+			RootCAs:    pool,
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		return conn.ConnectionState()
+	}
+
+	state := handshake()
+	assert.Equal(t, []byte("response1"), state.OCSPResponse)
+	serial := state.PeerCertificates[0].SerialNumber
+
+	certPEM, keyPEM = ca.issue(t, "example.com")
+	writeTestFile(t, certFile, certPEM, 0)
+	writeTestFile(t, keyFile, keyPEM, 0)
+	writeTestFile(t, ocspFile, []byte("response2"), 0)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		state = handshake()
+		if state.PeerCertificates[0].SerialNumber.Cmp(serial) != 0 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotEqual(t, serial, state.PeerCertificates[0].SerialNumber)
+	assert.Equal(t, []byte("response2"), state.OCSPResponse)
+
+	// drain errors of partially written files
+	for len(errs) > 0 {
+		<-errs
+	}
+
+	err = os.Remove(ocspFile)
+	require.NoError(t, err)
+
+	select {
+	case err := <-errs:
+		assert.True(t, os.IsNotExist(err))
+	case <-time.After(time.Second):
+		assert.Fail(t, "expected error")
+	}
+}
+
+func TestCertificateManagerClientCAs(t *testing.T) {
+	dir := testCertificateDir(t)
+	defer os.RemoveAll(dir)
+
+	serverCA := newTestAuthority(t)
+	clientCA1 := newTestAuthority(t)
+	clientCA2 := newTestAuthority(t)
+
+	certPEM, keyPEM := serverCA.issue(t, "example.com")
+	writeTestFile(t, filepath.Join(dir, "server.crt"), certPEM, 0)
+	writeTestFile(t, filepath.Join(dir, "server.key"), keyPEM, 0)
+
+	caFile := filepath.Join(dir, "clients.crt")
+	writeTestFile(t, caFile, clientCA1.pem, time.Hour)
+
+	manager := NewCertificateManager()
+	manager.Config = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+
+	err := manager.AddCertificate(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "")
+	require.NoError(t, err)
+
+	err = manager.SetClientCAs(filepath.Join(dir, "server.key"))
+	assert.Equal(t, ErrNoClientCAs, err)
+
+	err = manager.SetClientCAs(caFile)
+	require.NoError(t, err)
+
+	clientCertPEM, clientKeyPEM := clientCA2.issue(t, "client")
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(serverCA.pem)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	handshake := func() error {
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer clientConn.Close()
+
+		serverConn, err := listener.Accept()
+		require.NoError(t, err)
+		defer serverConn.Close()
+
+		go func() {
+			_ = tls.Client(clientConn, &tls.Config{
+				ServerName:   "example.com",
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{clientCert},
+			}).Handshake()
+			_ = clientConn.Close()
+		}()
+
+		return tls.Server(serverConn, manager.TLSConfig()).Handshake()
+	}
+
+	err = handshake()
+	assert.Error(t, err)
+
+	writeTestFile(t, caFile, append(clientCA1.pem, clientCA2.pem...), 0)
+
+	err = manager.Reload()
+	assert.NoError(t, err)
+
+	err = handshake()
+	assert.NoError(t, err)
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"crypto/x509"
 	"net"
 	"time"
 
@@ -45,4 +46,33 @@ type Conn interface {
 
 	// RemoteAddr will return the underlying connection's remote net address.
 	RemoteAddr() net.Addr
+
+	// PeerCertificates will return the verified certificate chain presented
+	// by the peer, starting with the leaf certificate. It returns nil if the
+	// connection is not secured by TLS or the peer did not present a verified
+	// certificate.
+	PeerCertificates() []*x509.Certificate
+
+	// Stats returns a snapshot of the traffic carried by the connection. It
+	// can be called concurrently with all other methods.
+	Stats() TrafficStats
+}
+
+// Unwrap returns the connection wrapped by the provided connection or nil if
+// it does not wrap another connection. Connections that wrap another
+// connection provide an Unwrap method that returns the wrapped connection.
+// Optional methods like EnableScheduler or Request should be looked up on all
+// connections of the chain:
+//
+//	for c := conn; c != nil; c = transport.Unwrap(c) {
+//		if wsConn, ok := c.(*transport.WebSocketConn); ok {
+//			// use wsConn.Request()
+//		}
+//	}
+func Unwrap(conn Conn) Conn {
+	if w, ok := conn.(interface{ Unwrap() Conn }); ok {
+		return w.Unwrap()
+	}
+
+	return nil
 }
@@ -75,6 +75,8 @@ func abstractConnDecodeErrorTest(t *testing.T, protocol string) {
 			netConn.conn.Write(buf)
 		} else if webSocketConn, ok := conn1.(*WebSocketConn); ok {
 			webSocketConn.conn.WriteMessage(websocket.BinaryMessage, buf)
+		} else if memoryConn, ok := conn1.(*MemoryConn); ok {
+			memoryConn.out.push(buf)
 		}
 
 		pkt, err := conn1.Receive()
@@ -348,3 +350,66 @@ func abstractConnBigAsyncSendAfterCloseTest(t *testing.T, protocol string) {
 
 	safeReceive(done)
 }
+
+func abstractConnStatsTest(t *testing.T, protocol string) {
+	publish := packet.NewPublish()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("payload")
+
+	conn2, done := connectionPair(protocol, func(conn1 Conn) {
+		pkt, err := conn1.Receive()
+		assert.Equal(t, pkt.Type(), packet.CONNECT)
+		assert.NoError(t, err)
+
+		pkt, err = conn1.Receive()
+		assert.Equal(t, pkt.Type(), packet.PUBLISH)
+		assert.NoError(t, err)
+
+		err = conn1.Send(packet.NewConnack(), false)
+		assert.NoError(t, err)
+
+		stats := conn1.Stats()
+		assert.Equal(t, TrafficCount{Packets: 1, Bytes: int64(packet.NewConnack().Len())}, stats.Sent)
+		assert.Equal(t, TrafficCount{Packets: 2, Bytes: int64(packet.NewConnect().Len() + publish.Len())}, stats.Received)
+		assert.Equal(t, map[packet.Type]TrafficCount{
+			packet.CONNECT: {Packets: 1, Bytes: int64(packet.NewConnect().Len())},
+			packet.PUBLISH: {Packets: 1, Bytes: int64(publish.Len())},
+		}, stats.ReceivedByType)
+		assert.False(t, stats.LastRead.IsZero())
+		assert.False(t, stats.LastWrite.IsZero())
+		assert.Equal(t, int64(0), stats.Buffered)
+
+		pkt, err = conn1.Receive()
+		assert.Nil(t, pkt)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	stats := conn2.Stats()
+	assert.Equal(t, TrafficCount{}, stats.Sent)
+	assert.Equal(t, TrafficCount{}, stats.Received)
+	assert.Empty(t, stats.SentByType)
+	assert.True(t, stats.LastRead.IsZero())
+	assert.True(t, stats.LastWrite.IsZero())
+
+	err := conn2.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	err = conn2.Send(publish, false)
+	assert.NoError(t, err)
+
+	pkt, err := conn2.Receive()
+	assert.Equal(t, pkt.Type(), packet.CONNACK)
+	assert.NoError(t, err)
+
+	stats = conn2.Stats()
+	assert.Equal(t, TrafficCount{Packets: 2, Bytes: int64(packet.NewConnect().Len() + publish.Len())}, stats.Sent)
+	assert.Equal(t, map[packet.Type]TrafficCount{
+		packet.CONNACK: {Packets: 1, Bytes: int64(packet.NewConnack().Len())},
+	}, stats.ReceivedByType)
+	assert.False(t, stats.LastRead.Before(stats.LastWrite))
+
+	err = conn2.Close()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
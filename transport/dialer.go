@@ -1,11 +1,14 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -22,6 +25,67 @@ type Dialer struct {
 	DefaultWSPort  string
 	DefaultWSSPort string
 
+	// The maximum time establishing the TCP connection may take. The timeout
+	// is shared between all addresses that are tried.
+	//
+	// Will default to no timeout.
+	ConnectTimeout time.Duration
+
+	// The maximum time the TLS and WebSocket handshake may take.
+	//
+	// Will default to no timeout.
+	HandshakeTimeout time.Duration
+
+	// The optional local address used for TCP and Unix connections.
+	LocalAddr net.Addr
+
+	// The interval of TCP keep-alive probes. Keep-alives are disabled if
+	// negative.
+	//
+	// Will default to 15 seconds.
+	KeepAlive time.Duration
+
+	// The optional function that is called after creating the socket and
+	// before connecting. It may be used to set socket options.
+	Control func(network, address string, c syscall.RawConn) error
+
+	// The delay after which the next resolved address is tried while
+	// previous attempts are still pending.
+	//
+	// Will default to 300 milliseconds.
+	FallbackDelay time.Duration
+
+	// The optional resolver used to lookup host names.
+	Resolver *net.Resolver
+
+	// The function that returns the proxy used for a URL. TCP, TLS and
+	// WebSocket connections are tunneled through HTTP and HTTPS proxies using
+	// the CONNECT method and through SOCKS5 proxies. Credentials are taken
+	// from the user info of the proxy URL. No proxy is used if the function
+	// is nil or returns a nil URL.
+	//
+	// Will default to ProxyFromEnvironment.
+	Proxy func(*url.URL) (*url.URL, error)
+
+	// The optional TLS config used to connect to HTTPS proxies.
+	ProxyTLSConfig *tls.Config
+
+	// The subprotocols offered for WebSocket connections. The server selects
+	// the subprotocol according to its own preference.
+	//
+	// Will default to "mqtt".
+	Subprotocols []string
+
+	// The optional config that enables the permessage-deflate extension for
+	// WebSocket connections. Connections are not compressed if the server
+	// does not support the extension.
+	Compression *WebSocketCompression
+
+	// The optional functions that dial connections for additional schemes.
+	// They are called with the parsed URL after the defaults of the dialer
+	// have been applied.
+	Schemes map[string]func(ctx context.Context, urlParts *url.URL) (Conn, error)
+
 	webSocketDialer *websocket.Dialer
 }
 
@@ -32,8 +96,8 @@ func NewDialer() *Dialer {
 		DefaultTLSPort: "8883",
 		DefaultWSPort:  "80",
 		DefaultWSSPort: "443",
+		Proxy:          ProxyFromEnvironment,
 		webSocketDialer: &websocket.Dialer{
-			Proxy:        http.ProxyFromEnvironment,
 			Subprotocols: []string{"mqtt"},
 		},
 	}
@@ -50,8 +114,21 @@ func Dial(urlString string) (Conn, error) {
 	return sharedDialer.Dial(urlString)
 }
 
+// DialContext is a shorthand function.
+func DialContext(ctx context.Context, urlString string) (Conn, error) {
+	return sharedDialer.DialContext(ctx, urlString)
+}
+
 // Dial initiates a connection based in information extracted from an URL.
 func (d *Dialer) Dial(urlString string) (Conn, error) {
+	return d.DialContext(context.Background(), urlString)
+}
+
+// DialContext initiates a connection based in information extracted from an
+// URL. The context may be used to cancel the connection attempt including the
+// TLS and WebSocket handshake. Once the connection is established, expiring
+// the context has no effect.
+func (d *Dialer) DialContext(ctx context.Context, urlString string) (Conn, error) {
 	// ensure write delay default
 	if d.MaxWriteDelay == 0 {
 		d.MaxWriteDelay = 10 * time.Millisecond
@@ -62,19 +139,33 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 		return nil, err
 	}
 
+	// dial additional schemes
+	if fn, ok := d.Schemes[urlParts.Scheme]; ok {
+		return fn(ctx, urlParts)
+	}
+
 	host, port, err := net.SplitHostPort(urlParts.Host)
 	if err != nil {
 		host = urlParts.Host
 		port = ""
 	}
 
+	// get proxy
+	var proxyURL *url.URL
+	if d.Proxy != nil && urlParts.Scheme != "unix" && urlParts.Scheme != "memory" {
+		proxyURL, err = d.Proxy(urlParts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	switch urlParts.Scheme {
 	case "tcp", "mqtt":
 		if port == "" {
 			port = d.DefaultTCPPort
 		}
 
-		conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+		conn, err := d.dialProxy(ctx, proxyURL, host, port)
 		if err != nil {
 			return nil, err
 		}
@@ -85,40 +176,377 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 			port = d.DefaultTLSPort
 		}
 
-		conn, err := tls.Dial("tcp", net.JoinHostPort(host, port), d.TLSConfig)
+		conn, err := d.dialProxy(ctx, proxyURL, host, port)
 		if err != nil {
 			return nil, err
 		}
 
-		return NewNetConn(conn, d.MaxWriteDelay), nil
+		tlsConn, err := d.handshake(ctx, conn, tlsConfigFor(d.TLSConfig, host))
+		if err != nil {
+			return nil, err
+		}
+
+		return NewNetConn(tlsConn, d.MaxWriteDelay), nil
 	case "ws":
 		if port == "" {
 			port = d.DefaultWSPort
 		}
 
 		wsURL := fmt.Sprintf("ws://%s:%s%s", host, port, urlParts.Path)
+		if urlParts.RawQuery != "" {
+			wsURL += "?" + urlParts.RawQuery
+		}
 
-		conn, _, err := d.webSocketDialer.Dial(wsURL, d.RequestHeader)
+		conn, err := d.dialWebSocket(ctx, wsURL, proxyURL)
 		if err != nil {
 			return nil, err
 		}
 
-		return NewWebSocketConn(conn, d.MaxWriteDelay), nil
+		return conn, nil
 	case "wss":
 		if port == "" {
 			port = d.DefaultWSSPort
 		}
 
 		wsURL := fmt.Sprintf("wss://%s:%s%s", host, port, urlParts.Path)
+		if urlParts.RawQuery != "" {
+			wsURL += "?" + urlParts.RawQuery
+		}
+
+		conn, err := d.dialWebSocket(ctx, wsURL, proxyURL)
+		if err != nil {
+			return nil, err
+		}
 
-		d.webSocketDialer.TLSClientConfig = d.TLSConfig
-		conn, _, err := d.webSocketDialer.Dial(wsURL, d.RequestHeader)
+		return conn, nil
+	case "unix":
+		conn, err := d.netDialer().DialContext(ctx, "unix", unixPath(urlParts))
 		if err != nil {
 			return nil, err
 		}
 
-		return NewWebSocketConn(conn, d.MaxWriteDelay), nil
+		return NewNetConn(conn, d.MaxWriteDelay), nil
+	case "memory":
+		conn, err := DialMemory(urlParts.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		return conn, nil
 	}
 
 	return nil, ErrUnsupportedProtocol
 }
+
+func (d *Dialer) netDialer() *net.Dialer {
+	return &net.Dialer{
+		LocalAddr: d.LocalAddr,
+		KeepAlive: d.KeepAlive,
+		Control:   d.Control,
+	}
+}
+
+func (d *Dialer) dialTCP(ctx context.Context, host, port string) (net.Conn, error) {
+	// apply connect timeout
+	if d.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.ConnectTimeout)
+		defer cancel()
+	}
+
+	// resolve host
+	addrs, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// get fallback delay
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = 300 * time.Millisecond
+	}
+
+	return dialParallel(ctx, d.netDialer(), addrs, port, delay)
+}
+
+func (d *Dialer) resolve(ctx context.Context, host string) ([]string, error) {
+	// check ip
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+
+	// get resolver
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	// lookup addresses
+	ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// split families
+	var primary, fallback []string
+	for _, ipAddr := range ipAddrs {
+		if (ipAddr.IP.To4() != nil) == (ipAddrs[0].IP.To4() != nil) {
+			primary = append(primary, ipAddr.String())
+		} else {
+			fallback = append(fallback, ipAddr.String())
+		}
+	}
+
+	// interleave families
+	var addrs []string
+	for len(primary) > 0 || len(fallback) > 0 {
+		if len(primary) > 0 {
+			addrs = append(addrs, primary[0])
+			primary = primary[1:]
+		}
+
+		if len(fallback) > 0 {
+			addrs = append(addrs, fallback[0])
+			fallback = fallback[1:]
+		}
+	}
+
+	return addrs, nil
+}
+
+// dialParallel connects to the first reachable address. A new attempt is
+// started whenever the previous attempt failed or the delay elapsed.
+func dialParallel(ctx context.Context, dialer *net.Dialer, addrs []string, port string, delay time.Duration) (net.Conn, error) {
+	// prepare context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// prepare results
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+
+	// prepare state
+	next := 0
+	pending := 0
+	var firstErr error
+
+	// start attempt
+	start := func() {
+		addr := net.JoinHostPort(addrs[next], port)
+		next++
+		pending++
+
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- result{conn: conn, err: err}
+		}()
+	}
+
+	// start first attempt
+	start()
+
+	for {
+		// prepare fallback timer
+		var timer *time.Timer
+		var fallback <-chan time.Time
+		if next < len(addrs) {
+			timer = time.NewTimer(delay)
+			fallback = timer.C
+		}
+
+		select {
+		case res := <-results:
+			pending--
+
+			// return first established connection
+			if res.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+
+				// close connections of pending attempts
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if res := <-results; res.conn != nil {
+							_ = res.conn.Close()
+						}
+					}
+				}(pending)
+
+				return res.conn, nil
+			}
+
+			// keep first error
+			if firstErr == nil {
+				firstErr = res.err
+			}
+
+			// start next attempt immediately or fail
+			if next < len(addrs) {
+				start()
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-fallback:
+			start()
+		}
+
+		// stop timer
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func tlsConfigFor(base *tls.Config, host string) *tls.Config {
+	// prepare config
+	var config *tls.Config
+	if base != nil {
+		config = base.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	// set server name if missing
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	return config
+}
+
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	// set deadline
+	if d.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.HandshakeTimeout))
+	}
+
+	// close connection if context is canceled
+	stop := closeOnCancel(ctx, conn)
+
+	// perform handshake
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.Handshake()
+	if stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+
+		// prefer context error
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	// reset deadline
+	_ = conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+func (d *Dialer) dialWebSocket(ctx context.Context, wsURL string, proxyURL *url.URL) (*WebSocketConn, error) {
+	// prepare state
+	var stops []func() bool
+	var mutex sync.Mutex
+
+	// copy dialer
+	dialer := *d.webSocketDialer
+	dialer.TLSClientConfig = d.TLSConfig
+	dialer.HandshakeTimeout = d.HandshakeTimeout
+	dialer.Proxy = nil
+	dialer.EnableCompression = d.Compression != nil
+	if len(d.Subprotocols) > 0 {
+		dialer.Subprotocols = d.Subprotocols
+	}
+	dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		// split address
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// dial connection
+		conn, err := d.dialProxy(ctx, proxyURL, host, port)
+		if err != nil {
+			return nil, err
+		}
+
+		// close connection if context is canceled during handshake
+		mutex.Lock()
+		stops = append(stops, closeOnCancel(ctx, conn))
+		mutex.Unlock()
+
+		return conn, nil
+	}
+
+	// dial connection
+	conn, res, err := dialer.Dial(wsURL, d.RequestHeader)
+
+	// stop watching context
+	mutex.Lock()
+	for _, stop := range stops {
+		if stop() && err == nil {
+			_ = conn.Close()
+			err = ctx.Err()
+		}
+	}
+	mutex.Unlock()
+
+	// handle errors
+	if err != nil {
+		// prefer context error
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	// create connection
+	webSocketConn := NewWebSocketConn(conn, d.MaxWriteDelay)
+
+	// configure compression if negotiated
+	if d.Compression != nil && negotiatedCompression(res.Header) {
+		err = webSocketConn.enableCompression(d.Compression)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return webSocketConn, nil
+}
+
+// closeOnCancel closes the connection if the context is canceled before the
+// returned function is called. The function reports whether the connection
+// has been closed.
+func closeOnCancel(ctx context.Context, conn net.Conn) func() bool {
+	// check context
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	// close connection on cancel
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return <-closed
+	}
+}
@@ -0,0 +1,424 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedProxy is returned by the Dialer if the scheme of the proxy URL
+// is not one of "http", "https", "socks5" or "socks5h".
+var ErrUnsupportedProxy = errors.New("unsupported proxy")
+
+// ErrProxyAuthentication is returned by the Dialer if the proxy rejected the
+// provided credentials or requires credentials that have not been provided.
+var ErrProxyAuthentication = errors.New("proxy authentication failed")
+
+// ProxyFromEnvironment returns the proxy that should be used to connect to the
+// server specified by the URL. The proxy is read from the HTTPS_PROXY variable
+// for the "tls", "mqtts" and "wss" schemes and from the HTTP_PROXY variable
+// for all other schemes. The ALL_PROXY variable is used if the specific
+// variable is not set. The lowercase variants are respected as well.
+//
+// Connections to loopback addresses and hosts that match an entry of the
+// NO_PROXY variable are not proxied. Entries may be host names that also
+// match all sub domains, domain suffixes with a leading dot, IP addresses,
+// CIDR ranges or "*" to disable proxying completely.
+//
+// A nil URL and nil error are returned if no proxy should be used.
+func ProxyFromEnvironment(u *url.URL) (*url.URL, error) {
+	// get host
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return nil, nil
+	}
+
+	// skip loopback addresses
+	if host == "localhost" {
+		return nil, nil
+	} else if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil, nil
+	}
+
+	// get proxy
+	var value string
+	switch u.Scheme {
+	case "tls", "mqtts", "wss", "https":
+		value = getenv("HTTPS_PROXY")
+	default:
+		value = getenv("HTTP_PROXY")
+	}
+	if value == "" {
+		value = getenv("ALL_PROXY")
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	// check exclusions
+	if matchNoProxy(host, getenv("NO_PROXY")) {
+		return nil, nil
+	}
+
+	// assume http proxy if scheme is missing
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+
+	// parse proxy
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %v", value, err)
+	}
+
+	return proxyURL, nil
+}
+
+func getenv(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		value = os.Getenv(strings.ToLower(name))
+	}
+
+	return value
+}
+
+func matchNoProxy(host, list string) bool {
+	// parse ip
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(list, ",") {
+		// clean entry
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		// check wildcard
+		if entry == "*" {
+			return true
+		}
+
+		// check network
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		// remove port
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+
+		// check address
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		// check domain suffix
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) || host == entry[1:] {
+				return true
+			}
+
+			continue
+		}
+
+		// check domain
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Dialer) dialProxy(ctx context.Context, proxyURL *url.URL, host, port string) (net.Conn, error) {
+	// dial directly if no proxy is configured
+	if proxyURL == nil {
+		return d.dialTCP(ctx, host, port)
+	}
+
+	// get default proxy port
+	var defaultPort string
+	switch proxyURL.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	default:
+		return nil, ErrUnsupportedProxy
+	}
+
+	// get proxy address
+	proxyHost := proxyURL.Hostname()
+	proxyPort := proxyURL.Port()
+	if proxyPort == "" {
+		proxyPort = defaultPort
+	}
+
+	// resolve host locally for plain socks5 proxies
+	if proxyURL.Scheme == "socks5" && net.ParseIP(host) == nil {
+		addrs, err := d.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		host = addrs[0]
+	}
+
+	// dial proxy
+	conn, err := d.dialTCP(ctx, proxyHost, proxyPort)
+	if err != nil {
+		return nil, err
+	}
+
+	// secure connection to https proxies
+	if proxyURL.Scheme == "https" {
+		conn, err = d.handshake(ctx, conn, tlsConfigFor(d.ProxyTLSConfig, proxyHost))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// set deadline
+	if d.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.HandshakeTimeout))
+	}
+
+	// close connection if context is canceled
+	stop := closeOnCancel(ctx, conn)
+
+	// negotiate tunnel
+	if proxyURL.Scheme == "http" || proxyURL.Scheme == "https" {
+		conn, err = httpConnect(conn, proxyURL.User, host, port)
+	} else {
+		err = socks5Connect(conn, proxyURL.User, host, port)
+	}
+	if stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+
+		// prefer context error
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	// reset deadline
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// httpConnect establishes a tunnel using the HTTP CONNECT method.
+func httpConnect(conn net.Conn, user *url.Userinfo, host, port string) (net.Conn, error) {
+	// prepare request
+	addr := net.JoinHostPort(host, port)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	// add credentials
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	// write request
+	err := req.Write(conn)
+	if err != nil {
+		return conn, err
+	}
+
+	// read response
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+
+	// check status
+	if res.StatusCode == http.StatusProxyAuthRequired {
+		return conn, ErrProxyAuthentication
+	} else if res.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy refused connection: %s", res.Status)
+	}
+
+	// keep data that has already been buffered
+	if reader.Buffered() > 0 {
+		return &sniffConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+var socks5Errors = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Connect establishes a tunnel using the SOCKS5 protocol as described
+// in RFC 1928 and RFC 1929.
+func socks5Connect(conn net.Conn, user *url.Userinfo, host, port string) error {
+	// prepare methods
+	methods := []byte{0x00}
+	if user != nil {
+		methods = append(methods, 0x02)
+	}
+
+	// write greeting
+	_, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+
+	// read selected method
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	} else if buf[0] != 0x05 {
+		return ErrUnsupportedProxy
+	}
+
+	// handle method
+	switch buf[1] {
+	case 0x00:
+	case 0x02:
+		// check credentials
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return ErrProxyAuthentication
+		}
+
+		// write credentials
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		_, err = conn.Write(auth)
+		if err != nil {
+			return err
+		}
+
+		// read status
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		} else if buf[1] != 0x00 {
+			return ErrProxyAuthentication
+		}
+	default:
+		return ErrProxyAuthentication
+	}
+
+	// parse port
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	// prepare request
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(portNum>>8), byte(portNum))
+
+	// write request
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	// read reply header
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	} else if header[0] != 0x05 {
+		return ErrUnsupportedProxy
+	}
+
+	// check reply
+	if header[1] != 0x00 {
+		msg, ok := socks5Errors[header[1]]
+		if !ok {
+			msg = fmt.Sprintf("unknown error %d", header[1])
+		}
+
+		return fmt.Errorf("proxy refused connection: %s", msg)
+	}
+
+	// get bound address length
+	var length int
+	switch header[3] {
+	case 0x01:
+		length = net.IPv4len
+	case 0x04:
+		length = net.IPv6len
+	case 0x03:
+		_, err = io.ReadFull(conn, buf[:1])
+		if err != nil {
+			return err
+		}
+
+		length = int(buf[0])
+	default:
+		return ErrUnsupportedProxy
+	}
+
+	// skip bound address and port
+	_, err = io.ReadFull(conn, make([]byte, length+2))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -1,8 +1,15 @@
 package transport
 
 import (
+	"context"
 	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -49,6 +56,41 @@ func TestDialerUnsupportedProtocol(t *testing.T) {
 	assert.Equal(t, ErrUnsupportedProtocol, err)
 }
 
+func TestDialerSchemes(t *testing.T) {
+	server, err := CreateMemoryServer("dialer-schemes")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		conn, err := server.Accept()
+		require.NoError(t, err)
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		close(done)
+	}()
+
+	dialer := NewDialer()
+	dialer.Schemes = map[string]func(context.Context, *url.URL) (Conn, error){
+		"foo": func(ctx context.Context, urlParts *url.URL) (Conn, error) {
+			return DialMemory(urlParts.Host)
+		},
+	}
+
+	conn, err := dialer.Dial("foo://dialer-schemes")
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryConn{}, conn)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
 func TestDialerTCPError(t *testing.T) {
 	conn, err := Dial("tcp://localhost:1234567")
 	assert.Nil(t, conn)
@@ -123,3 +165,140 @@ func TestWSDefaultPort(t *testing.T) {
 func TestWSSDefaultPort(t *testing.T) {
 	abstractDefaultPortTest(t, "wss")
 }
+
+func silentServer(t *testing.T) (net.Listener, func()) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	var conns []net.Conn
+	var mutex sync.Mutex
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+		}
+	}()
+
+	return listener, func() {
+		_ = listener.Close()
+
+		mutex.Lock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+		mutex.Unlock()
+	}
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	server, err := testLauncher.Launch("tcp://localhost:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	conn, err := DialContext(ctx, getURL(server, "tcp"))
+	assert.Nil(t, conn)
+	assert.Error(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestDialerHandshakeTimeout(t *testing.T) {
+	listener, stop := silentServer(t)
+	defer stop()
+
+	dialer := NewDialer()
+	dialer.HandshakeTimeout = 50 * time.Millisecond
+
+	for _, protocol := range []string{"tls", "ws", "wss"} {
+		start := time.Now()
+
+		conn, err := dialer.Dial(protocol + "://" + listener.Addr().String())
+		assert.Nil(t, conn)
+		assert.Error(t, err)
+		assert.True(t, time.Since(start) < 5*time.Second)
+	}
+}
+
+func TestDialContextHandshakeDeadline(t *testing.T) {
+	listener, stop := silentServer(t)
+	defer stop()
+
+	for _, protocol := range []string{"tls", "wss"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+		conn, err := DialContext(ctx, protocol+"://"+listener.Addr().String())
+		assert.Nil(t, conn)
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		cancel()
+	}
+}
+
+func TestDialerLocalAddr(t *testing.T) {
+	server, err := testLauncher.Launch("tcp://127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			assert.Equal(t, 45678, conn.RemoteAddr().(*net.TCPAddr).Port)
+			_ = conn.Close()
+		}
+	}()
+
+	dialer := NewDialer()
+	dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 45678}
+
+	conn, err := dialer.Dial(getURL(server, "tcp"))
+	require.NoError(t, err)
+	assert.Equal(t, 45678, conn.LocalAddr().(*net.TCPAddr).Port)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestDialParallel(t *testing.T) {
+	server, err := testLauncher.Launch("tcp://127.0.0.1:0")
+	require.NoError(t, err)
+
+	dialer := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			// simulate unreachable address
+			if strings.HasPrefix(address, "127.0.0.2:") {
+				time.Sleep(time.Second)
+			}
+
+			return nil
+		},
+	}
+
+	start := time.Now()
+
+	conn, err := dialParallel(context.Background(), dialer, []string{"127.0.0.2", "127.0.0.1"}, getPort(server), 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	assert.Equal(t, "127.0.0.1:"+getPort(server), conn.RemoteAddr().String())
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	conn, err = dialParallel(context.Background(), &net.Dialer{}, []string{"127.0.0.1"}, "1", 50*time.Millisecond)
+	assert.Nil(t, conn)
+	assert.Error(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,631 @@
+package transport
+
+import (
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+)
+
+// ErrInjectedReset is returned by a FaultConn if the connection has been reset
+// because the configured packet or byte limit has been reached.
+var ErrInjectedReset = errors.New("injected connection reset")
+
+// FaultRules describe the faults injected into one direction of a FaultConn.
+type FaultRules struct {
+	// The fixed delay added to every packet.
+	Latency time.Duration
+
+	// The maximum random delay added to the latency of every packet.
+	Jitter time.Duration
+
+	// The maximum number of bytes per second. Packets are delayed until all
+	// previous packets of the direction have been transmitted if set.
+	Bandwidth int64
+
+	// The probability between 0 and 1 that a packet is silently dropped.
+	DropRate float64
+
+	// The packet types that may be dropped.
+	//
+	// Will default to all types.
+	DropTypes []packet.Type
+
+	// The probability between 0 and 1 that a byte of the encoded packet is
+	// flipped. Sent packets that cannot be decoded anymore reset the
+	// connection while received packets return the decoding error.
+	CorruptRate float64
+}
+
+type faultTimeoutError struct{}
+
+func (faultTimeoutError) Error() string   { return "i/o timeout" }
+func (faultTimeoutError) Timeout() bool   { return true }
+func (faultTimeoutError) Temporary() bool { return true }
+
+// A FaultConfig describes the faults injected by a FaultConn.
+type FaultConfig struct {
+	// The seed used for all random decisions. Connections with the same seed
+	// and traffic will experience the same faults. Sent and received packets
+	// use separate sources to not depend on the order of concurrent calls.
+	Seed int64
+
+	// The faults injected into sent packets.
+	Send FaultRules
+
+	// The faults injected into received packets.
+	Receive FaultRules
+
+	// The number of sent and received packets after which the connection is
+	// reset.
+	ResetAfterPackets int
+
+	// The number of sent and received bytes after which the connection is
+	// reset.
+	ResetAfterBytes int64
+
+	// The number of sent and received packets after which the connection
+	// becomes half-open. All further packets are silently discarded and the
+	// underlying connection is not read anymore. Receive calls block until the
+	// configured read timeout is reached and return a timeout error.
+	HangAfterPackets int
+}
+
+// A FaultConn wraps a Conn and injects latency, bandwidth limits, packet drops,
+// corruption, resets and hangs as described by the FaultConfig. It is meant to
+// test the behaviour of clients and brokers under unreliable network
+// conditions.
+type FaultConn struct {
+	conn   Conn
+	config FaultConfig
+
+	send    faultDirection
+	receive faultDirection
+	packets int
+	bytes   int64
+	hung    bool
+	reset   bool
+	sendErr error
+	timeout time.Duration
+	mutex   sync.Mutex
+
+	hang   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewFaultConn wraps the provided connection.
+func NewFaultConn(conn Conn, config FaultConfig) *FaultConn {
+	return &FaultConn{
+		conn:   conn,
+		config: config,
+		send: faultDirection{
+			rules:  config.Send,
+			random: rand.New(rand.NewSource(config.Seed)),
+		},
+		receive: faultDirection{
+			rules:  config.Receive,
+			random: rand.New(rand.NewSource(config.Seed + 1)),
+		},
+		hang:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+type faultDirection struct {
+	rules  FaultRules
+	random *rand.Rand
+	free   time.Time
+	last   time.Time
+	queue  chan *faultItem
+	once   sync.Once
+	mutex  sync.Mutex
+}
+
+type faultItem struct {
+	pkt packet.Generic
+	err error
+	due time.Time
+}
+
+// faultQueueSize is the number of delayed packets per direction that are in
+// flight before further calls block.
+const faultQueueSize = 1024
+
+func (d *faultDirection) delayed() bool {
+	return d.rules.Latency > 0 || d.rules.Jitter > 0 || d.rules.Bandwidth > 0
+}
+
+// schedule returns the time the packet should be delivered. It must be called
+// with the direction mutex held.
+func (d *faultDirection) schedule(size int) time.Time {
+	// transmit packet once previous packets have been transmitted
+	now := time.Now()
+	if d.free.Before(now) {
+		d.free = now
+	}
+	if d.rules.Bandwidth > 0 {
+		d.free = d.free.Add(time.Duration(int64(size) * int64(time.Second) / d.rules.Bandwidth))
+	}
+
+	// add latency and jitter
+	due := d.free.Add(d.rules.Latency)
+	if d.rules.Jitter > 0 {
+		due = due.Add(time.Duration(d.random.Int63n(int64(d.rules.Jitter))))
+	}
+
+	// keep packets in order
+	if due.Before(d.last) {
+		due = d.last
+	}
+	d.last = due
+
+	return due
+}
+
+// Send will apply the send rules and forward the packet to the underlying
+// connection. If latency, jitter or bandwidth rules are configured the packet
+// is queued and sent in the background once it is due. Errors of the
+// underlying connection are then returned by subsequent calls.
+func (c *FaultConn) Send(pkt packet.Generic, async bool) error {
+	// apply rules
+	pkt, due, err := c.apply(pkt, &c.send)
+	if err != nil {
+		return err
+	} else if pkt == nil {
+		return nil
+	}
+
+	// send packet directly if not delayed
+	if due.IsZero() {
+		return c.conn.Send(pkt, async)
+	}
+
+	// ensure sender is running
+	c.send.once.Do(func() {
+		c.send.queue = make(chan *faultItem, faultQueueSize)
+		go c.sender()
+	})
+
+	// check error
+	c.mutex.Lock()
+	err = c.sendErr
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// queue packet
+	select {
+	case c.send.queue <- &faultItem{pkt: pkt, due: due}:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+// Receive will read the next packet from the underlying connection and apply
+// the receive rules. If latency, jitter or bandwidth rules are configured the
+// underlying connection is read in the background and packets are returned
+// once they are due. If the connection hung, the call blocks until the read
+// timeout is reached.
+func (c *FaultConn) Receive() (packet.Generic, error) {
+	// get start
+	start := time.Now()
+
+	// receive packets directly if not delayed
+	if !c.receive.delayed() {
+		for {
+			// wait for timeout if hung
+			if c.isHung() {
+				return nil, c.wait(start)
+			}
+
+			// receive packet
+			pkt, err := c.conn.Receive()
+			if err != nil {
+				return nil, err
+			}
+
+			// apply rules
+			pkt, _, err = c.apply(pkt, &c.receive)
+			if err != nil {
+				return nil, err
+			} else if pkt != nil {
+				return pkt, nil
+			}
+		}
+	}
+
+	// ensure receiver is running
+	c.receive.once.Do(func() {
+		c.receive.queue = make(chan *faultItem, faultQueueSize)
+		go c.receiver()
+	})
+
+	// get next item
+	var item *faultItem
+	select {
+	case item = <-c.receive.queue:
+	case <-c.hang:
+		return nil, c.wait(start)
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+
+	// wait until due
+	if !c.sleep(item.due) {
+		return nil, net.ErrClosed
+	}
+
+	return item.pkt, item.err
+}
+
+func (c *FaultConn) sender() {
+	for {
+		// get next item
+		var item *faultItem
+		select {
+		case item = <-c.send.queue:
+		case <-c.closed:
+			return
+		}
+
+		// wait until due
+		if !c.sleep(item.due) {
+			return
+		}
+
+		// send packet
+		err := c.conn.Send(item.pkt, false)
+		if err != nil {
+			c.mutex.Lock()
+			c.sendErr = err
+			c.mutex.Unlock()
+			return
+		}
+	}
+}
+
+func (c *FaultConn) receiver() {
+	for {
+		// receive packet
+		pkt, err := c.conn.Receive()
+
+		// apply rules
+		var due time.Time
+		if err == nil {
+			pkt, due, err = c.apply(pkt, &c.receive)
+			if err == nil && pkt == nil {
+				// stop reading if hung
+				if c.isHung() {
+					return
+				}
+
+				continue
+			}
+		}
+
+		// queue item
+		select {
+		case c.receive.queue <- &faultItem{pkt: pkt, err: err, due: due}:
+		case <-c.closed:
+			return
+		}
+
+		// stop on error
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wait blocks until the read timeout has been reached since the specified
+// start and returns a timeout error. It blocks until the connection is closed
+// if no read timeout has been set.
+func (c *FaultConn) wait(start time.Time) error {
+	// get timeout
+	c.mutex.Lock()
+	timeout := c.timeout
+	c.mutex.Unlock()
+
+	// wait for close if no timeout is set
+	if timeout <= 0 {
+		<-c.closed
+		return net.ErrClosed
+	}
+
+	// wait for timeout
+	if !c.sleep(start.Add(timeout)) {
+		return net.ErrClosed
+	}
+
+	return faultTimeoutError{}
+}
+
+func (c *FaultConn) isHung() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.hung
+}
+
+func (c *FaultConn) sleep(due time.Time) bool {
+	// get delay
+	delay := time.Until(due)
+	if delay <= 0 {
+		return true
+	}
+
+	// wait delay
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// Close will close the underlying connection. Delayed packets that have not
+// yet been sent or received are discarded.
+func (c *FaultConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+
+	return c.conn.Close()
+}
+
+// Unwrap returns the underlying connection.
+func (c *FaultConn) Unwrap() Conn {
+	return c.conn
+}
+
+// SetReadLimit will set the read limit of the underlying connection.
+func (c *FaultConn) SetReadLimit(limit int64) {
+	c.conn.SetReadLimit(limit)
+}
+
+// SetReadTimeout will set the read timeout of the underlying connection. The
+// timeout is also used to fail receive calls once the connection hung.
+func (c *FaultConn) SetReadTimeout(timeout time.Duration) {
+	c.mutex.Lock()
+	c.timeout = timeout
+	c.mutex.Unlock()
+
+	c.conn.SetReadTimeout(timeout)
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (c *FaultConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (c *FaultConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// PeerCertificates returns the peer certificates of the underlying connection.
+func (c *FaultConn) PeerCertificates() []*x509.Certificate {
+	return c.conn.PeerCertificates()
+}
+
+// Stats returns the traffic stats of the underlying connection.
+func (c *FaultConn) Stats() TrafficStats {
+	return c.conn.Stats()
+}
+
+// apply returns the packet that should be passed on and the time it is due,
+// nil if the packet should be discarded or an error if the connection has been
+// reset. The due time is zero if the direction is not delayed.
+func (c *FaultConn) apply(pkt packet.Generic, dir *faultDirection) (packet.Generic, time.Time, error) {
+	// acquire mutex
+	c.mutex.Lock()
+
+	// check state
+	if c.reset {
+		c.mutex.Unlock()
+		return nil, time.Time{}, ErrInjectedReset
+	} else if c.hung {
+		c.mutex.Unlock()
+		return nil, time.Time{}, nil
+	}
+
+	// count packet
+	c.packets++
+	c.bytes += int64(pkt.Len())
+
+	// check reset
+	if (c.config.ResetAfterPackets > 0 && c.packets > c.config.ResetAfterPackets) ||
+		(c.config.ResetAfterBytes > 0 && c.bytes > c.config.ResetAfterBytes) {
+		c.reset = true
+		c.mutex.Unlock()
+		_ = c.conn.Close()
+		return nil, time.Time{}, ErrInjectedReset
+	}
+
+	// check hang
+	if c.config.HangAfterPackets > 0 && c.packets > c.config.HangAfterPackets {
+		c.hung = true
+		close(c.hang)
+		c.mutex.Unlock()
+		return nil, time.Time{}, nil
+	}
+
+	// release mutex
+	c.mutex.Unlock()
+
+	// acquire direction mutex
+	dir.mutex.Lock()
+
+	// schedule delivery
+	rules := &dir.rules
+	var due time.Time
+	if dir.delayed() {
+		due = dir.schedule(pkt.Len())
+	}
+
+	// check drop
+	drop := rules.DropRate > 0 && matchType(rules.DropTypes, pkt.Type()) && dir.random.Float64() < rules.DropRate
+
+	// corrupt packet
+	var corruptErr error
+	if !drop && rules.CorruptRate > 0 {
+		pkt, corruptErr = corrupt(pkt, rules.CorruptRate, dir.random)
+	}
+
+	// release direction mutex
+	dir.mutex.Unlock()
+
+	// handle corruption
+	if corruptErr != nil {
+		if dir == &c.send {
+			c.mutex.Lock()
+			c.reset = true
+			c.mutex.Unlock()
+			_ = c.conn.Close()
+			return nil, time.Time{}, ErrInjectedReset
+		}
+
+		_ = c.conn.Close()
+		return nil, due, corruptErr
+	}
+
+	// handle drop
+	if drop {
+		return nil, time.Time{}, nil
+	}
+
+	return pkt, due, nil
+}
+
+func corrupt(pkt packet.Generic, rate float64, random *rand.Rand) (packet.Generic, error) {
+	// encode packet
+	buf := make([]byte, pkt.Len())
+	_, err := pkt.Encode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// flip bytes
+	corrupted := false
+	for i := range buf {
+		if random.Float64() < rate {
+			buf[i] ^= byte(1 + random.Intn(255))
+			corrupted = true
+		}
+	}
+
+	// return original packet if unchanged
+	if !corrupted {
+		return pkt, nil
+	}
+
+	// detect packet
+	_, typ := packet.DetectPacket(buf)
+
+	// create packet
+	corruptedPkt, err := typ.New()
+	if err != nil {
+		return nil, err
+	}
+
+	// decode packet
+	_, err = corruptedPkt.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return corruptedPkt, nil
+}
+
+func matchType(types []packet.Type, typ packet.Type) bool {
+	// match all types by default
+	if len(types) == 0 {
+		return true
+	}
+
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The FaultDialer wraps a Dialer and returns connections that inject faults.
+// The seed is incremented for every dialed connection.
+type FaultDialer struct {
+	dialer *Dialer
+	config FaultConfig
+	mutex  sync.Mutex
+}
+
+// NewFaultDialer wraps the provided dialer.
+func NewFaultDialer(dialer *Dialer, config FaultConfig) *FaultDialer {
+	return &FaultDialer{
+		dialer: dialer,
+		config: config,
+	}
+}
+
+// Dial will dial a connection using the underlying dialer and wrap it.
+func (d *FaultDialer) Dial(urlString string) (Conn, error) {
+	// dial connection
+	conn, err := d.dialer.Dial(urlString)
+	if err != nil {
+		return nil, err
+	}
+
+	// get config
+	d.mutex.Lock()
+	config := d.config
+	d.config.Seed++
+	d.mutex.Unlock()
+
+	return NewFaultConn(conn, config), nil
+}
+
+// The FaultServer wraps a Server and returns connections that inject faults.
+// The seed is incremented for every accepted connection.
+type FaultServer struct {
+	Server
+
+	config FaultConfig
+	mutex  sync.Mutex
+}
+
+// NewFaultServer wraps the provided server.
+func NewFaultServer(server Server, config FaultConfig) *FaultServer {
+	return &FaultServer{
+		Server: server,
+		config: config,
+	}
+}
+
+// Accept will accept the next connection from the underlying server and wrap
+// it.
+func (s *FaultServer) Accept() (Conn, error) {
+	// accept connection
+	conn, err := s.Server.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// get config
+	s.mutex.Lock()
+	config := s.config
+	s.config.Seed++
+	s.mutex.Unlock()
+
+	return NewFaultConn(conn, config), nil
+}
@@ -0,0 +1,346 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func faultPair(t *testing.T, config FaultConfig) (*FaultConn, Conn, func()) {
+	server, err := testLauncher.Launch("tcp://localhost:0")
+	require.NoError(t, err)
+
+	accepted := make(chan Conn, 1)
+	go func() {
+		conn, err := server.Accept()
+		require.NoError(t, err)
+		accepted <- conn
+	}()
+
+	conn, err := testDialer.Dial(getURL(server, "tcp"))
+	require.NoError(t, err)
+
+	peer := <-accepted
+
+	return NewFaultConn(conn, config), peer, func() {
+		_ = conn.Close()
+		_ = peer.Close()
+		_ = server.Close()
+	}
+}
+
+func TestFaultConnLatency(t *testing.T) {
+	conn, peer, cleanup := faultPair(t, FaultConfig{
+		Send: FaultRules{
+			Latency: 50 * time.Millisecond,
+		},
+		Receive: FaultRules{
+			Latency: 50 * time.Millisecond,
+		},
+	})
+	defer cleanup()
+
+	start := time.Now()
+	err := conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	pkt, err := peer.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewPingreq(), pkt)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	err = peer.Send(packet.NewPingresp(), false)
+	assert.NoError(t, err)
+
+	start = time.Now()
+	pkt, err = conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewPingresp(), pkt)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestFaultConnLatencyThroughput(t *testing.T) {
+	conn, peer, cleanup := faultPair(t, FaultConfig{
+		Send: FaultRules{
+			Latency: 50 * time.Millisecond,
+			Jitter:  10 * time.Millisecond,
+		},
+		Receive: FaultRules{
+			Latency: 50 * time.Millisecond,
+			Jitter:  10 * time.Millisecond,
+		},
+	})
+	defer cleanup()
+
+	start := time.Now()
+
+	for i := 1; i <= 20; i++ {
+		puback := packet.NewPuback()
+		puback.ID = packet.ID(i)
+
+		err := conn.Send(puback, false)
+		assert.NoError(t, err)
+	}
+
+	for i := 1; i <= 20; i++ {
+		pkt, err := peer.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.ID(i), pkt.(*packet.Puback).ID)
+
+		err = peer.Send(pkt, false)
+		assert.NoError(t, err)
+	}
+
+	for i := 1; i <= 20; i++ {
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.ID(i), pkt.(*packet.Puback).ID)
+	}
+
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 100*time.Millisecond)
+	assert.True(t, elapsed < 500*time.Millisecond)
+}
+
+func TestFaultConnBandwidth(t *testing.T) {
+	conn, peer, cleanup := faultPair(t, FaultConfig{
+		Send: FaultRules{
+			Bandwidth: 10000,
+		},
+	})
+	defer cleanup()
+
+	publish := packet.NewPublish()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = make([]byte, 92)
+	assert.Equal(t, 100, publish.Len())
+
+	start := time.Now()
+
+	// concurrent senders share the bandwidth
+	for i := 0; i < 2; i++ {
+		go func() {
+			for j := 0; j < 5; j++ {
+				assert.NoError(t, conn.Send(publish, false))
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := peer.Receive()
+		assert.NoError(t, err)
+	}
+
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+}
+
+func TestFaultConnDropTypes(t *testing.T) {
+	conn, peer, cleanup := faultPair(t, FaultConfig{
+		Send: FaultRules{
+			DropRate:  1,
+			DropTypes: []packet.Type{packet.PUBACK},
+		},
+		Receive: FaultRules{
+			DropRate:  1,
+			DropTypes: []packet.Type{packet.PUBREC},
+		},
+	})
+	defer cleanup()
+
+	puback := packet.NewPuback()
+	puback.ID = 1
+
+	err := conn.Send(puback, false)
+	assert.NoError(t, err)
+
+	err = conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	pkt, err := peer.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewPingreq(), pkt)
+
+	pubrec := packet.NewPubrec()
+	pubrec.ID = 1
+
+	err = peer.Send(pubrec, false)
+	assert.NoError(t, err)
+
+	err = peer.Send(packet.NewPingresp(), false)
+	assert.NoError(t, err)
+
+	pkt, err = conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewPingresp(), pkt)
+}
+
+func TestFaultConnResetAfterPackets(t *testing.T) {
+	conn, peer, cleanup := faultPair(t, FaultConfig{
+		ResetAfterPackets: 2,
+	})
+	defer cleanup()
+
+	err := conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	err = conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	err = conn.Send(packet.NewPingreq(), false)
+	assert.Equal(t, ErrInjectedReset, err)
+
+	pkt, err := conn.Receive()
+	assert.Nil(t, pkt)
+	assert.Error(t, err)
+
+	for i := 0; i < 2; i++ {
+		pkt, err = peer.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.NewPingreq(), pkt)
+	}
+
+	pkt, err = peer.Receive()
+	assert.Nil(t, pkt)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFaultConnResetAfterBytes(t *testing.T) {
+	conn, _, cleanup := faultPair(t, FaultConfig{
+		ResetAfterBytes: 5,
+	})
+	defer cleanup()
+
+	err := conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	err = conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	err = conn.Send(packet.NewPingreq(), false)
+	assert.Equal(t, ErrInjectedReset, err)
+}
+
+func TestFaultConnHang(t *testing.T) {
+	conn, peer, cleanup := faultPair(t, FaultConfig{
+		HangAfterPackets: 1,
+	})
+	defer cleanup()
+
+	err := conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	err = conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	pkt, err := peer.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewPingreq(), pkt)
+
+	err = peer.Send(packet.NewPingresp(), false)
+	assert.NoError(t, err)
+
+	conn.SetReadTimeout(50 * time.Millisecond)
+
+	pkt, err = conn.Receive()
+	assert.Nil(t, pkt)
+	if assert.Error(t, err) {
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout())
+	}
+}
+
+func TestFaultConnCorruptDeterministic(t *testing.T) {
+	publishes := make([]packet.Generic, 20)
+	for i := range publishes {
+		publish := packet.NewPublish()
+		publish.ID = packet.ID(i + 1)
+		publish.Message.Topic = "test"
+		publish.Message.Payload = []byte("payload")
+		publish.Message.QOS = 1
+		publishes[i] = publish
+	}
+
+	run := func() []string {
+		conn, peer, cleanup := faultPair(t, FaultConfig{
+			Seed: 42,
+			Receive: FaultRules{
+				CorruptRate: 0.02,
+			},
+		})
+		defer cleanup()
+
+		go func() {
+			for _, publish := range publishes {
+				if peer.Send(publish, false) != nil {
+					return
+				}
+			}
+		}()
+
+		var results []string
+		for range publishes {
+			pkt, err := conn.Receive()
+			if err != nil {
+				results = append(results, err.Error())
+				break
+			}
+
+			results = append(results, pkt.String())
+		}
+
+		return results
+	}
+
+	var expected []string
+	for _, publish := range publishes {
+		expected = append(expected, publish.String())
+	}
+
+	first := run()
+	assert.NotEqual(t, expected, first)
+	assert.Equal(t, first, run())
+}
+
+func TestFaultDialerAndServer(t *testing.T) {
+	server, err := testLauncher.Launch("tcp://localhost:0")
+	require.NoError(t, err)
+
+	faultServer := NewFaultServer(server, FaultConfig{Seed: 10})
+
+	done := make(chan struct{})
+	go func() {
+		for _, seed := range []int64{10, 11} {
+			conn, err := faultServer.Accept()
+			require.NoError(t, err)
+			assert.Equal(t, seed, conn.(*FaultConn).config.Seed)
+		}
+
+		close(done)
+	}()
+
+	dialer := NewFaultDialer(testDialer, FaultConfig{Seed: 5})
+
+	conn1, err := dialer.Dial(getURL(server, "tcp"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), conn1.(*FaultConn).config.Seed)
+
+	conn2, err := dialer.Dial(getURL(server, "tcp"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), conn2.(*FaultConn).config.Seed)
+
+	safeReceive(done)
+
+	err = conn1.Close()
+	assert.NoError(t, err)
+
+	err = conn2.Close()
+	assert.NoError(t, err)
+
+	err = faultServer.Close()
+	assert.NoError(t, err)
+}
@@ -2,12 +2,34 @@ package transport
 
 import (
 	"crypto/tls"
+	"errors"
+	"net"
 	"net/url"
+	"os"
 )
 
+var errMissingCertificate = errors.New("tls: neither Certificates, GetCertificate, nor GetConfigForClient set in Config")
+
 // The Launcher helps with launching a server and accepting connections.
 type Launcher struct {
 	TLSConfig *tls.Config
+
+	// The file mode of created Unix sockets.
+	//
+	// Will default to the mode derived from the umask.
+	UnixSocketMode os.FileMode
+
+	// The owner of created Unix sockets. A nil id leaves the respective owner
+	// unchanged.
+	UnixSocketUID *int
+	UnixSocketGID *int
+
+	// The optional policy that enables PROXY protocol headers for TCP, TLS
+	// and WebSocket servers and Forwarded headers for WebSocket servers.
+	ProxyPolicy *ProxyPolicy
+
+	// The optional functions that launch servers for additional schemes.
+	Schemes map[string]func(urlParts *url.URL) (Server, error)
 }
 
 // NewLauncher returns a new Launcher.
@@ -33,6 +55,19 @@ func (l *Launcher) Launch(urlString string) (Server, error) {
 		return nil, err
 	}
 
+	// launch additional schemes
+	if fn, ok := l.Schemes[urlParts.Scheme]; ok {
+		return fn(urlParts)
+	}
+
+	// launch proxied servers
+	if l.ProxyPolicy != nil {
+		switch urlParts.Scheme {
+		case "tcp", "mqtt", "tls", "mqtts", "ws", "wss", "multi":
+			return l.launchProxied(urlParts.Scheme, urlParts.Host)
+		}
+	}
+
 	switch urlParts.Scheme {
 	case "tcp", "mqtt":
 		return CreateNetServer(urlParts.Host)
@@ -42,7 +77,47 @@ func (l *Launcher) Launch(urlString string) (Server, error) {
 		return CreateWebSocketServer(urlParts.Host)
 	case "wss":
 		return CreateSecureWebSocketServer(urlParts.Host, l.TLSConfig)
+	case "multi":
+		return CreateMultiServer(urlParts.Host, l.TLSConfig)
+	case "unix":
+		return CreateUnixServer(unixPath(urlParts), l.UnixSocketMode, ownerID(l.UnixSocketUID), ownerID(l.UnixSocketGID))
+	case "memory":
+		return CreateMemoryServer(urlParts.Host)
 	}
 
 	return nil, ErrUnsupportedProtocol
 }
+
+func (l *Launcher) launchProxied(scheme, address string) (Server, error) {
+	// check TLS config
+	secure := scheme == "tls" || scheme == "mqtts" || scheme == "wss"
+	if secure && (l.TLSConfig == nil || (len(l.TLSConfig.Certificates) == 0 && l.TLSConfig.GetCertificate == nil && l.TLSConfig.GetConfigForClient == nil)) {
+		return nil, errMissingCertificate
+	}
+
+	// create listener
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// read proxy headers before TLS handshake
+	listener = NewProxyListener(listener, l.ProxyPolicy)
+	if secure {
+		listener = tls.NewListener(listener, l.TLSConfig)
+	}
+
+	// create server
+	switch scheme {
+	case "ws", "wss":
+		server := NewWebSocketServer(listener)
+		server.SetProxyPolicy(l.ProxyPolicy)
+		return server, nil
+	case "multi":
+		server := NewMultiServer(listener, l.TLSConfig)
+		server.SetProxyPolicy(l.ProxyPolicy)
+		return server, nil
+	default:
+		return NewNetServer(listener), nil
+	}
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -26,3 +27,19 @@ func TestLauncherUnsupportedProtocol(t *testing.T) {
 	assert.Nil(t, conn)
 	assert.Equal(t, ErrUnsupportedProtocol, err)
 }
+
+func TestLauncherSchemes(t *testing.T) {
+	launcher := NewLauncher()
+	launcher.Schemes = map[string]func(*url.URL) (Server, error){
+		"foo": func(urlParts *url.URL) (Server, error) {
+			return CreateMemoryServer(urlParts.Host)
+		},
+	}
+
+	server, err := launcher.Launch("foo://launcher-schemes")
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryServer{}, server)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
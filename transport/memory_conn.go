@@ -0,0 +1,391 @@
+package transport
+
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+)
+
+type memoryTimeoutError struct{}
+
+func (memoryTimeoutError) Error() string   { return "i/o timeout" }
+func (memoryTimeoutError) Timeout() bool   { return true }
+func (memoryTimeoutError) Temporary() bool { return true }
+
+type memoryPipe struct {
+	queue  []interface{}
+	size   int
+	notify chan struct{}
+	space  chan struct{}
+	closed bool
+	mutex  sync.Mutex
+}
+
+func newMemoryPipe(size int) *memoryPipe {
+	return &memoryPipe{
+		size:   size,
+		notify: make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+}
+
+func (p *memoryPipe) push(item interface{}) bool {
+	for {
+		// acquire mutex
+		p.mutex.Lock()
+
+		// check if closed
+		if p.closed {
+			p.mutex.Unlock()
+			return false
+		}
+
+		// add item if there is room
+		if len(p.queue) < p.size {
+			p.queue = append(p.queue, item)
+			p.signal()
+			p.mutex.Unlock()
+			return true
+		}
+
+		// release mutex
+		p.mutex.Unlock()
+
+		// wait for room or close
+		<-p.space
+	}
+}
+
+func (p *memoryPipe) pop() (interface{}, bool) {
+	// acquire mutex
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// return queued item first
+	if len(p.queue) > 0 {
+		item := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.release()
+		return item, true
+	}
+
+	return nil, !p.closed
+}
+
+func (p *memoryPipe) close() {
+	// acquire mutex
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// set flag and wake up reader and writer
+	p.closed = true
+	p.signal()
+	p.release()
+}
+
+func (p *memoryPipe) signal() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *memoryPipe) release() {
+	select {
+	case p.space <- struct{}{}:
+	default:
+	}
+}
+
+// A MemoryConn is an in-process connection created by DialMemory and accepted
+// by a MemoryServer. Sent packets are either encoded or, if the server is
+// configured to do so, passed as is to the other end. Like a network
+// connection, Send blocks if the other end does not receive the queued
+// packets in time.
+type MemoryConn struct {
+	addr MemoryAddr
+	raw  bool
+
+	in     *memoryPipe
+	out    *memoryPipe
+	closed chan struct{}
+
+	meter *trafficMeter
+
+	limit    int64
+	timeout  time.Duration
+	deadline time.Time
+
+	sMutex sync.Mutex
+	rMutex sync.Mutex
+	mutex  sync.Mutex
+}
+
+func newMemoryConnPair(addr MemoryAddr, raw bool, size int) (*MemoryConn, *MemoryConn) {
+	// create pipes
+	pipe1 := newMemoryPipe(size)
+	pipe2 := newMemoryPipe(size)
+
+	// create connections
+	conn1 := &MemoryConn{
+		addr:   addr,
+		raw:    raw,
+		in:     pipe1,
+		out:    pipe2,
+		closed: make(chan struct{}),
+		meter:  newTrafficMeter(),
+	}
+	conn2 := &MemoryConn{
+		addr:   addr,
+		raw:    raw,
+		in:     pipe2,
+		out:    pipe1,
+		closed: make(chan struct{}),
+		meter:  newTrafficMeter(),
+	}
+
+	return conn1, conn2
+}
+
+// Send will queue the packet for the other end. It blocks until there is room
+// in the queue or the connection has been closed. Encoding errors are directly
+// returned and will close the connection.
+//
+// Note: Only one goroutine can Send at the same time.
+func (c *MemoryConn) Send(pkt packet.Generic, async bool) error {
+	c.sMutex.Lock()
+	defer c.sMutex.Unlock()
+
+	// check if closed
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	// encode packet if not raw
+	var item interface{} = pkt
+	if !c.raw {
+		buf := make([]byte, pkt.Len())
+		_, err := pkt.Encode(buf)
+		if err != nil {
+			// ensure connection gets closed
+			_ = c.Close()
+
+			return err
+		}
+
+		item = buf
+	}
+
+	// queue packet
+	if !c.out.push(item) {
+		// ensure connection gets closed
+		_ = c.Close()
+
+		return io.ErrClosedPipe
+	}
+
+	// count packet
+	c.meter.countSent(pkt)
+
+	return nil
+}
+
+// Receive will return the next packet sent by the other end. It will return
+// io.EOF if the other end has been closed and all queued packets have been
+// received.
+//
+// Note: Only one goroutine can Receive at the same time.
+func (c *MemoryConn) Receive() (packet.Generic, error) {
+	c.rMutex.Lock()
+	defer c.rMutex.Unlock()
+
+	for {
+		// check if closed
+		select {
+		case <-c.closed:
+			return nil, net.ErrClosed
+		default:
+		}
+
+		// get next item
+		item, ok := c.in.pop()
+		if item != nil {
+			// decode packet
+			pkt, err := c.decode(item)
+			if err != nil {
+				// ensure connection gets closed
+				_ = c.Close()
+
+				return nil, err
+			}
+
+			// count packet
+			c.meter.countReceived(pkt)
+
+			// reset timeout
+			c.mutex.Lock()
+			c.resetTimeout()
+			c.mutex.Unlock()
+
+			return pkt, nil
+		} else if !ok {
+			// ensure connection gets closed
+			_ = c.Close()
+
+			return nil, io.EOF
+		}
+
+		// get deadline
+		c.mutex.Lock()
+		deadline := c.deadline
+		c.mutex.Unlock()
+
+		// prepare timeout
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			// check deadline
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				// ensure connection gets closed
+				_ = c.Close()
+
+				return nil, memoryTimeoutError{}
+			}
+
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		// wait for next item, close or timeout
+		select {
+		case <-c.in.notify:
+		case <-c.closed:
+		case <-timeout:
+		}
+
+		// stop timer
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Close will close both ends of the connection. Packets that have already
+// been queued can still be received by the other end.
+func (c *MemoryConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// check if already closed
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	// close pipes
+	close(c.closed)
+	c.in.close()
+	c.out.close()
+
+	return nil
+}
+
+// SetReadLimit sets the maximum size of a packet that can be received.
+// If the limit is greater than zero, Receive will close the connection and
+// return an Error if receiving the next packet will exceed the limit.
+func (c *MemoryConn) SetReadLimit(limit int64) {
+	c.mutex.Lock()
+	c.limit = limit
+	c.mutex.Unlock()
+}
+
+// SetReadTimeout sets the maximum time that can pass between reads.
+// If no data is received in the set duration the connection will be closed
+// and Read returns an error.
+func (c *MemoryConn) SetReadTimeout(timeout time.Duration) {
+	c.mutex.Lock()
+	c.timeout = timeout
+	c.resetTimeout()
+	c.mutex.Unlock()
+
+	// wake up a pending receive to apply the new timeout
+	c.in.signal()
+}
+
+// LocalAddr returns the address of the memory server.
+func (c *MemoryConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// RemoteAddr returns the address of the memory server.
+func (c *MemoryConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// PeerCertificates always returns nil as memory connections are not secured
+// by TLS.
+func (c *MemoryConn) PeerCertificates() []*x509.Certificate {
+	return nil
+}
+
+// Stats returns a snapshot of the traffic carried by the connection. Memory
+// connections never buffer sent packets.
+func (c *MemoryConn) Stats() TrafficStats {
+	return c.meter.stats(false)
+}
+
+func (c *MemoryConn) decode(item interface{}) (packet.Generic, error) {
+	// get limit
+	c.mutex.Lock()
+	limit := c.limit
+	c.mutex.Unlock()
+
+	// check raw packet
+	if pkt, ok := item.(packet.Generic); ok {
+		if limit > 0 && int64(pkt.Len()) > limit {
+			return nil, packet.ErrReadLimitExceeded
+		}
+
+		return pkt, nil
+	}
+
+	// get buffer
+	buf := item.([]byte)
+	if limit > 0 && int64(len(buf)) > limit {
+		return nil, packet.ErrReadLimitExceeded
+	}
+
+	// detect packet
+	_, typ := packet.DetectPacket(buf)
+
+	// create packet
+	pkt, err := typ.New()
+	if err != nil {
+		return nil, err
+	}
+
+	// decode packet
+	_, err = pkt.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
+func (c *MemoryConn) resetTimeout() {
+	if c.timeout > 0 {
+		c.deadline = time.Now().Add(c.timeout)
+	} else {
+		c.deadline = time.Time{}
+	}
+}
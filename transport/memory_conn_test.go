@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryConnConnection(t *testing.T) {
+	abstractConnConnectTest(t, "memory")
+}
+
+func TestMemoryConnClose(t *testing.T) {
+	abstractConnCloseTest(t, "memory")
+}
+
+func TestMemoryConnEncodeError(t *testing.T) {
+	abstractConnEncodeErrorTest(t, "memory")
+}
+
+func TestMemoryConnDecodeError(t *testing.T) {
+	abstractConnDecodeErrorTest(t, "memory")
+}
+
+func TestMemoryConnSendAfterClose(t *testing.T) {
+	abstractConnSendAfterCloseTest(t, "memory")
+}
+
+func TestMemoryConnCloseWhileSend(t *testing.T) {
+	abstractConnCloseWhileSendTest(t, "memory")
+}
+
+func TestMemoryConnSendAndCloseTest(t *testing.T) {
+	abstractConnSendAndCloseTest(t, "memory")
+}
+
+func TestMemoryConnReadLimit(t *testing.T) {
+	abstractConnReadLimitTest(t, "memory")
+}
+
+func TestMemoryConnReadTimeout(t *testing.T) {
+	abstractConnReadTimeoutTest(t, "memory")
+}
+
+func TestMemoryConnCloseAfterClose(t *testing.T) {
+	abstractConnCloseAfterCloseTest(t, "memory")
+}
+
+func TestMemoryConnAddr(t *testing.T) {
+	abstractConnAddrTest(t, "memory")
+}
+
+func TestMemoryConnAsyncSend(t *testing.T) {
+	abstractConnAsyncSendTest(t, "memory")
+}
+
+func TestMemoryConnSendAfterAsyncSend(t *testing.T) {
+	abstractConnSendAfterAsyncSendTest(t, "memory")
+}
+
+func TestMemoryConnCloseAfterAsyncSend(t *testing.T) {
+	abstractConnCloseAfterAsyncSendTest(t, "memory")
+}
+
+func TestMemoryConnBigAsyncSendAfterClose(t *testing.T) {
+	abstractConnBigAsyncSendAfterCloseTest(t, "memory")
+}
+
+func TestMemoryConnStats(t *testing.T) {
+	abstractConnStatsTest(t, "memory")
+}
+
+func TestMemoryConnRaw(t *testing.T) {
+	conn1, conn2 := newMemoryConnPair("test", true, 10)
+
+	pub := packet.NewPublish()
+	pub.Message.Topic = "hello"
+	pub.Message.Payload = []byte("world")
+
+	err := conn1.Send(pub, false)
+	assert.NoError(t, err)
+
+	pkt, err := conn2.Receive()
+	assert.NoError(t, err)
+	assert.True(t, pkt == pub)
+
+	conn2.SetReadLimit(int64(pub.Len() - 1))
+
+	err = conn1.Send(pub, false)
+	assert.NoError(t, err)
+
+	pkt, err = conn2.Receive()
+	assert.Nil(t, pkt)
+	assert.Equal(t, packet.ErrReadLimitExceeded, err)
+
+	err = conn1.Send(pub, false)
+	assert.Error(t, err)
+}
+
+func TestMemoryConnReadTimeoutWhileReceiving(t *testing.T) {
+	conn1, conn2 := newMemoryConnPair("test", false, 10)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn1.SetReadTimeout(10 * time.Millisecond)
+	}()
+
+	pkt, err := conn1.Receive()
+	assert.Nil(t, pkt)
+	assert.Error(t, err)
+	assert.True(t, err.(interface{ Timeout() bool }).Timeout())
+
+	pkt, err = conn2.Receive()
+	assert.Nil(t, pkt)
+	assert.Error(t, err)
+}
+
+func TestMemoryConnSendBlocksWhenFull(t *testing.T) {
+	conn1, conn2 := newMemoryConnPair("test", false, 2)
+
+	assert.NoError(t, conn1.Send(packet.NewPingreq(), false))
+	assert.NoError(t, conn1.Send(packet.NewPingreq(), true))
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- conn1.Send(packet.NewPingreq(), false)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("send did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pkt, err := conn2.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.PINGREQ, pkt.Type())
+
+	select {
+	case err := <-sent:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("send did not resume")
+	}
+
+	go func() {
+		sent <- conn1.Send(packet.NewPingreq(), false)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, conn2.Close())
+
+	select {
+	case err := <-sent:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("send did not fail")
+	}
+}
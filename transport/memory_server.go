@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrAddressInUse is returned by CreateMemoryServer if a memory server with
+// the same name already exists.
+var ErrAddressInUse = errors.New("address in use")
+
+// ErrConnectionRefused is returned by DialMemory if no memory server with the
+// specified name exists or the server has been closed.
+var ErrConnectionRefused = errors.New("connection refused")
+
+var memoryServers = make(map[string]*MemoryServer)
+var memoryMutex sync.Mutex
+
+// A MemoryAddr is the address of a memory server.
+type MemoryAddr string
+
+// Network returns the network name "memory".
+func (a MemoryAddr) Network() string {
+	return "memory"
+}
+
+// String returns the name of the memory server.
+func (a MemoryAddr) String() string {
+	return string(a)
+}
+
+// The MemoryServer accepts in-process connections that have been created by
+// DialMemory using the same name. Servers are registered in a process wide
+// registry until they are closed.
+type MemoryServer struct {
+	// Raw may be set to pass packets without encoding and decoding them. The
+	// packets are then shared between both ends and must not be modified after
+	// they have been sent.
+	Raw bool
+
+	// The number of packets that can be queued per direction before Send
+	// blocks.
+	//
+	// Will default to 256.
+	QueueSize int
+
+	name     string
+	incoming chan *MemoryConn
+	closed   chan struct{}
+	mutex    sync.Mutex
+}
+
+// CreateMemoryServer creates and registers a new memory server with the
+// provided name.
+func CreateMemoryServer(name string) (*MemoryServer, error) {
+	// acquire mutex
+	memoryMutex.Lock()
+	defer memoryMutex.Unlock()
+
+	// check registry
+	if _, ok := memoryServers[name]; ok {
+		return nil, ErrAddressInUse
+	}
+
+	// create server
+	server := &MemoryServer{
+		QueueSize: 256,
+		name:      name,
+		incoming:  make(chan *MemoryConn),
+		closed:    make(chan struct{}),
+	}
+
+	// register server
+	memoryServers[name] = server
+
+	return server, nil
+}
+
+// DialMemory will connect to the memory server with the provided name. It
+// blocks until the server accepts the connection.
+func DialMemory(name string) (*MemoryConn, error) {
+	// get server
+	memoryMutex.Lock()
+	server, ok := memoryServers[name]
+	memoryMutex.Unlock()
+	if !ok {
+		return nil, ErrConnectionRefused
+	}
+
+	// get queue size
+	size := server.QueueSize
+	if size <= 0 {
+		size = 256
+	}
+
+	// create connection pair
+	conn1, conn2 := newMemoryConnPair(MemoryAddr(name), server.Raw, size)
+
+	// hand over connection
+	select {
+	case server.incoming <- conn1:
+		return conn2, nil
+	case <-server.closed:
+		return nil, ErrConnectionRefused
+	}
+}
+
+// Accept will return the next available connection or block until a
+// connection becomes available, otherwise returns an Error.
+func (s *MemoryServer) Accept() (Conn, error) {
+	select {
+	case conn := <-s.incoming:
+		return conn, nil
+	case <-s.closed:
+		return nil, ErrAcceptAfterClose
+	}
+}
+
+// Close will unregister the server and cleanup resources. Already accepted
+// connections are not closed.
+func (s *MemoryServer) Close() error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check if already closed
+	select {
+	case <-s.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	// unregister server
+	memoryMutex.Lock()
+	delete(memoryServers, s.name)
+	memoryMutex.Unlock()
+
+	// close channel
+	close(s.closed)
+
+	return nil
+}
+
+// Addr returns the server's address.
+func (s *MemoryServer) Addr() net.Addr {
+	return MemoryAddr(s.name)
+}
@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryServer(t *testing.T) {
+	abstractServerTest(t, "memory")
+}
+
+func TestMemoryServerAcceptAfterClose(t *testing.T) {
+	abstractServerAcceptAfterCloseTest(t, "memory")
+}
+
+func TestMemoryServerCloseAfterClose(t *testing.T) {
+	abstractServerCloseAfterCloseTest(t, "memory")
+}
+
+func TestMemoryServerAddr(t *testing.T) {
+	server, err := testLauncher.Launch("memory://broker")
+	require.NoError(t, err)
+
+	assert.Equal(t, "memory", server.Addr().Network())
+	assert.Equal(t, "broker", server.Addr().String())
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestMemoryServerAddressInUse(t *testing.T) {
+	server, err := CreateMemoryServer("broker")
+	require.NoError(t, err)
+
+	_, err = CreateMemoryServer("broker")
+	assert.Equal(t, ErrAddressInUse, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+
+	server, err = CreateMemoryServer("broker")
+	require.NoError(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestMemoryServerConnectionRefused(t *testing.T) {
+	conn, err := testDialer.Dial("memory://missing")
+	assert.Nil(t, conn)
+	assert.Equal(t, ErrConnectionRefused, err)
+}
@@ -0,0 +1,280 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// The MultiServer accepts raw MQTT, TLS secured MQTT, WebSocket and secure
+// WebSocket connections on a single listener. The protocol is detected by
+// inspecting the first bytes of every connection. Plain HTTP requests that
+// are not WebSocket upgrades are passed to the optional fallback handler.
+type MultiServer struct {
+	MaxWriteDelay time.Duration
+
+	// The time a connection has to complete the TLS handshake and send the
+	// first bytes.
+	//
+	// Will default to 10 seconds.
+	SniffTimeout time.Duration
+
+	listener  net.Listener
+	config    *tls.Config
+	http      *connListener
+	webSocket *WebSocketServer
+	incoming  chan Conn
+
+	tomb tomb.Tomb
+}
+
+// NewMultiServer wraps the provided listener. TLS connections are only
+// accepted if a config is provided.
+func NewMultiServer(listener net.Listener, config *tls.Config) *MultiServer {
+	// prepare http listener
+	httpListener := &connListener{
+		addr:   listener.Addr(),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+
+	// create server
+	s := &MultiServer{
+		listener:  listener,
+		config:    config,
+		http:      httpListener,
+		webSocket: NewWebSocketServer(httpListener),
+		incoming:  make(chan Conn),
+	}
+
+	// accept connections in background
+	s.tomb.Go(s.acceptor)
+	s.tomb.Go(s.forwarder)
+
+	return s
+}
+
+// CreateMultiServer creates a new multi protocol server that listens on the
+// provided address.
+func CreateMultiServer(address string, config *tls.Config) (*MultiServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMultiServer(listener, config), nil
+}
+
+// SetFallback will register a http.Handler that gets called if a request is not
+// a WebSocket upgrade request.
+func (s *MultiServer) SetFallback(handler http.Handler) {
+	s.webSocket.SetFallback(handler)
+}
+
+// SetOriginChecker sets an optional function that allows check the request origin
+// before accepting the connection.
+func (s *MultiServer) SetOriginChecker(fn func(r *http.Request) bool) {
+	s.webSocket.SetOriginChecker(fn)
+}
+
+// SetCompression enables the permessage-deflate extension for WebSocket
+// clients that request it. Compression is disabled if the config is nil.
+func (s *MultiServer) SetCompression(config *WebSocketCompression) {
+	s.webSocket.SetCompression(config)
+}
+
+// SetProxyPolicy sets an optional policy that allows trusted proxies to report
+// the address of the client using the Forwarded or X-Forwarded-For header.
+func (s *MultiServer) SetProxyPolicy(policy *ProxyPolicy) {
+	s.webSocket.SetProxyPolicy(policy)
+}
+
+// Accept will return the next available connection or block until a
+// connection becomes available, otherwise returns an Error.
+func (s *MultiServer) Accept() (Conn, error) {
+	select {
+	case <-s.tomb.Dying():
+		if s.tomb.Err() == errManualClose {
+			// server has been closed manually
+			return nil, ErrAcceptAfterClose
+		}
+
+		// return the previously caught error
+		return nil, s.tomb.Err()
+	case conn := <-s.incoming:
+		return conn, nil
+	}
+}
+
+// Close will close the underlying listener and cleanup resources. It will
+// return an Error if the underlying listener didn't close cleanly.
+func (s *MultiServer) Close() error {
+	s.tomb.Kill(errManualClose)
+
+	err := s.listener.Close()
+	_ = s.webSocket.Close()
+	_ = s.tomb.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Addr returns the server's network address.
+func (s *MultiServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *MultiServer) acceptor() error {
+	for {
+		// accept next connection
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		// detect protocol in background
+		go s.dispatch(conn)
+	}
+}
+
+func (s *MultiServer) forwarder() error {
+	for {
+		// get next WebSocket connection
+		conn, err := s.webSocket.Accept()
+		if err != nil {
+			return err
+		}
+
+		// forward connection
+		select {
+		case s.incoming <- conn:
+		case <-s.tomb.Dying():
+			_ = conn.Close()
+			return tomb.ErrDying
+		}
+	}
+}
+
+func (s *MultiServer) dispatch(conn net.Conn) {
+	// get timeout
+	timeout := s.SniffTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	// set deadline
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	// peek first byte
+	sc := newSniffConn(conn)
+	first, err := sc.reader.Peek(1)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	// perform TLS handshake if a TLS record is found
+	if first[0] == 0x16 {
+		// check config
+		if s.config == nil {
+			_ = conn.Close()
+			return
+		}
+
+		// perform handshake
+		tlsConn := tls.Server(sc, s.config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+
+		// peek first decrypted byte
+		sc = newSniffConn(tlsConn)
+		first, err = sc.reader.Peek(1)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+
+	// reset deadline
+	_ = conn.SetDeadline(time.Time{})
+
+	// pass HTTP requests to WebSocket server
+	if first[0] >= 'A' && first[0] <= 'Z' {
+		select {
+		case s.http.conns <- sc:
+		case <-s.http.closed:
+			_ = sc.Close()
+		}
+
+		return
+	}
+
+	// ensure write delay default
+	maxWriteDelay := s.MaxWriteDelay
+	if maxWriteDelay == 0 {
+		maxWriteDelay = 10 * time.Millisecond
+	}
+
+	// handle as raw MQTT connection
+	select {
+	case s.incoming <- NewNetConn(sc, maxWriteDelay):
+	case <-s.tomb.Dying():
+		_ = sc.Close()
+	}
+}
+
+type sniffConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+}
+
+func newSniffConn(conn net.Conn) *sniffConn {
+	return &sniffConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+type connListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
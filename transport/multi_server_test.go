@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiServer(t *testing.T) {
+	server, err := testLauncher.Launch("multi://localhost:0")
+	require.NoError(t, err)
+
+	server.(*MultiServer).SetFallback(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("admin"))
+	}))
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				pkt, err := conn.Receive()
+				assert.Equal(t, pkt.Type(), packet.CONNECT)
+				assert.NoError(t, err)
+
+				err = conn.Send(packet.NewConnack(), false)
+				assert.NoError(t, err)
+
+				_, _ = conn.Receive()
+			}()
+		}
+	}()
+
+	dialer := NewDialer()
+	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+
+	for _, protocol := range []string{"tcp", "tls", "ws", "wss"} {
+		conn, err := dialer.Dial(getURL(server, protocol))
+		require.NoError(t, err, protocol)
+
+		err = conn.Send(packet.NewConnect(), false)
+		assert.NoError(t, err)
+
+		pkt, err := conn.Receive()
+		assert.Equal(t, pkt.Type(), packet.CONNACK)
+		assert.NoError(t, err)
+
+		err = conn.Close()
+		assert.NoError(t, err)
+	}
+
+	for _, scheme := range []string{"http", "https"} {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+
+		res, err := client.Get(scheme + "://" + server.Addr().String())
+		require.NoError(t, err, scheme)
+
+		body, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "admin", string(body))
+		assert.NoError(t, res.Body.Close())
+	}
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestMultiServerWithoutTLS(t *testing.T) {
+	server, err := Launch("multi://localhost:0")
+	require.NoError(t, err)
+
+	dialer := NewDialer()
+	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+
+	conn, err := dialer.Dial(getURL(server, "tls"))
+	assert.Nil(t, conn)
+	assert.Error(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestMultiServerAcceptAfterClose(t *testing.T) {
+	abstractServerAcceptAfterCloseTest(t, "multi")
+}
+
+func TestMultiServerCloseAfterClose(t *testing.T) {
+	abstractServerCloseAfterCloseTest(t, "multi")
+}
+
+func TestMultiServerAddr(t *testing.T) {
+	abstractServerAddrTest(t, "multi")
+}
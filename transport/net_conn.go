@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"crypto/x509"
 	"net"
 	"time"
 )
@@ -30,6 +31,18 @@ func (c *NetConn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// PeerCertificates returns the verified certificate chain of the peer if the
+// connection is secured by TLS.
+func (c *NetConn) PeerCertificates() []*x509.Certificate {
+	return peerCertificates(c.conn)
+}
+
+// ProxyHeader returns the PROXY protocol header sent by the proxy if the
+// connection has been accepted by a server with a proxy policy.
+func (c *NetConn) ProxyHeader() *ProxyHeader {
+	return proxyHeader(c.conn)
+}
+
 // UnderlyingConn returns the underlying net.Conn.
 func (c *NetConn) UnderlyingConn() net.Conn {
 	return c.conn
@@ -73,6 +73,10 @@ func TestNetConnBigAsyncSendAfterClose(t *testing.T) {
 	abstractConnBigAsyncSendAfterCloseTest(t, "tcp")
 }
 
+func TestNetConnStats(t *testing.T) {
+	abstractConnStatsTest(t, "tcp")
+}
+
 func TestNetConnCloseWhileReadError(t *testing.T) {
 	conn2, done := connectionPair("tcp", func(conn1 Conn) {
 		pkt := packet.NewPublish()
@@ -0,0 +1,600 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidProxyHeader is returned when reading from a connection that
+// started with a malformed PROXY protocol header.
+var ErrInvalidProxyHeader = errors.New("invalid proxy header")
+
+// ErrMissingProxyHeader is returned when reading from a connection of a
+// trusted proxy that did not send a PROXY protocol header although the policy
+// requires one.
+var ErrMissingProxyHeader = errors.New("missing proxy header")
+
+// The PROXY protocol v2 TLV types.
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVCRC32C    byte = 0x03
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	ProxyTLVNetNS     byte = 0x30
+)
+
+// The PROXY protocol v2 SSL sub TLV types.
+const (
+	ProxySubTLVSSLVersion byte = 0x21
+	ProxySubTLVSSLCN      byte = 0x22
+	ProxySubTLVSSLCipher  byte = 0x23
+	ProxySubTLVSSLSigAlg  byte = 0x24
+	ProxySubTLVSSLKeyAlg  byte = 0x25
+)
+
+var proxyV1Signature = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A ProxyPolicy configures from which peers PROXY protocol headers and, for
+// WebSocket connections, Forwarded and X-Forwarded-For headers are accepted.
+type ProxyPolicy struct {
+	// The networks of trusted proxies. Headers sent by other peers are
+	// ignored. No peer is trusted if empty.
+	TrustedNetworks []*net.IPNet
+
+	// Whether trusted peers must send a PROXY protocol header.
+	Required bool
+
+	// The time a peer has to send the PROXY protocol header.
+	//
+	// Will default to 5 seconds.
+	HeaderTimeout time.Duration
+}
+
+// Trusts returns whether the provided address belongs to a trusted proxy.
+func (p *ProxyPolicy) Trusts(addr net.Addr) bool {
+	// get ip
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+
+		ip = net.ParseIP(host)
+	}
+
+	return p.trustsIP(ip)
+}
+
+func (p *ProxyPolicy) trustsIP(ip net.IP) bool {
+	// check ip
+	if ip == nil {
+		return false
+	}
+
+	// check networks
+	for _, network := range p.TrustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ForwardedAddr returns the address of the client reported by the Forwarded
+// or X-Forwarded-For header of a request sent by a trusted proxy. Addresses of
+// trusted proxies in the chain are skipped. It returns nil if the request has
+// not been sent by a trusted proxy or does not include a valid header.
+func (p *ProxyPolicy) ForwardedAddr(r *http.Request) net.Addr {
+	// check peer
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !p.trustsIP(net.ParseIP(host)) {
+		return nil
+	}
+
+	// get chain
+	chain := parseForwarded(r.Header.Values("Forwarded"))
+	if chain == nil {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, node := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(node))
+			}
+		}
+	}
+
+	// find first untrusted address from the right
+	var addr *net.TCPAddr
+	for i := len(chain) - 1; i >= 0; i-- {
+		// parse node
+		addr = parseNode(chain[i])
+		if addr == nil {
+			return nil
+		}
+
+		// stop at untrusted address
+		if !p.trustsIP(addr.IP) {
+			break
+		}
+	}
+
+	// check result
+	if addr == nil {
+		return nil
+	}
+
+	return addr
+}
+
+func (p *ProxyPolicy) headerTimeout() time.Duration {
+	if p.HeaderTimeout > 0 {
+		return p.HeaderTimeout
+	}
+
+	return 5 * time.Second
+}
+
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				// split pair
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+
+				// add node
+				chain = append(chain, strings.Trim(kv[1], `"`))
+			}
+		}
+	}
+
+	return chain
+}
+
+func parseNode(node string) *net.TCPAddr {
+	// split host and port
+	host, port := node, ""
+	if h, p, err := net.SplitHostPort(node); err == nil {
+		host, port = h, p
+	}
+
+	// parse ip
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return nil
+	}
+
+	// parse port
+	n, _ := strconv.Atoi(port)
+
+	return &net.TCPAddr{IP: ip, Port: n}
+}
+
+// A ProxyTLV is a type-length-value field of a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyTLSInfo describes the TLS connection between the client and the proxy
+// as reported by the SSL TLV of a PROXY protocol v2 header.
+type ProxyTLSInfo struct {
+	Client   byte
+	Verified bool
+
+	Version            string
+	CommonName         string
+	Cipher             string
+	SignatureAlgorithm string
+	KeyAlgorithm       string
+}
+
+// A ProxyHeader is a parsed PROXY protocol v1 or v2 header.
+type ProxyHeader struct {
+	// The protocol version, either 1 or 2.
+	Version int
+
+	// Whether the connection has been established by the proxy itself, e.g.
+	// for health checks. Source and Destination are nil in this case.
+	Local bool
+
+	// The addresses of the original connection.
+	Source      net.Addr
+	Destination net.Addr
+
+	// The TLVs of a v2 header.
+	TLVs []ProxyTLV
+}
+
+// TLV returns the value of the first TLV with the provided type.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// TLS returns the TLS information from the SSL TLV or nil if the header does
+// not include one.
+func (h *ProxyHeader) TLS() *ProxyTLSInfo {
+	// get value
+	value, ok := h.TLV(ProxyTLVSSL)
+	if !ok || len(value) < 5 {
+		return nil
+	}
+
+	// prepare info
+	info := &ProxyTLSInfo{
+		Client:   value[0],
+		Verified: binary.BigEndian.Uint32(value[1:5]) == 0,
+	}
+
+	// parse sub TLVs
+	subs, err := parseProxyTLVs(value[5:])
+	if err != nil {
+		return nil
+	}
+
+	// set fields
+	for _, sub := range subs {
+		switch sub.Type {
+		case ProxySubTLVSSLVersion:
+			info.Version = string(sub.Value)
+		case ProxySubTLVSSLCN:
+			info.CommonName = string(sub.Value)
+		case ProxySubTLVSSLCipher:
+			info.Cipher = string(sub.Value)
+		case ProxySubTLVSSLSigAlg:
+			info.SignatureAlgorithm = string(sub.Value)
+		case ProxySubTLVSSLKeyAlg:
+			info.KeyAlgorithm = string(sub.Value)
+		}
+	}
+
+	return info
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header from the reader. It
+// returns nil without consuming any data if the stream does not start with a
+// header.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	// peek first byte
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	// check signatures
+	switch first[0] {
+	case proxyV1Signature[0]:
+		sig, err := r.Peek(len(proxyV1Signature))
+		if err != nil || !bytes.Equal(sig, proxyV1Signature) {
+			return nil, nil
+		}
+
+		return readProxyHeaderV1(r)
+	case proxyV2Signature[0]:
+		sig, err := r.Peek(len(proxyV2Signature))
+		if err != nil || !bytes.Equal(sig, proxyV2Signature) {
+			return nil, nil
+		}
+
+		return readProxyHeaderV2(r)
+	}
+
+	return nil, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	// read line, the maximum length is 107 bytes
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		} else if len(line) >= 107 {
+			return nil, ErrInvalidProxyHeader
+		}
+	}
+
+	// check line ending
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// split fields
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// handle unknown protocol
+	if fields[1] == "UNKNOWN" {
+		return &ProxyHeader{Version: 1, Local: true}, nil
+	}
+
+	// check fields
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// parse addresses
+	src := net.ParseIP(fields[2])
+	dst := net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &ProxyHeader{
+		Version:     1,
+		Source:      &net.TCPAddr{IP: src, Port: int(srcPort)},
+		Destination: &net.TCPAddr{IP: dst, Port: int(dstPort)},
+	}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	// read fixed header
+	buf := make([]byte, 16)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// check version
+	if buf[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// get command, family and length
+	cmd := buf[12] & 0x0F
+	family := buf[13] >> 4
+	length := binary.BigEndian.Uint16(buf[14:16])
+
+	// read payload
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare header
+	header := &ProxyHeader{
+		Version: 2,
+	}
+
+	// get address length
+	var addrLen int
+	switch family {
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	}
+
+	// check payload
+	if len(payload) < addrLen {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// parse addresses
+	switch family {
+	case 0x1:
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 0x2:
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	case 0x3:
+		header.Source = &net.UnixAddr{Net: "unix", Name: string(bytes.TrimRight(payload[0:108], "\x00"))}
+		header.Destination = &net.UnixAddr{Net: "unix", Name: string(bytes.TrimRight(payload[108:216], "\x00"))}
+	}
+
+	// parse TLVs
+	header.TLVs, err = parseProxyTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+
+	// handle local command and unspecified family
+	if cmd == 0x0 || family == 0x0 {
+		header.Local = true
+		header.Source = nil
+		header.Destination = nil
+	} else if cmd != 0x1 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return header, nil
+}
+
+func parseProxyTLVs(data []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(data) > 0 {
+		// check length
+		if len(data) < 3 {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		// get length
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		// add tlv
+		tlvs = append(tlvs, ProxyTLV{
+			Type:  data[0],
+			Value: data[3 : 3+length],
+		})
+
+		data = data[3+length:]
+	}
+
+	return tlvs, nil
+}
+
+type proxyListener struct {
+	net.Listener
+
+	policy *ProxyPolicy
+}
+
+// NewProxyListener wraps the provided listener and returns connections that
+// read a PROXY protocol header from trusted peers before any other data. The
+// header is read on the first call to Read, RemoteAddr or LocalAddr.
+func NewProxyListener(listener net.Listener, policy *ProxyPolicy) net.Listener {
+	return &proxyListener{
+		Listener: listener,
+		policy:   policy,
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	// accept connection
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyConn{
+		Conn:   conn,
+		policy: l.policy,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+
+	policy   *ProxyPolicy
+	reader   *bufio.Reader
+	header   *ProxyHeader
+	err      error
+	once     sync.Once
+	deadline time.Time
+	mutex    sync.Mutex
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		// check peer
+		if !c.policy.Trusts(c.Conn.RemoteAddr()) {
+			return
+		}
+
+		// read header with timeout
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.policy.headerTimeout()))
+		c.header, c.err = ReadProxyHeader(c.reader)
+
+		// restore deadline
+		c.mutex.Lock()
+		_ = c.Conn.SetReadDeadline(c.deadline)
+		c.mutex.Unlock()
+
+		// check header
+		if c.err == nil && c.header == nil && c.policy.Required {
+			c.err = ErrMissingProxyHeader
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	// read header
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	// read header
+	c.init()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	// read header
+	c.init()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+// proxyHeader returns the PROXY protocol header of the connection if it has
+// been accepted by a proxy listener.
+func proxyHeader(conn net.Conn) *ProxyHeader {
+	for {
+		switch c := conn.(type) {
+		case *sniffConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *proxyConn:
+			// read header
+			c.init()
+
+			return c.header
+		default:
+			return nil
+		}
+	}
+}
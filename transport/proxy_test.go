@@ -0,0 +1,336 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyHeaderV2(cmd byte, src, dst *net.TCPAddr, tlvs ...ProxyTLV) []byte {
+	// prepare payload
+	var payload []byte
+	payload = append(payload, src.IP.To4()...)
+	payload = append(payload, dst.IP.To4()...)
+	payload = append(payload, byte(src.Port>>8), byte(src.Port))
+	payload = append(payload, byte(dst.Port>>8), byte(dst.Port))
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+
+	// prepare header
+	buf := append([]byte{}, proxyV2Signature...)
+	buf = append(buf, 0x20|cmd, 0x11, 0, 0)
+	binary.BigEndian.PutUint16(buf[14:16], uint16(len(payload)))
+
+	return append(buf, payload...)
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return network
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\nrest"))
+	header, err := ReadProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &ProxyHeader{
+		Version:     1,
+		Source:      &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1111},
+		Destination: &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 2222},
+	}, header)
+
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "rest", string(rest))
+
+	r = bufio.NewReader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 1111 2222\r\n"))
+	header, err = ReadProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1111", header.Source.String())
+
+	r = bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	header, err = ReadProxyHeader(r)
+	assert.NoError(t, err)
+	assert.True(t, header.Local)
+	assert.Nil(t, header.Source)
+
+	r = bufio.NewReader(strings.NewReader("PROXY TCP4 foo bar 1 2\r\n"))
+	header, err = ReadProxyHeader(r)
+	assert.Nil(t, header)
+	assert.Equal(t, ErrInvalidProxyHeader, err)
+
+	r = bufio.NewReader(strings.NewReader("PROXY " + strings.Repeat("x", 200)))
+	header, err = ReadProxyHeader(r)
+	assert.Nil(t, header)
+	assert.Equal(t, ErrInvalidProxyHeader, err)
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("1.2.3.4").To4(), Port: 1111}
+	dst := &net.TCPAddr{IP: net.ParseIP("5.6.7.8").To4(), Port: 2222}
+
+	ssl := []byte{0x07, 0, 0, 0, 0}
+	ssl = append(ssl, ProxySubTLVSSLVersion, 0, 7)
+	ssl = append(ssl, "TLSv1.3"...)
+	ssl = append(ssl, ProxySubTLVSSLCN, 0, 6)
+	ssl = append(ssl, "device"...)
+
+	data := proxyHeaderV2(0x1, src, dst, ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("example.com")}, ProxyTLV{Type: ProxyTLVSSL, Value: ssl})
+	r := bufio.NewReader(bytes.NewReader(append(data, "rest"...)))
+
+	header, err := ReadProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, header.Version)
+	assert.False(t, header.Local)
+	assert.Equal(t, src, header.Source)
+	assert.Equal(t, dst, header.Destination)
+
+	authority, ok := header.TLV(ProxyTLVAuthority)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", string(authority))
+
+	assert.Equal(t, &ProxyTLSInfo{
+		Client:     0x07,
+		Verified:   true,
+		Version:    "TLSv1.3",
+		CommonName: "device",
+	}, header.TLS())
+
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "rest", string(rest))
+
+	r = bufio.NewReader(bytes.NewReader(proxyHeaderV2(0x0, src, dst)))
+	header, err = ReadProxyHeader(r)
+	assert.NoError(t, err)
+	assert.True(t, header.Local)
+	assert.Nil(t, header.Source)
+	assert.Nil(t, header.TLS())
+}
+
+func TestReadProxyHeaderMissing(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("\x10\x00"))
+	header, err := ReadProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Nil(t, header)
+
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "\x10\x00", string(rest))
+}
+
+func abstractProxyServerTest(t *testing.T, protocol string, policy *ProxyPolicy, header []byte, handler func(Conn)) {
+	launcher := NewLauncher()
+	launcher.TLSConfig = serverTLSConfig
+	launcher.ProxyPolicy = policy
+
+	server, err := launcher.Launch(protocol + "://localhost:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+
+	go func() {
+		conn, err := server.Accept()
+		require.NoError(t, err)
+
+		handler(conn)
+
+		close(done)
+	}()
+
+	// dial connection and write header
+	netConn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+
+	_, err = netConn.Write(header)
+	require.NoError(t, err)
+
+	// wrap TLS if secure
+	if protocol == "tls" {
+		netConn = tls.Client(netConn, &tls.Config{InsecureSkipVerify: true})
+	}
+
+	conn := NewNetConn(netConn, 0)
+
+	err = conn.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func loopbackPolicy() *ProxyPolicy {
+	return &ProxyPolicy{
+		TrustedNetworks: []*net.IPNet{mustParseCIDR("127.0.0.0/8")},
+	}
+}
+
+func TestProxyProtocolTCP(t *testing.T) {
+	header := []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n")
+
+	abstractProxyServerTest(t, "tcp", loopbackPolicy(), header, func(conn Conn) {
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.CONNECT, pkt.Type())
+
+		assert.Equal(t, "1.2.3.4:1111", conn.RemoteAddr().String())
+		assert.Equal(t, "5.6.7.8:2222", conn.LocalAddr().String())
+		assert.Equal(t, 1, conn.(*NetConn).ProxyHeader().Version)
+	})
+}
+
+func TestProxyProtocolTLS(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("1.2.3.4").To4(), Port: 1111}
+	dst := &net.TCPAddr{IP: net.ParseIP("5.6.7.8").To4(), Port: 2222}
+
+	abstractProxyServerTest(t, "tls", loopbackPolicy(), proxyHeaderV2(0x1, src, dst), func(conn Conn) {
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.CONNECT, pkt.Type())
+
+		assert.Equal(t, "1.2.3.4:1111", conn.RemoteAddr().String())
+		assert.Equal(t, 2, conn.(*NetConn).ProxyHeader().Version)
+	})
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	policy := &ProxyPolicy{
+		TrustedNetworks: []*net.IPNet{mustParseCIDR("10.0.0.0/8")},
+	}
+
+	header := []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n")
+
+	abstractProxyServerTest(t, "tcp", policy, header, func(conn Conn) {
+		assert.True(t, strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:"))
+		assert.Nil(t, conn.(*NetConn).ProxyHeader())
+	})
+}
+
+func TestProxyProtocolNoTrustedNetworks(t *testing.T) {
+	header := []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n")
+
+	abstractProxyServerTest(t, "tcp", &ProxyPolicy{}, header, func(conn Conn) {
+		assert.True(t, strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:"))
+		assert.Nil(t, conn.(*NetConn).ProxyHeader())
+	})
+}
+
+func TestProxyProtocolRequired(t *testing.T) {
+	policy := loopbackPolicy()
+	policy.Required = true
+
+	abstractProxyServerTest(t, "tcp", policy, nil, func(conn Conn) {
+		pkt, err := conn.Receive()
+		assert.Nil(t, pkt)
+		assert.Equal(t, ErrMissingProxyHeader, err)
+	})
+}
+
+func TestProxyPolicyForwardedAddr(t *testing.T) {
+	policy := &ProxyPolicy{
+		TrustedNetworks: []*net.IPNet{
+			mustParseCIDR("127.0.0.0/8"),
+			mustParseCIDR("10.0.0.0/8"),
+		},
+	}
+
+	request := func(remoteAddr string, header ...string) *http.Request {
+		r := &http.Request{
+			RemoteAddr: remoteAddr,
+			Header:     http.Header{},
+		}
+
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Add(header[i], header[i+1])
+		}
+
+		return r
+	}
+
+	addr := policy.ForwardedAddr(request("127.0.0.1:1234", "X-Forwarded-For", "1.2.3.4, 10.0.0.1"))
+	assert.Equal(t, "1.2.3.4:0", addr.String())
+
+	addr = policy.ForwardedAddr(request("127.0.0.1:1234", "X-Forwarded-For", "6.6.6.6, 1.2.3.4"))
+	assert.Equal(t, "1.2.3.4:0", addr.String())
+
+	addr = policy.ForwardedAddr(request("127.0.0.1:1234", "Forwarded", `for="[2001:db8::1]:4711";proto=https, for=10.0.0.1`))
+	assert.Equal(t, "[2001:db8::1]:4711", addr.String())
+
+	addr = policy.ForwardedAddr(request("1.1.1.1:1234", "X-Forwarded-For", "1.2.3.4"))
+	assert.Nil(t, addr)
+
+	addr = policy.ForwardedAddr(request("127.0.0.1:1234", "X-Forwarded-For", "unknown"))
+	assert.Nil(t, addr)
+
+	addr = policy.ForwardedAddr(request("127.0.0.1:1234"))
+	assert.Nil(t, addr)
+}
+
+func TestProxyWebSocketForwarded(t *testing.T) {
+	abstractProxyWebSocketTest(t, loopbackPolicy(), "1.2.3.4:0")
+}
+
+func TestProxyWebSocketForwardedUntrusted(t *testing.T) {
+	abstractProxyWebSocketTest(t, &ProxyPolicy{}, "127.0.0.1:")
+}
+
+func abstractProxyWebSocketTest(t *testing.T, policy *ProxyPolicy, remoteAddr string) {
+	launcher := NewLauncher()
+	launcher.ProxyPolicy = policy
+
+	server, err := launcher.Launch("ws://localhost:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+
+	go func() {
+		conn, err := server.Accept()
+		require.NoError(t, err)
+
+		assert.True(t, strings.HasPrefix(conn.RemoteAddr().String(), remoteAddr))
+		assert.Nil(t, conn.(*WebSocketConn).ProxyHeader())
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		close(done)
+	}()
+
+	dialer := NewDialer()
+	dialer.RequestHeader = http.Header{
+		"X-Forwarded-For": []string{"1.2.3.4"},
+	}
+
+	conn, err := dialer.Dial(getURL(server, "ws"))
+	require.NoError(t, err)
+
+	safeReceive(done)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
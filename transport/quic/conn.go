@@ -0,0 +1,349 @@
+// Package quic implements a QUIC transport for the transport package. It is a
+// separate module to not raise the Go version required by the other packages.
+package quic
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/transport"
+	"github.com/quic-go/quic-go"
+)
+
+// ErrMigrationUnavailable is returned by Migrate if the connection cannot be
+// migrated because the server rejected its 0-RTT handshake. The connection
+// identifiers sent during the handshake are lost in that case.
+var ErrMigrationUnavailable = errors.New("migration unavailable after rejected 0-RTT handshake")
+
+// quicLinger is the maximum time a closed QUIC connection waits for the peer
+// to receive the remaining data and close the connection.
+const quicLinger = 5 * time.Second
+
+// quicStream adapts a bidirectional QUIC stream to the Carrier interface. On
+// the client side, data written during a 0-RTT handshake is retained and
+// written again to a new stream if the server rejects 0-RTT.
+type quicStream struct {
+	conn      *quic.Conn
+	stream    *quic.Stream
+	early     []byte
+	buffering bool
+	deadline  time.Time
+	eof       bool
+	closed    bool
+	mutex     sync.Mutex
+}
+
+func (s *quicStream) Read(p []byte) (int, error) {
+	for {
+		// get stream
+		s.mutex.Lock()
+		stream := s.stream
+		s.mutex.Unlock()
+
+		// read data
+		n, err := stream.Read(p)
+		if err == quic.Err0RTTRejected {
+			err = s.recover(stream)
+			if err == nil {
+				continue
+			}
+		}
+
+		// translate error
+		err = quicError(err)
+		if err == io.EOF {
+			s.mutex.Lock()
+			s.eof = true
+			s.mutex.Unlock()
+		}
+
+		return n, err
+	}
+}
+
+func (s *quicStream) Write(p []byte) (int, error) {
+	// get stream
+	s.mutex.Lock()
+	stream := s.stream
+
+	// retain data written before the handshake completed
+	if s.buffering {
+		select {
+		case <-s.conn.HandshakeComplete():
+			s.buffering = false
+			s.early = nil
+		default:
+			s.early = append(s.early, p...)
+		}
+	}
+
+	// release mutex
+	s.mutex.Unlock()
+
+	// write data
+	n, err := stream.Write(p)
+	if err == quic.Err0RTTRejected {
+		// the data is written again as part of the retained data
+		err = s.recover(stream)
+		if err == nil {
+			return len(p), nil
+		}
+	}
+
+	return n, quicError(err)
+}
+
+func (s *quicStream) recover(old *quic.Stream) error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check if already recovered
+	if s.stream != old {
+		return nil
+	}
+
+	// wait for handshake
+	conn, err := s.conn.NextConnection(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// open new stream
+	stream, err := conn.OpenStream()
+	if err != nil {
+		return err
+	}
+
+	// apply deadline
+	_ = stream.SetReadDeadline(s.deadline)
+
+	// write retained data
+	_, err = stream.Write(s.early)
+	if err != nil {
+		return err
+	}
+
+	// replace stream
+	s.stream = stream
+	s.buffering = false
+	s.early = nil
+
+	return nil
+}
+
+func (s *quicStream) Close() error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check flag
+	if s.closed {
+		return nil
+	}
+
+	// set flag
+	s.closed = true
+
+	// close connection immediately if the peer already finished
+	if s.eof {
+		return s.conn.CloseWithError(0, "")
+	}
+
+	// close send direction and stop reading
+	err := s.stream.Close()
+	s.stream.CancelRead(0)
+
+	// close connection once the peer closed it as well
+	go func() {
+		select {
+		case <-s.conn.Context().Done():
+		case <-time.After(quicLinger):
+		}
+
+		_ = s.conn.CloseWithError(0, "")
+	}()
+
+	return err
+}
+
+func (s *quicStream) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.deadline = t
+
+	return s.stream.SetReadDeadline(t)
+}
+
+// quicError translates the errors returned by streams of closed connections
+// to io.EOF.
+func quicError(err error) error {
+	// check application errors
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.ErrorCode == 0 {
+		return io.EOF
+	}
+
+	// check stream errors
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) && streamErr.ErrorCode == 0 && streamErr.Remote {
+		return io.EOF
+	}
+
+	return err
+}
+
+// The Conn carries MQTT packets over a single bidirectional QUIC stream.
+// Connections dialed by a Dialer use 0-RTT resumption if allowed by the server
+// and can be migrated to another network path.
+type Conn struct {
+	*transport.BaseConn
+
+	conn       *quic.Conn
+	stream     *quicStream
+	early      bool
+	transports []*quic.Transport
+	mutex      sync.Mutex
+}
+
+// NewConn returns a new Conn.
+func NewConn(conn *quic.Conn, stream *quic.Stream, maxWriteDelay time.Duration) *Conn {
+	// prepare stream
+	qs := &quicStream{
+		conn:   conn,
+		stream: stream,
+	}
+
+	// create connection
+	c := &Conn{
+		BaseConn: transport.NewBaseConn(qs, maxWriteDelay),
+		conn:     conn,
+		stream:   qs,
+	}
+
+	// close owned transports once the connection is closed
+	go func() {
+		<-conn.Context().Done()
+
+		c.mutex.Lock()
+		for _, transport := range c.transports {
+			_ = transport.Close()
+		}
+		c.mutex.Unlock()
+	}()
+
+	return c
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// PeerCertificates returns the verified certificate chain of the peer. As
+// the peer is only verified once the handshake completed, it will block until
+// the handshake completed or failed.
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	// wait for handshake
+	select {
+	case <-c.conn.HandshakeComplete():
+	case <-c.conn.Context().Done():
+		return nil
+	}
+
+	// get connection state
+	state := c.conn.ConnectionState().TLS
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0]
+}
+
+// Used0RTT returns whether the connection has been resumed using 0-RTT. It
+// will block until the handshake completed or failed.
+func (c *Conn) Used0RTT() bool {
+	// wait for handshake
+	select {
+	case <-c.conn.HandshakeComplete():
+	case <-c.conn.Context().Done():
+		return false
+	}
+
+	return c.conn.ConnectionState().Used0RTT
+}
+
+// Migrate will move a dialed connection to a new network path using the
+// provided packet connection, e.g. after switching from Wi-Fi to cellular.
+// The path is validated before it is used and the connection including its
+// MQTT session continues unchanged. The packet connection is closed with the
+// connection or if the migration failed.
+func (c *Conn) Migrate(ctx context.Context, packetConn net.PacketConn) error {
+	// check 0-RTT handshake
+	if c.early && !c.Used0RTT() {
+		_ = packetConn.Close()
+		return ErrMigrationUnavailable
+	}
+
+	// prepare transport
+	transport := &quic.Transport{Conn: packetConn}
+
+	// add path
+	path, err := c.conn.AddPath(transport)
+	if err != nil {
+		_ = transport.Close()
+		return err
+	}
+
+	// validate path
+	err = path.Probe(ctx)
+	if err != nil {
+		_ = path.Close()
+		_ = transport.Close()
+		return err
+	}
+
+	// switch path
+	err = path.Switch()
+	if err != nil {
+		_ = path.Close()
+		_ = transport.Close()
+		return err
+	}
+
+	// keep transport
+	c.addTransport(transport)
+
+	return nil
+}
+
+// UnderlyingConn returns the underlying quic.Conn.
+func (c *Conn) UnderlyingConn() *quic.Conn {
+	return c.conn
+}
+
+func (c *Conn) addTransport(transport *quic.Transport) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// close transport directly if the connection is already closed
+	select {
+	case <-c.conn.Context().Done():
+		_ = transport.Close()
+		return
+	default:
+	}
+
+	c.transports = append(c.transports, transport)
+}
@@ -0,0 +1,363 @@
+package quic
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/qingcloudhx/gomqtt/transport"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection(t *testing.T) {
+	server, err := testLauncher.Launch("quic://localhost:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		conn, err := server.Accept()
+		require.NoError(t, err)
+
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.CONNECT, pkt.Type())
+
+		err = conn.Send(packet.NewConnack(), false)
+		assert.NoError(t, err)
+
+		pkt, err = conn.Receive()
+		assert.Nil(t, pkt)
+		assert.Equal(t, io.EOF, err)
+
+		close(done)
+	}()
+
+	conn, err := testDialer.Dial(getURL(server))
+	require.NoError(t, err)
+
+	err = conn.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	pkt, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.CONNACK, pkt.Type())
+
+	assert.Nil(t, conn.PeerCertificates())
+	assert.Equal(t, "udp", conn.LocalAddr().Network())
+	assert.Equal(t, server.Addr().String(), conn.RemoteAddr().String())
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestServerClose(t *testing.T) {
+	server, err := testLauncher.Launch("quic://localhost:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		conn, err := server.Accept()
+		require.NoError(t, err)
+
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.CONNECT, pkt.Type())
+
+		err = conn.Send(packet.NewConnack(), false)
+		assert.NoError(t, err)
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		close(done)
+	}()
+
+	conn, err := testDialer.Dial(getURL(server))
+	require.NoError(t, err)
+
+	err = conn.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	pkt, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.CONNACK, pkt.Type())
+
+	pkt, err = conn.Receive()
+	assert.Nil(t, pkt)
+	assert.Equal(t, io.EOF, err)
+
+	safeReceive(done)
+
+	err = server.Close()
+	assert.NoError(t, err)
+
+	conn, err = server.Accept()
+	assert.Nil(t, conn)
+	assert.Equal(t, transport.ErrAcceptAfterClose, err)
+}
+
+func TestLaunchMissingCertificate(t *testing.T) {
+	server, err := NewLauncher(nil).Launch("quic://localhost:0")
+	assert.Nil(t, server)
+	assert.Equal(t, errMissingCertificate, err)
+}
+
+func TestZeroRTT(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		launcher := NewLauncher(nil)
+		launcher.TLSConfig = serverTLSConfig
+		if allow {
+			launcher.Config = &quic.Config{Allow0RTT: true}
+		}
+
+		server, err := launcher.Launch("quic://localhost:0")
+		require.NoError(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 2; i++ {
+				conn, err := server.Accept()
+				require.NoError(t, err)
+
+				pkt, err := conn.Receive()
+				assert.NoError(t, err)
+				assert.Equal(t, packet.CONNECT, pkt.Type())
+
+				err = conn.Send(packet.NewConnack(), false)
+				assert.NoError(t, err)
+
+				pkt, err = conn.Receive()
+				assert.Nil(t, pkt)
+				assert.Equal(t, io.EOF, err)
+			}
+
+			close(done)
+		}()
+
+		dialer := newTestDialer()
+
+		for _, resumed := range []bool{false, allow} {
+			conn, err := dialer.Dial(getURL(server))
+			require.NoError(t, err)
+
+			err = conn.Send(packet.NewConnect(), false)
+			assert.NoError(t, err)
+
+			pkt, err := conn.Receive()
+			assert.NoError(t, err)
+			assert.Equal(t, packet.CONNACK, pkt.Type())
+
+			assert.Equal(t, resumed, conn.(*Conn).Used0RTT())
+
+			err = conn.Close()
+			assert.NoError(t, err)
+		}
+
+		safeReceive(done)
+
+		err = server.Close()
+		assert.NoError(t, err)
+	}
+}
+
+func TestZeroRTTRejected(t *testing.T) {
+	server1, err := CreateServer("localhost:0", serverTLSConfig, &quic.Config{Allow0RTT: true})
+	require.NoError(t, err)
+
+	// a server that does not allow 0-RTT for the same host
+	server2, err := CreateServer("localhost:0", serverTLSConfig, nil)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		for _, server := range []transport.Server{server1, server2} {
+			conn, err := server.Accept()
+			require.NoError(t, err)
+
+			pkt, err := conn.Receive()
+			assert.NoError(t, err)
+			assert.Equal(t, packet.CONNECT, pkt.Type())
+
+			err = conn.Send(packet.NewConnack(), false)
+			assert.NoError(t, err)
+
+			pkt, err = conn.Receive()
+			assert.Nil(t, pkt)
+			assert.Equal(t, io.EOF, err)
+		}
+
+		close(done)
+	}()
+
+	dialer := newTestDialer()
+
+	for _, server := range []transport.Server{server1, server2} {
+		conn, err := dialer.Dial(getURL(server))
+		require.NoError(t, err)
+
+		err = conn.Send(packet.NewConnect(), false)
+		assert.NoError(t, err)
+
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.CONNACK, pkt.Type())
+		assert.False(t, conn.(*Conn).Used0RTT())
+
+		err = conn.Close()
+		assert.NoError(t, err)
+	}
+
+	safeReceive(done)
+
+	err = server1.Close()
+	assert.NoError(t, err)
+
+	err = server2.Close()
+	assert.NoError(t, err)
+}
+
+func TestMigration(t *testing.T) {
+	server, err := testLauncher.Launch("quic://localhost:0")
+	require.NoError(t, err)
+
+	addrs := make(chan string, 2)
+	done := make(chan struct{})
+	go func() {
+		conn, err := server.Accept()
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			pkt, err := conn.Receive()
+			assert.NoError(t, err)
+			assert.Equal(t, packet.PINGREQ, pkt.Type())
+
+			addrs <- conn.RemoteAddr().String()
+
+			err = conn.Send(packet.NewPingresp(), false)
+			assert.NoError(t, err)
+		}
+
+		pkt, err := conn.Receive()
+		assert.Nil(t, pkt)
+		assert.Equal(t, io.EOF, err)
+
+		close(done)
+	}()
+
+	conn, err := newTestDialer().Dial(getURL(server))
+	require.NoError(t, err)
+
+	err = conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	pkt, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.PINGRESP, pkt.Type())
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = conn.(*Conn).Migrate(ctx, socket)
+	require.NoError(t, err)
+
+	err = conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	pkt, err = conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.PINGRESP, pkt.Type())
+
+	first := <-addrs
+	second := <-addrs
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, socket.LocalAddr().String(), second)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestMigrationRejectedZeroRTT(t *testing.T) {
+	server1, err := CreateServer("localhost:0", serverTLSConfig, &quic.Config{Allow0RTT: true})
+	require.NoError(t, err)
+
+	server2, err := CreateServer("localhost:0", serverTLSConfig, nil)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		for _, server := range []transport.Server{server1, server2} {
+			conn, err := server.Accept()
+			require.NoError(t, err)
+
+			pkt, err := conn.Receive()
+			assert.NoError(t, err)
+			assert.Equal(t, packet.PINGREQ, pkt.Type())
+
+			err = conn.Send(packet.NewPingresp(), false)
+			assert.NoError(t, err)
+
+			pkt, err = conn.Receive()
+			assert.Nil(t, pkt)
+			assert.Equal(t, io.EOF, err)
+		}
+
+		close(done)
+	}()
+
+	dialer := newTestDialer()
+
+	for i, server := range []transport.Server{server1, server2} {
+		conn, err := dialer.Dial(getURL(server))
+		require.NoError(t, err)
+
+		err = conn.Send(packet.NewPingreq(), false)
+		assert.NoError(t, err)
+
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.PINGRESP, pkt.Type())
+
+		socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		err = conn.(*Conn).Migrate(ctx, socket)
+		if i == 0 {
+			assert.NoError(t, err)
+		} else {
+			assert.Equal(t, ErrMigrationUnavailable, err)
+		}
+
+		cancel()
+
+		err = conn.Close()
+		assert.NoError(t, err)
+	}
+
+	safeReceive(done)
+
+	err = server1.Close()
+	assert.NoError(t, err)
+
+	err = server2.Close()
+	assert.NoError(t, err)
+}
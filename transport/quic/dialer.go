@@ -0,0 +1,187 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/qingcloudhx/gomqtt/transport"
+	"github.com/quic-go/quic-go"
+)
+
+// The Dialer adds the "quic" scheme to a transport.Dialer. QUIC connections
+// use the TLS config, timeouts, resolver, local address and write delay of
+// the wrapped dialer. Proxies are not supported.
+type Dialer struct {
+	*transport.Dialer
+
+	// The default port used for QUIC connections.
+	//
+	// Will default to "14567".
+	DefaultPort string
+
+	// The optional config used for QUIC connections. If the TLS config has no
+	// session cache set, a session cache shared by all connections of the
+	// dialer is used to resume connections.
+	Config *quic.Config
+
+	sessions tls.ClientSessionCache
+	mutex    sync.Mutex
+}
+
+// NewDialer wraps the provided dialer and registers the "quic" scheme. A new
+// dialer is created if none is provided.
+func NewDialer(dialer *transport.Dialer) *Dialer {
+	// ensure dialer
+	if dialer == nil {
+		dialer = transport.NewDialer()
+	}
+
+	// create dialer
+	d := &Dialer{
+		Dialer:      dialer,
+		DefaultPort: "14567",
+	}
+
+	// register scheme
+	if dialer.Schemes == nil {
+		dialer.Schemes = map[string]func(context.Context, *url.URL) (transport.Conn, error){}
+	}
+	dialer.Schemes["quic"] = d.dial
+
+	return d
+}
+
+func (d *Dialer) dial(ctx context.Context, urlParts *url.URL) (transport.Conn, error) {
+	// get host and port
+	host, port, err := net.SplitHostPort(urlParts.Host)
+	if err != nil {
+		host = urlParts.Host
+		port = ""
+	}
+	if port == "" {
+		port = d.DefaultPort
+	}
+
+	// dial connection
+	conn, err := d.DialQUIC(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// DialQUIC will dial a QUIC connection to the provided host and port.
+func (d *Dialer) DialQUIC(ctx context.Context, host, port string) (*Conn, error) {
+	// apply connect timeout
+	if d.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.ConnectTimeout)
+		defer cancel()
+	}
+
+	// resolve host
+	addr, err := d.resolve(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	// get local address
+	var localAddr *net.UDPAddr
+	if udpAddr, ok := d.LocalAddr.(*net.UDPAddr); ok {
+		localAddr = udpAddr
+	}
+
+	// create socket
+	socket, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare TLS config
+	tlsConfig := quicTLSConfig(d.TLSConfig, true)
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = d.sessionCache()
+	}
+
+	// prepare QUIC config
+	var quicConfig *quic.Config
+	if d.Config != nil {
+		quicConfig = d.Config.Clone()
+	} else {
+		quicConfig = &quic.Config{}
+	}
+	if d.HandshakeTimeout > 0 {
+		quicConfig.HandshakeIdleTimeout = d.HandshakeTimeout
+	}
+
+	// dial connection
+	tr := &quic.Transport{Conn: socket}
+	conn, err := tr.DialEarly(ctx, addr, tlsConfig, quicConfig)
+	if err != nil {
+		_ = tr.Close()
+		return nil, err
+	}
+
+	// open stream
+	stream, err := conn.OpenStream()
+	if err != nil {
+		_ = conn.CloseWithError(0, "")
+		_ = tr.Close()
+		return nil, err
+	}
+
+	// create connection
+	quicConn := NewConn(conn, stream, d.MaxWriteDelay)
+	quicConn.addTransport(tr)
+
+	// retain data sent during a 0-RTT handshake
+	select {
+	case <-conn.HandshakeComplete():
+	default:
+		quicConn.stream.buffering = true
+		quicConn.early = true
+	}
+
+	return quicConn, nil
+}
+
+func (d *Dialer) resolve(ctx context.Context, host, port string) (*net.UDPAddr, error) {
+	// lookup host if not an ip
+	if net.ParseIP(host) == nil {
+		// get resolver
+		resolver := d.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+
+		// lookup addresses
+		ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		// use first address
+		host = ipAddrs[0].String()
+	}
+
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+}
+
+func (d *Dialer) sessionCache() tls.ClientSessionCache {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// create cache once
+	if d.sessions == nil {
+		d.sessions = tls.NewLRUClientSessionCache(0)
+	}
+
+	return d.sessions
+}
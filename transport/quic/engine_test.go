@@ -0,0 +1,60 @@
+package quic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/broker"
+	"github.com/qingcloudhx/gomqtt/client"
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine(t *testing.T) {
+	server, err := testLauncher.Launch("quic://localhost:0")
+	require.NoError(t, err)
+
+	engine := broker.NewEngine(broker.NewMemoryBackend())
+	engine.Accept(server)
+
+	config := client.NewConfig(getURL(server))
+	config.Dialer = testDialer
+
+	received := make(chan *packet.Message, 1)
+
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		if err == nil {
+			received <- msg
+		}
+		return nil
+	}
+
+	cf, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("test", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := c.Publish("test", []byte("test"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "test", msg.Topic)
+		assert.Equal(t, []byte("test"), msg.Payload)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "message not received")
+	}
+
+	assert.NoError(t, c.Disconnect())
+
+	err = server.Close()
+	assert.NoError(t, err)
+
+	engine.Close()
+}
@@ -0,0 +1,22 @@
+module github.com/qingcloudhx/gomqtt/transport/quic
+
+go 1.26.0
+
+require (
+	github.com/qingcloudhx/gomqtt v0.0.0
+	github.com/quic-go/quic-go v0.63.0
+	github.com/stretchr/testify v1.12.1
+	gopkg.in/tomb.v2 v2.0.0-20161208151619-d5d1b5820637
+)
+
+require (
+	github.com/256dpi/mercury v0.1.0 // indirect
+	github.com/gorilla/websocket v1.3.0 // indirect
+	github.com/jpillora/backoff v0.0.0-20170918002102-8eab2debe79d // indirect
+	go.yaml.in/yaml/v3 v3.0.5 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+)
+
+replace github.com/qingcloudhx/gomqtt => ../..
@@ -0,0 +1,53 @@
+package quic
+
+import (
+	"net/url"
+
+	"github.com/qingcloudhx/gomqtt/transport"
+	"github.com/quic-go/quic-go"
+)
+
+// The Launcher adds the "quic" scheme to a transport.Launcher. QUIC servers
+// use the TLS config of the wrapped launcher.
+type Launcher struct {
+	*transport.Launcher
+
+	// The optional config used for QUIC servers. 0-RTT resumption must be
+	// enabled explicitly using the Allow0RTT option, see CreateServer for the
+	// replay risks.
+	//
+	// Will default to a config that does not allow 0-RTT resumption.
+	Config *quic.Config
+}
+
+// NewLauncher wraps the provided launcher and registers the "quic" scheme. A
+// new launcher is created if none is provided.
+func NewLauncher(launcher *transport.Launcher) *Launcher {
+	// ensure launcher
+	if launcher == nil {
+		launcher = transport.NewLauncher()
+	}
+
+	// create launcher
+	l := &Launcher{
+		Launcher: launcher,
+	}
+
+	// register scheme
+	if launcher.Schemes == nil {
+		launcher.Schemes = map[string]func(*url.URL) (transport.Server, error){}
+	}
+	launcher.Schemes["quic"] = l.launch
+
+	return l
+}
+
+func (l *Launcher) launch(urlParts *url.URL) (transport.Server, error) {
+	// create server
+	server, err := CreateServer(urlParts.Host, l.TLSConfig, l.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	return server, nil
+}
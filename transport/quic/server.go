@@ -0,0 +1,179 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/transport"
+	"github.com/quic-go/quic-go"
+	"gopkg.in/tomb.v2"
+)
+
+var errManualClose = errors.New("internal: manual close")
+
+var errMissingCertificate = errors.New("tls: neither Certificates, GetCertificate, nor GetConfigForClient set in Config")
+
+// quicProtocol is the ALPN protocol negotiated for QUIC connections.
+const quicProtocol = "mqtt"
+
+// quicTLSConfig returns a copy of the config that negotiates the MQTT ALPN
+// protocol. If only is set, other protocols are removed.
+func quicTLSConfig(config *tls.Config, only bool) *tls.Config {
+	// clone config
+	if config != nil {
+		config = config.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	// check protocols
+	for _, proto := range config.NextProtos {
+		if proto == quicProtocol && !only {
+			return config
+		}
+	}
+
+	// set protocol
+	if only {
+		config.NextProtos = []string{quicProtocol}
+	} else {
+		config.NextProtos = append([]string{quicProtocol}, config.NextProtos...)
+	}
+
+	return config
+}
+
+// The Server accepts QUIC connections that carry MQTT over the first
+// bidirectional stream opened by the client. 0-RTT data is accepted if enabled
+// by the config. Clients may migrate their connections to other addresses.
+type Server struct {
+	MaxWriteDelay time.Duration
+
+	// The time a connection has to open the stream after the handshake has
+	// been started.
+	//
+	// Will default to 10 seconds.
+	StreamTimeout time.Duration
+
+	listener *quic.EarlyListener
+	incoming chan transport.Conn
+
+	tomb tomb.Tomb
+}
+
+// NewServer wraps the provided listener.
+func NewServer(listener *quic.EarlyListener) *Server {
+	// create server
+	s := &Server{
+		listener: listener,
+		incoming: make(chan transport.Conn),
+	}
+
+	// accept connections in background
+	s.tomb.Go(s.acceptor)
+
+	return s
+}
+
+// CreateServer creates a new QUIC server that listens on the provided
+// address. 0-RTT resumption is only accepted if enabled using the Allow0RTT
+// option of the QUIC config. Be aware that 0-RTT data is not protected against
+// replay attacks: an attacker may replay the CONNECT and PUBLISH packets sent
+// during the handshake of a resumed connection.
+func CreateServer(address string, tlsConfig *tls.Config, quicConfig *quic.Config) (*Server, error) {
+	// check TLS config
+	if tlsConfig == nil || (len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil) {
+		return nil, errMissingCertificate
+	}
+
+	// create listener
+	listener, err := quic.ListenAddrEarly(address, quicTLSConfig(tlsConfig, false), quicConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServer(listener), nil
+}
+
+// Accept will return the next available connection or block until a
+// connection becomes available, otherwise returns an Error.
+func (s *Server) Accept() (transport.Conn, error) {
+	select {
+	case <-s.tomb.Dying():
+		if s.tomb.Err() == errManualClose {
+			// server has been closed manually
+			return nil, transport.ErrAcceptAfterClose
+		}
+
+		// return the previously caught error
+		return nil, s.tomb.Err()
+	case conn := <-s.incoming:
+		return conn, nil
+	}
+}
+
+// Close will close the underlying listener and cleanup resources. It will
+// return an Error if the underlying listener didn't close cleanly.
+func (s *Server) Close() error {
+	s.tomb.Kill(errManualClose)
+
+	err := s.listener.Close()
+	_ = s.tomb.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Addr returns the server's network address.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Server) acceptor() error {
+	for {
+		// accept next connection
+		conn, err := s.listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+
+		// accept stream in background
+		go s.dispatch(conn)
+	}
+}
+
+func (s *Server) dispatch(conn *quic.Conn) {
+	// ensure stream timeout default
+	timeout := s.StreamTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	// accept stream
+	ctx, cancel := context.WithTimeout(s.tomb.Context(nil), timeout)
+	stream, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		_ = conn.CloseWithError(0, "")
+		return
+	}
+
+	// ensure write delay default
+	maxWriteDelay := s.MaxWriteDelay
+	if maxWriteDelay == 0 {
+		maxWriteDelay = 10 * time.Millisecond
+	}
+
+	// queue connection
+	select {
+	case s.incoming <- NewConn(conn, stream, maxWriteDelay):
+	case <-s.tomb.Dying():
+		_ = conn.CloseWithError(0, "")
+	}
+}
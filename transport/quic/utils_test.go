@@ -0,0 +1,56 @@
+package quic
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/transport"
+)
+
+var serverTLSConfig *tls.Config
+
+var testDialer *Dialer
+var testLauncher *Launcher
+
+func init() {
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+
+	crt, err := tls.LoadX509KeyPair(filepath.Join(wd, "../../example.com+2.pem"), filepath.Join(wd, "../../example.com+2-key.pem"))
+	if err != nil {
+		panic(err)
+	}
+
+	serverTLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{crt},
+	}
+
+	testDialer = newTestDialer()
+
+	testLauncher = NewLauncher(nil)
+	testLauncher.TLSConfig = serverTLSConfig
+}
+
+// returns a dialer that accepts the test certificate
+func newTestDialer() *Dialer {
+	dialer := NewDialer(nil)
+	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	return dialer
+}
+
+func getURL(s transport.Server) string {
+	return fmt.Sprintf("quic://%s", s.Addr().String())
+}
+
+func safeReceive(ch chan struct{}) {
+	select {
+	case <-time.After(1 * time.Minute):
+		panic("nothing received")
+	case <-ch:
+	}
+}
@@ -0,0 +1,368 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+)
+
+// ErrSendQueueFull is returned by TrySend if the packet cannot be queued
+// without blocking.
+var ErrSendQueueFull = errors.New("send queue full")
+
+// A SchedulerConfig configures the send scheduler of a BaseConn.
+type SchedulerConfig struct {
+	// The maximum number of queued priority packets.
+	//
+	// Will default to 64.
+	PriorityQueue int
+
+	// The maximum number of queued bulk packets.
+	//
+	// Will default to 256.
+	BulkQueue int
+
+	// The function that decides whether a packet is sent with priority.
+	// Bulk packets are always sent in the order they have been queued.
+	//
+	// Will default to all packets except PUBLISH and DISCONNECT packets.
+	Priority func(packet.Generic) bool
+
+	// The maximum time Close waits for queued packets to be written. The
+	// underlying connection is closed afterwards and the remaining packets are
+	// failed.
+	//
+	// Will default to 5 seconds.
+	CloseTimeout time.Duration
+}
+
+// DefaultPriority returns true for all control and acknowledgement packets.
+// PUBLISH packets are not prioritized to keep their order and DISCONNECT
+// packets are not prioritized to not overtake queued PUBLISH packets.
+func DefaultPriority(pkt packet.Generic) bool {
+	switch pkt.Type() {
+	case packet.PUBLISH, packet.DISCONNECT:
+		return false
+	}
+
+	return true
+}
+
+type sendItem struct {
+	pkt    packet.Generic
+	async  bool
+	result chan error
+}
+
+// sendScheduler queues packets and writes them from a single goroutine. Queued
+// priority packets are always written before queued bulk packets.
+type sendScheduler struct {
+	queued     int64
+	conn       *BaseConn
+	priority   chan *sendItem
+	bulk       chan *sendItem
+	prioritize func(packet.Generic) bool
+	timeout    time.Duration
+
+	closed  bool
+	closing chan struct{}
+	mutex   sync.RWMutex
+
+	done     chan struct{}
+	err      error
+	errMutex sync.Mutex
+}
+
+func newSendScheduler(conn *BaseConn, config SchedulerConfig) *sendScheduler {
+	// set defaults
+	if config.PriorityQueue <= 0 {
+		config.PriorityQueue = 64
+	}
+	if config.BulkQueue <= 0 {
+		config.BulkQueue = 256
+	}
+	if config.Priority == nil {
+		config.Priority = DefaultPriority
+	}
+	if config.CloseTimeout <= 0 {
+		config.CloseTimeout = 5 * time.Second
+	}
+
+	// prepare scheduler
+	s := &sendScheduler{
+		conn:       conn,
+		priority:   make(chan *sendItem, config.PriorityQueue),
+		bulk:       make(chan *sendItem, config.BulkQueue),
+		prioritize: config.Priority,
+		timeout:    config.CloseTimeout,
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	// run writer
+	go s.writer()
+
+	return s
+}
+
+func (s *sendScheduler) send(pkt packet.Generic, async, try bool) error {
+	// acquire read lock
+	s.mutex.RLock()
+
+	// check state
+	if s.closed {
+		s.mutex.RUnlock()
+		return net.ErrClosed
+	}
+
+	// prepare item
+	item := &sendItem{
+		pkt:   pkt,
+		async: async,
+	}
+	if !async {
+		item.result = make(chan error, 1)
+	}
+
+	// select queue
+	queue := s.bulk
+	if s.prioritize(pkt) {
+		queue = s.priority
+	}
+
+	// count packet before it becomes visible to the writer
+	atomic.AddInt64(&s.queued, int64(pkt.Len()))
+
+	// queue item
+	var err error
+	if try {
+		select {
+		case queue <- item:
+		case <-s.done:
+			err = s.failure()
+		default:
+			err = ErrSendQueueFull
+		}
+	} else {
+		select {
+		case queue <- item:
+		case <-s.done:
+			err = s.failure()
+		}
+	}
+
+	// release read lock
+	s.mutex.RUnlock()
+
+	// handle error
+	if err != nil {
+		atomic.AddInt64(&s.queued, -int64(pkt.Len()))
+		return err
+	}
+
+	// return async items immediately
+	if async {
+		return nil
+	}
+
+	// wait for result
+	select {
+	case err = <-item.result:
+		return err
+	case <-s.done:
+		// prefer result if available
+		select {
+		case err = <-item.result:
+			return err
+		default:
+			return s.failure()
+		}
+	}
+}
+
+func (s *sendScheduler) close() error {
+	// close carrier if the queue cannot be written in time to unblock a
+	// stalled write, the writer will then fail the remaining items
+	timer := time.AfterFunc(s.timeout, func() {
+		_ = s.conn.carrier.Close()
+	})
+	defer timer.Stop()
+
+	// set flag and wake up writer
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.closing)
+	}
+	s.mutex.Unlock()
+
+	// wait for writer
+	<-s.done
+
+	// get error
+	s.errMutex.Lock()
+	err := s.err
+	s.errMutex.Unlock()
+
+	// ignore close error
+	if err == net.ErrClosed {
+		return nil
+	}
+
+	return err
+}
+
+func (s *sendScheduler) failure() error {
+	s.errMutex.Lock()
+	defer s.errMutex.Unlock()
+
+	if s.err == nil {
+		return net.ErrClosed
+	}
+
+	return s.err
+}
+
+func (s *sendScheduler) next(wait bool) *sendItem {
+	// prefer priority items
+	select {
+	case item := <-s.priority:
+		return item
+	default:
+	}
+
+	// get any item without waiting
+	if !wait {
+		select {
+		case item := <-s.priority:
+			return item
+		case item := <-s.bulk:
+			return item
+		default:
+			return nil
+		}
+	}
+
+	// wait for any item or close
+	select {
+	case item := <-s.priority:
+		return item
+	case item := <-s.bulk:
+		return item
+	case <-s.closing:
+		return nil
+	}
+}
+
+func (s *sendScheduler) writer() {
+	// prepare flag
+	closing := false
+
+	for {
+		// get next item
+		item := s.next(!closing)
+		if item == nil && !closing {
+			// drain remaining items before closing
+			closing = true
+			continue
+		} else if item == nil {
+			break
+		}
+
+		// write item
+		err := s.conn.write(item.pkt, item.async)
+		atomic.AddInt64(&s.queued, -int64(item.pkt.Len()))
+
+		// return result
+		if item.result != nil {
+			item.result <- err
+		}
+
+		// handle error
+		if err != nil {
+			s.stop(err)
+			return
+		}
+	}
+
+	// flush buffer
+	err := s.conn.stream.Flush()
+	if err != nil {
+		s.stop(err)
+		return
+	}
+
+	s.stop(net.ErrClosed)
+}
+
+func (s *sendScheduler) stop(err error) {
+	// set error
+	s.errMutex.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.errMutex.Unlock()
+
+	// signal termination
+	close(s.done)
+
+	// fail remaining items
+	for {
+		select {
+		case item := <-s.priority:
+			s.discard(item, err)
+		case item := <-s.bulk:
+			s.discard(item, err)
+		default:
+			return
+		}
+	}
+}
+
+func (s *sendScheduler) discard(item *sendItem, err error) {
+	atomic.AddInt64(&s.queued, -int64(item.pkt.Len()))
+
+	if item.result != nil {
+		item.result <- err
+	}
+}
+
+// ScheduledServer wraps a Server and enables the send scheduler for all
+// accepted connections that support it.
+type ScheduledServer struct {
+	Server
+
+	config SchedulerConfig
+}
+
+// NewScheduledServer wraps the provided server.
+func NewScheduledServer(server Server, config SchedulerConfig) *ScheduledServer {
+	return &ScheduledServer{
+		Server: server,
+		config: config,
+	}
+}
+
+// Accept will accept the next connection from the underlying server and
+// enable its send scheduler.
+func (s *ScheduledServer) Accept() (Conn, error) {
+	// accept connection
+	conn, err := s.Server.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// enable scheduler of the first supporting connection
+	for c := conn; c != nil; c = Unwrap(c) {
+		if sc, ok := c.(interface{ EnableScheduler(SchedulerConfig) }); ok {
+			sc.EnableScheduler(s.config)
+			break
+		}
+	}
+
+	return conn, nil
+}
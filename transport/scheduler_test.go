@@ -0,0 +1,284 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bigPublish(id packet.ID) *packet.Publish {
+	publish := packet.NewPublish()
+	publish.ID = id
+	publish.Message.Topic = "test"
+	publish.Message.Payload = make([]byte, 10000)
+	publish.Message.QOS = 1
+	return publish
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	pipe1, pipe2 := net.Pipe()
+
+	conn := NewNetConn(pipe1, 0)
+	conn.EnableScheduler(SchedulerConfig{})
+
+	peer := NewNetConn(pipe2, 0)
+
+	for i := 1; i <= 5; i++ {
+		err := conn.Send(bigPublish(packet.ID(i)), true)
+		assert.NoError(t, err)
+	}
+
+	puback := packet.NewPuback()
+	puback.ID = 42
+
+	err := conn.Send(puback, true)
+	assert.NoError(t, err)
+
+	var ids []packet.ID
+	ackIndex := -1
+	for i := 0; i < 6; i++ {
+		pkt, err := peer.Receive()
+		require.NoError(t, err)
+
+		switch pkt := pkt.(type) {
+		case *packet.Publish:
+			ids = append(ids, pkt.ID)
+		case *packet.Puback:
+			ackIndex = i
+		}
+	}
+
+	assert.Equal(t, []packet.ID{1, 2, 3, 4, 5}, ids)
+	assert.True(t, ackIndex >= 0 && ackIndex <= 1, "ack index %d", ackIndex)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	pkt, err := peer.Receive()
+	assert.Nil(t, pkt)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSchedulerTrySend(t *testing.T) {
+	pipe1, pipe2 := net.Pipe()
+
+	conn := NewNetConn(pipe1, 0)
+	conn.EnableScheduler(SchedulerConfig{
+		BulkQueue: 1,
+	})
+
+	peer := NewNetConn(pipe2, 0)
+
+	var sent int
+	var err error
+	for i := 1; i <= 5; i++ {
+		err = conn.TrySend(bigPublish(packet.ID(i)))
+		if err != nil {
+			break
+		}
+
+		sent++
+	}
+
+	assert.Equal(t, ErrSendQueueFull, err)
+	assert.True(t, sent >= 1 && sent <= 2, "sent %d", sent)
+	assert.True(t, conn.Stats().Buffered > 0)
+
+	err = conn.TrySend(packet.NewPingreq())
+	assert.NoError(t, err)
+
+	for i := 0; i < sent+1; i++ {
+		_, err := peer.Receive()
+		assert.NoError(t, err)
+	}
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(0), conn.Stats().Buffered)
+	assert.Equal(t, int64(sent+1), conn.Stats().Sent.Packets)
+}
+
+func TestSchedulerCloseFlushesQueue(t *testing.T) {
+	conn2, done := connectionPair("tcp", func(conn1 Conn) {
+		for i := 1; i <= 10; i++ {
+			pkt, err := conn1.Receive()
+			assert.NoError(t, err)
+			assert.Equal(t, packet.ID(i), pkt.(*packet.Publish).ID)
+		}
+
+		pkt, err := conn1.Receive()
+		assert.Nil(t, pkt)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	conn2.(*NetConn).EnableScheduler(SchedulerConfig{})
+
+	for i := 1; i <= 10; i++ {
+		err := conn2.Send(bigPublish(packet.ID(i)), true)
+		assert.NoError(t, err)
+	}
+
+	err := conn2.Close()
+	assert.NoError(t, err)
+
+	err = conn2.Send(packet.NewPingreq(), false)
+	assert.Equal(t, net.ErrClosed, err)
+
+	safeReceive(done)
+}
+
+func TestSchedulerSendError(t *testing.T) {
+	conn2, done := connectionPair("tcp", func(conn1 Conn) {
+		pkt, err := conn1.Receive()
+		assert.Nil(t, pkt)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	conn2.(*NetConn).EnableScheduler(SchedulerConfig{})
+
+	pkt := packet.NewConnack()
+	pkt.ReturnCode = 11 // < invalid return code
+
+	err := conn2.Send(pkt, false)
+	assert.Error(t, err)
+
+	err = conn2.Send(packet.NewPingreq(), false)
+	assert.Error(t, err)
+
+	safeReceive(done)
+}
+
+func TestScheduledServer(t *testing.T) {
+	server, err := testLauncher.Launch("tcp://localhost:0")
+	require.NoError(t, err)
+
+	scheduledServer := NewScheduledServer(server, SchedulerConfig{})
+
+	done := make(chan struct{})
+	go func() {
+		conn, err := scheduledServer.Accept()
+		require.NoError(t, err)
+		assert.NotNil(t, conn.(*NetConn).scheduler())
+
+		err = conn.Send(packet.NewConnack(), false)
+		assert.NoError(t, err)
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		close(done)
+	}()
+
+	conn, err := testDialer.Dial(getURL(server, "tcp"))
+	require.NoError(t, err)
+
+	conn.SetReadTimeout(time.Second)
+
+	pkt, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewConnack(), pkt)
+
+	safeReceive(done)
+
+	err = scheduledServer.Close()
+	assert.NoError(t, err)
+}
+
+func TestScheduledAccountingServer(t *testing.T) {
+	server, err := testLauncher.Launch("tcp://localhost:0")
+	require.NoError(t, err)
+
+	accountingServer := NewAccountingServer(NewFaultServer(server, FaultConfig{}))
+	scheduledServer := NewScheduledServer(accountingServer, SchedulerConfig{})
+
+	done := make(chan struct{})
+	go func() {
+		conn, err := scheduledServer.Accept()
+		require.NoError(t, err)
+
+		// find wrapped connection
+		faultConn, ok := Unwrap(conn).(*FaultConn)
+		require.True(t, ok)
+		netConn, ok := Unwrap(faultConn).(*NetConn)
+		require.True(t, ok)
+		assert.Nil(t, Unwrap(netConn))
+		assert.NotNil(t, netConn.scheduler())
+
+		err = conn.Send(packet.NewConnack(), false)
+		assert.NoError(t, err)
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		close(done)
+	}()
+
+	conn, err := testDialer.Dial(getURL(server, "tcp"))
+	require.NoError(t, err)
+
+	conn.SetReadTimeout(time.Second)
+
+	pkt, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewConnack(), pkt)
+
+	safeReceive(done)
+
+	assert.Equal(t, 0, accountingServer.Active())
+	assert.Equal(t, int64(1), accountingServer.Stats().Sent.Packets)
+
+	err = scheduledServer.Close()
+	assert.NoError(t, err)
+}
+
+func TestSchedulerCloseStalledPeer(t *testing.T) {
+	pipe1, pipe2 := net.Pipe()
+	defer pipe2.Close()
+
+	conn := NewNetConn(pipe1, 0)
+	conn.EnableScheduler(SchedulerConfig{
+		BulkQueue:    1,
+		CloseTimeout: 50 * time.Millisecond,
+	})
+
+	// the peer never reads
+	err := conn.Send(bigPublish(1), true)
+	assert.NoError(t, err)
+
+	// block sender on the full queue
+	results := make(chan error, 3)
+	for i := 2; i <= 4; i++ {
+		go func(id packet.ID) {
+			results <- conn.Send(bigPublish(id), false)
+		}(packet.ID(i))
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- conn.Close()
+	}()
+
+	select {
+	case err = <-closed:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("close blocked")
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err = <-results:
+			assert.Error(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("send blocked")
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// peerCertificates returns the first verified certificate chain of the
+// provided connection if it is a TLS connection.
+func peerCertificates(conn net.Conn) []*x509.Certificate {
+	// unwrap sniffed connection
+	if sc, ok := conn.(*sniffConn); ok {
+		conn = sc.Conn
+	}
+
+	// check connection
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	// get connection state
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0]
+}
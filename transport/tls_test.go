@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// returns a client certificate with the provided common name signed by a
+// freshly generated certificate authority
+func clientCertificate(name string) (tls.Certificate, *x509.CertPool) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gomqtt test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		panic(err)
+	}
+
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name + ".example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		panic(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, pool
+}
+
+func abstractPeerCertificatesTest(t *testing.T, protocol string) {
+	crt, pool := clientCertificate("device1")
+
+	serverConfig := serverTLSConfig.Clone()
+	serverConfig.ClientCAs = pool
+	serverConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+	launcher := NewLauncher()
+	launcher.TLSConfig = serverConfig
+
+	server, err := launcher.Launch(protocol + "://localhost:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+
+	go func() {
+		conn, err := server.Accept()
+		require.NoError(t, err)
+
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.CONNECT, pkt.Type())
+
+		chain := conn.PeerCertificates()
+		if assert.Len(t, chain, 2) {
+			assert.Equal(t, "device1", chain[0].Subject.CommonName)
+			assert.Equal(t, "gomqtt test ca", chain[1].Subject.CommonName)
+		}
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		close(done)
+	}()
+
+	dialer := NewDialer()
+	dialer.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{crt},
+	}
+
+	// multi servers are dialed using TLS
+	url := getURL(server, protocol)
+	if protocol == "multi" {
+		url = getURL(server, "tls")
+	}
+
+	conn, err := dialer.Dial(url)
+	require.NoError(t, err)
+	assert.NotEmpty(t, conn.PeerCertificates())
+
+	err = conn.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestTLSPeerCertificates(t *testing.T) {
+	abstractPeerCertificatesTest(t, "tls")
+}
+
+func TestWSSPeerCertificates(t *testing.T) {
+	abstractPeerCertificatesTest(t, "wss")
+}
+
+func TestMultiPeerCertificates(t *testing.T) {
+	abstractPeerCertificatesTest(t, "multi")
+}
+
+func TestPeerCertificatesWithoutTLS(t *testing.T) {
+	conn2, done := connectionPair("tcp", func(conn1 Conn) {
+		assert.Nil(t, conn1.PeerCertificates())
+
+		err := conn1.Close()
+		assert.NoError(t, err)
+	})
+
+	assert.Nil(t, conn2.PeerCertificates())
+
+	pkt, err := conn2.Receive()
+	assert.Nil(t, pkt)
+	assert.Error(t, err)
+
+	safeReceive(done)
+}
@@ -0,0 +1,309 @@
+package transport
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+)
+
+// A TrafficCount holds the number of packets and their encoded size in bytes.
+type TrafficCount struct {
+	Packets int64
+	Bytes   int64
+}
+
+// Add will add the other count.
+func (c *TrafficCount) Add(other TrafficCount) {
+	c.Packets += other.Packets
+	c.Bytes += other.Bytes
+}
+
+// TrafficStats is a snapshot of the traffic carried by one or more
+// connections. Bytes are counted using the encoded size of the packets and
+// do not include the overhead of the underlying protocol (e.g. TLS or
+// WebSocket framing).
+type TrafficStats struct {
+	// The total traffic in both directions.
+	Sent     TrafficCount
+	Received TrafficCount
+
+	// The traffic in both directions by packet type. Types without any
+	// traffic are omitted.
+	SentByType     map[packet.Type]TrafficCount
+	ReceivedByType map[packet.Type]TrafficCount
+
+	// The time the last packet has been received and sent.
+	LastRead  time.Time
+	LastWrite time.Time
+
+	// The number of bytes that have been sent but are still buffered and not
+	// yet written to the underlying connection.
+	Buffered int64
+}
+
+// Add will add the other stats. Counters are summed up while the latest
+// timestamps are kept.
+func (s *TrafficStats) Add(other TrafficStats) {
+	// add totals
+	s.Sent.Add(other.Sent)
+	s.Received.Add(other.Received)
+	s.Buffered += other.Buffered
+
+	// add types
+	s.SentByType = addTypes(s.SentByType, other.SentByType)
+	s.ReceivedByType = addTypes(s.ReceivedByType, other.ReceivedByType)
+
+	// keep latest timestamps
+	if other.LastRead.After(s.LastRead) {
+		s.LastRead = other.LastRead
+	}
+	if other.LastWrite.After(s.LastWrite) {
+		s.LastWrite = other.LastWrite
+	}
+}
+
+func addTypes(dst, src map[packet.Type]TrafficCount) map[packet.Type]TrafficCount {
+	for typ, count := range src {
+		if dst == nil {
+			dst = make(map[packet.Type]TrafficCount)
+		}
+
+		sum := dst[typ]
+		sum.Add(count)
+		dst[typ] = sum
+	}
+
+	return dst
+}
+
+// trafficCounter is updated atomically and must therefore stay 64-bit aligned.
+type trafficCounter struct {
+	packets int64
+	bytes   int64
+}
+
+// trafficMeter counts the traffic of a connection. All methods can be called
+// concurrently.
+type trafficMeter struct {
+	sent      [16]trafficCounter
+	received  [16]trafficCounter
+	lastRead  int64
+	lastWrite int64
+	written   int64
+}
+
+func newTrafficMeter() *trafficMeter {
+	return &trafficMeter{}
+}
+
+func (m *trafficMeter) countSent(pkt packet.Generic) {
+	// count packet
+	counter := &m.sent[pkt.Type()&0xF]
+	atomic.AddInt64(&counter.packets, 1)
+	atomic.AddInt64(&counter.bytes, int64(pkt.Len()))
+
+	// set timestamp
+	atomic.StoreInt64(&m.lastWrite, time.Now().UnixNano())
+}
+
+func (m *trafficMeter) countReceived(pkt packet.Generic) {
+	// count packet
+	counter := &m.received[pkt.Type()&0xF]
+	atomic.AddInt64(&counter.packets, 1)
+	atomic.AddInt64(&counter.bytes, int64(pkt.Len()))
+
+	// set timestamp
+	atomic.StoreInt64(&m.lastRead, time.Now().UnixNano())
+}
+
+func (m *trafficMeter) countWritten(n int) {
+	atomic.AddInt64(&m.written, int64(n))
+}
+
+// stats returns a snapshot of the counters. If buffered is set, the number of
+// buffered bytes is derived from the bytes written to the underlying
+// connection.
+func (m *trafficMeter) stats(buffered bool) TrafficStats {
+	// prepare stats
+	var stats TrafficStats
+	stats.SentByType = collectTypes(&m.sent, &stats.Sent)
+	stats.ReceivedByType = collectTypes(&m.received, &stats.Received)
+	stats.LastRead = unixNano(atomic.LoadInt64(&m.lastRead))
+	stats.LastWrite = unixNano(atomic.LoadInt64(&m.lastWrite))
+
+	// calculate buffered bytes
+	if buffered {
+		stats.Buffered = stats.Sent.Bytes - atomic.LoadInt64(&m.written)
+		if stats.Buffered < 0 {
+			stats.Buffered = 0
+		}
+	}
+
+	return stats
+}
+
+func collectTypes(counters *[16]trafficCounter, total *TrafficCount) map[packet.Type]TrafficCount {
+	types := make(map[packet.Type]TrafficCount)
+
+	for i := range counters {
+		// load counter
+		count := TrafficCount{
+			Packets: atomic.LoadInt64(&counters[i].packets),
+			Bytes:   atomic.LoadInt64(&counters[i].bytes),
+		}
+
+		// add count
+		if count.Packets > 0 {
+			types[packet.Type(i)] = count
+			total.Add(count)
+		}
+	}
+
+	return types
+}
+
+func unixNano(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos)
+}
+
+// meteredWriter counts the bytes written to the underlying writer.
+type meteredWriter struct {
+	writer io.Writer
+	meter  *trafficMeter
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.meter.countWritten(n)
+	return n, err
+}
+
+// The AccountingServer wraps a Server and aggregates the traffic of all
+// accepted connections. The traffic of closed connections is retained.
+type AccountingServer struct {
+	Server
+
+	active map[*accountedConn]struct{}
+	closed TrafficStats
+	mutex  sync.Mutex
+}
+
+// NewAccountingServer wraps the provided server.
+func NewAccountingServer(server Server) *AccountingServer {
+	return &AccountingServer{
+		Server: server,
+		active: make(map[*accountedConn]struct{}),
+	}
+}
+
+// Accept will accept the next connection from the underlying server and track
+// its traffic.
+func (s *AccountingServer) Accept() (Conn, error) {
+	// accept connection
+	conn, err := s.Server.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// wrap connection
+	ac := &accountedConn{
+		Conn:   conn,
+		server: s,
+	}
+
+	// add connection
+	s.mutex.Lock()
+	s.active[ac] = struct{}{}
+	s.mutex.Unlock()
+
+	return ac, nil
+}
+
+// Active returns the number of active connections.
+func (s *AccountingServer) Active() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.active)
+}
+
+// Stats returns the aggregated traffic of all active and closed connections.
+func (s *AccountingServer) Stats() TrafficStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// add closed connections
+	var stats TrafficStats
+	stats.Add(s.closed)
+
+	// add active connections
+	for conn := range s.active {
+		stats.Add(conn.Stats())
+	}
+
+	return stats
+}
+
+func (s *AccountingServer) retire(conn *accountedConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// get stats without unflushed data
+	stats := conn.Stats()
+	stats.Buffered = 0
+
+	// move traffic to closed stats
+	delete(s.active, conn)
+	s.closed.Add(stats)
+}
+
+// accountedConn retires itself from the server once the connection has been
+// closed or failed.
+type accountedConn struct {
+	Conn
+
+	server *AccountingServer
+	once   sync.Once
+}
+
+func (c *accountedConn) Send(pkt packet.Generic, async bool) error {
+	err := c.Conn.Send(pkt, async)
+	if err != nil {
+		c.retire()
+	}
+
+	return err
+}
+
+func (c *accountedConn) Receive() (packet.Generic, error) {
+	pkt, err := c.Conn.Receive()
+	if err != nil {
+		c.retire()
+	}
+
+	return pkt, err
+}
+
+func (c *accountedConn) Close() error {
+	err := c.Conn.Close()
+	c.retire()
+
+	return err
+}
+
+func (c *accountedConn) Unwrap() Conn {
+	return c.Conn
+}
+
+func (c *accountedConn) retire() {
+	c.once.Do(func() {
+		c.server.retire(c)
+	})
+}
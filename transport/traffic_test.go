@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficStatsAdd(t *testing.T) {
+	now := time.Now()
+
+	stats := TrafficStats{
+		Sent: TrafficCount{Packets: 1, Bytes: 2},
+		SentByType: map[packet.Type]TrafficCount{
+			packet.CONNECT: {Packets: 1, Bytes: 2},
+		},
+		LastWrite: now,
+		Buffered:  2,
+	}
+
+	stats.Add(TrafficStats{
+		Sent:     TrafficCount{Packets: 2, Bytes: 4},
+		Received: TrafficCount{Packets: 1, Bytes: 2},
+		SentByType: map[packet.Type]TrafficCount{
+			packet.CONNECT: {Packets: 1, Bytes: 2},
+			packet.PINGREQ: {Packets: 1, Bytes: 2},
+		},
+		ReceivedByType: map[packet.Type]TrafficCount{
+			packet.CONNACK: {Packets: 1, Bytes: 2},
+		},
+		LastRead:  now,
+		LastWrite: now.Add(-time.Second),
+		Buffered:  1,
+	})
+
+	assert.Equal(t, TrafficStats{
+		Sent:     TrafficCount{Packets: 3, Bytes: 6},
+		Received: TrafficCount{Packets: 1, Bytes: 2},
+		SentByType: map[packet.Type]TrafficCount{
+			packet.CONNECT: {Packets: 2, Bytes: 4},
+			packet.PINGREQ: {Packets: 1, Bytes: 2},
+		},
+		ReceivedByType: map[packet.Type]TrafficCount{
+			packet.CONNACK: {Packets: 1, Bytes: 2},
+		},
+		LastRead:  now,
+		LastWrite: now,
+		Buffered:  3,
+	}, stats)
+}
+
+func TestBaseConnStatsBuffered(t *testing.T) {
+	pipe1, pipe2 := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, pipe2)
+		close(done)
+	}()
+
+	conn := NewNetConn(pipe1, time.Hour)
+
+	err := conn.Send(packet.NewPingreq(), true)
+	assert.NoError(t, err)
+
+	stats := conn.Stats()
+	assert.Equal(t, TrafficCount{Packets: 1, Bytes: 2}, stats.Sent)
+	assert.Equal(t, int64(2), stats.Buffered)
+
+	err = conn.Send(packet.NewPingreq(), false)
+	assert.NoError(t, err)
+
+	stats = conn.Stats()
+	assert.Equal(t, TrafficCount{Packets: 2, Bytes: 4}, stats.Sent)
+	assert.Equal(t, int64(0), stats.Buffered)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
+
+func TestAccountingServer(t *testing.T) {
+	server, err := testLauncher.Launch("tcp://localhost:0")
+	require.NoError(t, err)
+
+	accountingServer := NewAccountingServer(server)
+
+	ready := make(chan struct{}, 2)
+	closed := make(chan struct{}, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := accountingServer.Accept()
+			require.NoError(t, err)
+
+			go func() {
+				pkt, err := conn.Receive()
+				assert.NoError(t, err)
+				assert.Equal(t, packet.NewPingreq(), pkt)
+
+				err = conn.Send(packet.NewPingresp(), false)
+				assert.NoError(t, err)
+
+				ready <- struct{}{}
+
+				pkt, err = conn.Receive()
+				assert.Nil(t, pkt)
+				assert.Equal(t, io.EOF, err)
+
+				closed <- struct{}{}
+			}()
+		}
+	}()
+
+	var conns []Conn
+	for i := 0; i < 2; i++ {
+		conn, err := testDialer.Dial(getURL(server, "tcp"))
+		require.NoError(t, err)
+
+		err = conn.Send(packet.NewPingreq(), false)
+		assert.NoError(t, err)
+
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.NewPingresp(), pkt)
+
+		conns = append(conns, conn)
+	}
+
+	<-ready
+	<-ready
+
+	assert.Equal(t, 2, accountingServer.Active())
+
+	stats := accountingServer.Stats()
+	assert.Equal(t, TrafficCount{Packets: 2, Bytes: 4}, stats.Sent)
+	assert.Equal(t, TrafficCount{Packets: 2, Bytes: 4}, stats.Received)
+	assert.Equal(t, map[packet.Type]TrafficCount{
+		packet.PINGRESP: {Packets: 2, Bytes: 4},
+	}, stats.SentByType)
+	assert.Equal(t, map[packet.Type]TrafficCount{
+		packet.PINGREQ: {Packets: 2, Bytes: 4},
+	}, stats.ReceivedByType)
+
+	for _, conn := range conns {
+		err = conn.Close()
+		assert.NoError(t, err)
+	}
+
+	<-closed
+	<-closed
+
+	assert.Equal(t, 0, accountingServer.Active())
+
+	closedStats := accountingServer.Stats()
+	assert.Equal(t, stats.Sent, closedStats.Sent)
+	assert.Equal(t, stats.Received, closedStats.Received)
+	assert.Equal(t, stats.SentByType, closedStats.SentByType)
+	assert.Equal(t, stats.ReceivedByType, closedStats.ReceivedByType)
+
+	err = accountingServer.Close()
+	assert.NoError(t, err)
+}
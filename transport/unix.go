@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+)
+
+// ErrNoPeerCredentials is returned by NetConn.PeerCredentials if the
+// connection is not a Unix socket connection or the platform does not support
+// retrieving the credentials of the peer.
+var ErrNoPeerCredentials = errors.New("peer credentials not available")
+
+// PeerCredentials are the credentials of the process on the other end of a
+// Unix socket connection.
+type PeerCredentials struct {
+	UID int
+	GID int
+	PID int
+}
+
+// CreateUnixServer creates a new Unix socket server that listens on the
+// provided path. A stale socket file left behind by a crashed process is
+// removed. If mode is not zero it is applied to the socket file, otherwise the
+// mode derived from the umask is used. If uid or gid is not -1 the socket file
+// is changed to the specified owner. The socket file is not accessible by other
+// users until the mode and owner have been applied.
+func CreateUnixServer(path string, mode os.FileMode, uid, gid int) (*NetServer, error) {
+	// remove stale socket
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// create listener
+	listener, defaultMode, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// apply owner
+	if uid != -1 || gid != -1 {
+		err = os.Chown(path, uid, gid)
+		if err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+
+	// apply mode
+	if mode == 0 {
+		mode = defaultMode
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	return NewNetServer(listener), nil
+}
+
+// PeerCredentials returns the credentials of the peer process if the
+// connection is a Unix socket connection.
+func (c *NetConn) PeerCredentials() (*PeerCredentials, error) {
+	// check connection
+	unixConn, ok := c.conn.(*net.UnixConn)
+	if !ok {
+		return nil, ErrNoPeerCredentials
+	}
+
+	return peerCredentials(unixConn)
+}
+
+func removeStaleSocket(path string) error {
+	// check file
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// leave other files alone
+	if info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	// check if socket is still in use
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return nil
+	}
+
+	// remove socket
+	return os.Remove(path)
+}
+
+func ownerID(id *int) int {
+	if id == nil {
+		return -1
+	}
+
+	return *id
+}
+
+func unixPath(urlParts *url.URL) string {
+	// support absolute "unix:///path" and relative "unix://path" URLs
+	return urlParts.Host + urlParts.Path
+}
@@ -0,0 +1,32 @@
+package transport
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	// get raw connection
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	// read credentials
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	} else if credErr != nil {
+		return nil, credErr
+	}
+
+	return &PeerCredentials{
+		UID: int(cred.Uid),
+		GID: int(cred.Gid),
+		PID: int(cred.Pid),
+	}, nil
+}
@@ -0,0 +1,26 @@
+//go:build !unix
+// +build !unix
+
+package transport
+
+import (
+	"net"
+	"os"
+)
+
+func listenUnix(path string) (net.Listener, os.FileMode, error) {
+	// create socket
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// get mode
+	info, err := os.Stat(path)
+	if err != nil {
+		_ = listener.Close()
+		return nil, 0, err
+	}
+
+	return listener, info.Mode().Perm(), nil
+}
@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "broker.sock")
+
+	launcher := NewLauncher()
+	launcher.UnixSocketMode = 0600
+
+	server, err := launcher.Launch("unix://" + path)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	wait := make(chan struct{})
+
+	go func() {
+		conn1, err := server.Accept()
+		require.NoError(t, err)
+
+		if runtime.GOOS == "linux" {
+			cred, err := conn1.(*NetConn).PeerCredentials()
+			assert.NoError(t, err)
+			assert.Equal(t, &PeerCredentials{
+				UID: os.Getuid(),
+				GID: os.Getgid(),
+				PID: os.Getpid(),
+			}, cred)
+		}
+
+		pkt, err := conn1.Receive()
+		assert.Equal(t, pkt.Type(), packet.CONNECT)
+		assert.NoError(t, err)
+
+		err = conn1.Send(packet.NewConnack(), false)
+		assert.NoError(t, err)
+
+		close(wait)
+	}()
+
+	conn2, err := testDialer.Dial("unix://" + path)
+	require.NoError(t, err)
+
+	err = conn2.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	pkt, err := conn2.Receive()
+	assert.Equal(t, pkt.Type(), packet.CONNACK)
+	assert.NoError(t, err)
+
+	safeReceive(wait)
+
+	err = conn2.Close()
+	assert.NoError(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnixServerStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "broker.sock")
+
+	// leave socket file behind
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, listener.Close())
+
+	server, err := CreateUnixServer(path, 0, -1, -1)
+	require.NoError(t, err)
+
+	// socket in use
+	_, err = CreateUnixServer(path, 0, -1, -1)
+	assert.Error(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestUnixServerOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "broker.sock")
+
+	// the current ids are zero if running as root
+	uid := os.Getuid()
+	gid := os.Getgid()
+
+	launcher := NewLauncher()
+	launcher.UnixSocketMode = 0660
+	launcher.UnixSocketUID = &uid
+	launcher.UnixSocketGID = &gid
+
+	server, err := launcher.Launch("unix://" + path)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestPeerCredentialsWithoutUnix(t *testing.T) {
+	conn2, done := connectionPair("tcp", func(conn1 Conn) {
+		cred, err := conn1.(*NetConn).PeerCredentials()
+		assert.Nil(t, cred)
+		assert.Equal(t, ErrNoPeerCredentials, err)
+
+		err = conn1.Close()
+		assert.NoError(t, err)
+	})
+
+	pkt, err := conn2.Receive()
+	assert.Nil(t, pkt)
+	assert.Error(t, err)
+
+	safeReceive(done)
+}
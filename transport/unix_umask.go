@@ -0,0 +1,29 @@
+//go:build unix
+// +build unix
+
+package transport
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var umaskMutex sync.Mutex
+
+func listenUnix(path string) (net.Listener, os.FileMode, error) {
+	// acquire mutex
+	umaskMutex.Lock()
+	defer umaskMutex.Unlock()
+
+	// create socket without permissions
+	umask := syscall.Umask(0777)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return listener, os.FileMode(0777 &^ umask), nil
+}
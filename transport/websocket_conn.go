@@ -1,9 +1,13 @@
 package transport
 
 import (
+	"compress/flate"
+	"crypto/x509"
 	"errors"
 	"io"
 	"net"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,9 +17,45 @@ import (
 // received that is not binary.
 var ErrNotBinary = errors.New("received web socket message is not binary")
 
+// WebSocketCompression configures the permessage-deflate extension. Only the
+// "no context takeover" mode is supported. The server_no_context_takeover and
+// client_no_context_takeover parameters are always negotiated and every
+// message is compressed and decompressed independently, as the underlying
+// WebSocket implementation does not support retaining the compression context
+// between messages.
+type WebSocketCompression struct {
+	// The compression level from flate.HuffmanOnly (-2) to
+	// flate.BestCompression (9).
+	//
+	// Will default to flate.BestSpeed (1).
+	Level int
+
+	// The minimum size of a message to be compressed. Smaller messages are
+	// sent uncompressed as compression would only add overhead.
+	//
+	// Will default to 128 bytes.
+	Threshold int
+}
+
+// negotiatedCompression returns whether the permessage-deflate extension is
+// present in the provided headers.
+func negotiatedCompression(header http.Header) bool {
+	for _, value := range header["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(value, ",") {
+			name := strings.TrimSpace(strings.Split(ext, ";")[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 type wsStream struct {
-	conn   *websocket.Conn
-	reader io.Reader
+	conn      *websocket.Conn
+	reader    io.Reader
+	threshold int
 }
 
 func (s *wsStream) Read(p []byte) (int, error) {
@@ -58,6 +98,11 @@ func (s *wsStream) Read(p []byte) (int, error) {
 }
 
 func (s *wsStream) Write(p []byte) (n int, err error) {
+	// only compress big enough messages
+	if s.threshold > 0 {
+		s.conn.EnableWriteCompression(len(p) >= s.threshold)
+	}
+
 	// create writer if missing
 	writer, err := s.conn.NextWriter(websocket.BinaryMessage)
 	if err != nil {
@@ -99,27 +144,98 @@ func (s *wsStream) SetReadDeadline(t time.Time) error {
 type WebSocketConn struct {
 	*BaseConn
 
-	conn *websocket.Conn
+	conn       *websocket.Conn
+	stream     *wsStream
+	remoteAddr net.Addr
+	request    *http.Request
+	compressed bool
 }
 
 // NewWebSocketConn returns a new WebSocketConn.
 func NewWebSocketConn(conn *websocket.Conn, maxWriteDelay time.Duration) *WebSocketConn {
+	// prepare stream
+	stream := &wsStream{conn: conn}
+
 	return &WebSocketConn{
-		BaseConn: NewBaseConn(&wsStream{conn: conn}, maxWriteDelay),
+		BaseConn: NewBaseConn(stream, maxWriteDelay),
 		conn:     conn,
+		stream:   stream,
 	}
 }
 
+func (c *WebSocketConn) enableCompression(config *WebSocketCompression) error {
+	// get level
+	level := config.Level
+	if level == 0 {
+		level = flate.BestSpeed
+	}
+
+	// set level
+	err := c.conn.SetCompressionLevel(level)
+	if err != nil {
+		return err
+	}
+
+	// get threshold
+	threshold := config.Threshold
+	if threshold <= 0 {
+		threshold = 128
+	}
+
+	// set threshold and flag
+	c.stream.threshold = threshold
+	c.compressed = true
+
+	return nil
+}
+
 // LocalAddr returns the local network address.
 func (c *WebSocketConn) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
 }
 
-// RemoteAddr returns the remote network address.
+// RemoteAddr returns the remote network address. If the connection has been
+// accepted from a trusted proxy, the address of the client reported by the
+// proxy is returned.
 func (c *WebSocketConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
 	return c.conn.RemoteAddr()
 }
 
+// PeerCertificates returns the verified certificate chain of the peer if the
+// connection is secured by TLS.
+func (c *WebSocketConn) PeerCertificates() []*x509.Certificate {
+	return peerCertificates(c.conn.UnderlyingConn())
+}
+
+// Request returns the upgrade request of a connection accepted by a
+// WebSocketServer or WebSocketHandler. It returns nil for dialed connections.
+// The request body must not be read.
+func (c *WebSocketConn) Request() *http.Request {
+	return c.request
+}
+
+// ProxyHeader returns the PROXY protocol header sent by the proxy if the
+// connection has been accepted by a server with a proxy policy.
+func (c *WebSocketConn) ProxyHeader() *ProxyHeader {
+	return proxyHeader(c.conn.UnderlyingConn())
+}
+
+// Subprotocol returns the negotiated subprotocol or an empty string if no
+// subprotocol has been negotiated.
+func (c *WebSocketConn) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+// Compressed returns whether the permessage-deflate extension has been
+// negotiated for the connection.
+func (c *WebSocketConn) Compressed() bool {
+	return c.compressed
+}
+
 // UnderlyingConn returns the underlying websocket.Conn.
 func (c *WebSocketConn) UnderlyingConn() *websocket.Conn {
 	return c.conn
@@ -1,13 +1,17 @@
 package transport
 
 import (
+	"bytes"
 	"io"
+	"net"
+	"sync/atomic"
 	"testing"
 
 	"github.com/qingcloudhx/gomqtt/packet"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWebSocketConnConnection(t *testing.T) {
@@ -74,6 +78,10 @@ func TestWebSocketConnBigAsyncSendAfterClose(t *testing.T) {
 	abstractConnBigAsyncSendAfterCloseTest(t, "ws")
 }
 
+func TestWebSocketConnStats(t *testing.T) {
+	abstractConnStatsTest(t, "ws")
+}
+
 func TestWebSocketBadFrameError(t *testing.T) {
 	conn2, done := connectionPair("ws", func(conn1 Conn) {
 		buf := []byte{0x07, 0x00, 0x00, 0x00, 0x00} // < bad frame
@@ -171,6 +179,164 @@ func TestWebSocketNotBinaryMessage(t *testing.T) {
 	safeReceive(done)
 }
 
+type countingListener struct {
+	net.Listener
+
+	read int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingConn{Conn: conn, read: &l.read}, nil
+}
+
+type countingConn struct {
+	net.Conn
+
+	read *int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func webSocketCompressionTest(t *testing.T, serverConfig, clientConfig *WebSocketCompression, compressed bool) int64 {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	counter := &countingListener{Listener: listener}
+
+	server := NewWebSocketServer(counter)
+	server.SetCompression(serverConfig)
+
+	pkt := packet.NewPublish()
+	pkt.Message.Topic = "hello"
+	pkt.Message.Payload = bytes.Repeat([]byte(`{"temperature":21.5}`), 500)
+
+	done := make(chan struct{})
+	go func() {
+		conn, err := server.Accept()
+		require.NoError(t, err)
+		assert.Equal(t, compressed, conn.(*WebSocketConn).Compressed())
+
+		in, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, pkt.String(), in.String())
+
+		in, err = conn.Receive()
+		assert.Nil(t, in)
+		assert.Equal(t, io.EOF, err)
+
+		close(done)
+	}()
+
+	dialer := NewDialer()
+	dialer.Compression = clientConfig
+
+	conn, err := dialer.Dial(getURL(server, "ws"))
+	require.NoError(t, err)
+	assert.Equal(t, compressed, conn.(*WebSocketConn).Compressed())
+
+	err = conn.Send(pkt, false)
+	assert.NoError(t, err)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	err = server.Close()
+	assert.NoError(t, err)
+
+	return atomic.LoadInt64(&counter.read)
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	plain := webSocketCompressionTest(t, nil, nil, false)
+	assert.True(t, plain > 10000)
+
+	compressed := webSocketCompressionTest(t, &WebSocketCompression{}, &WebSocketCompression{}, true)
+	assert.True(t, compressed < 2000)
+
+	uncompressed := webSocketCompressionTest(t, &WebSocketCompression{}, &WebSocketCompression{
+		Threshold: 20000,
+	}, true)
+	assert.True(t, uncompressed > 10000)
+
+	onlyClient := webSocketCompressionTest(t, nil, &WebSocketCompression{}, false)
+	assert.True(t, onlyClient > 10000)
+
+	onlyServer := webSocketCompressionTest(t, &WebSocketCompression{}, nil, false)
+	assert.True(t, onlyServer > 10000)
+}
+
+func TestWebSocketCompressionInvalidLevel(t *testing.T) {
+	server, err := testLauncher.Launch("ws://localhost:0")
+	require.NoError(t, err)
+
+	server.(*WebSocketServer).SetCompression(&WebSocketCompression{})
+
+	dialer := NewDialer()
+	dialer.Compression = &WebSocketCompression{Level: 42}
+
+	conn, err := dialer.Dial(getURL(server, "ws"))
+	assert.Nil(t, conn)
+	assert.Error(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestWebSocketSubprotocol(t *testing.T) {
+	table := []struct {
+		requested []string
+		selected  string
+	}{
+		{nil, "mqtt"},
+		{[]string{"mqttv3.1"}, "mqttv3.1"},
+		{[]string{"foo", "mqttv3.1", "mqtt"}, "mqtt"}, // < server preference
+		{[]string{"foo"}, ""},
+	}
+
+	for _, item := range table {
+		server, err := testLauncher.Launch("ws://localhost:0")
+		require.NoError(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			conn, err := server.Accept()
+			require.NoError(t, err)
+			assert.Equal(t, item.selected, conn.(*WebSocketConn).Subprotocol())
+
+			err = conn.Close()
+			assert.NoError(t, err)
+
+			close(done)
+		}()
+
+		dialer := NewDialer()
+		dialer.Subprotocols = item.requested
+
+		conn, err := dialer.Dial(getURL(server, "ws"))
+		require.NoError(t, err)
+		assert.Equal(t, item.selected, conn.(*WebSocketConn).Subprotocol())
+
+		safeReceive(done)
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		err = server.Close()
+		assert.NoError(t, err)
+	}
+}
+
 func BenchmarkWebSocketConn(b *testing.B) {
 	pkt := packet.NewPublish()
 	pkt.Message.Topic = "foo/bar/baz"
@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type handlerAddr struct{}
+
+func (handlerAddr) Network() string { return "http" }
+func (handlerAddr) String() string  { return "http handler" }
+
+// The WebSocketHandler is a http.Handler that upgrades requests to WebSocket
+// connections. It implements the Server interface and can be mounted on any
+// path of an existing HTTP server while the connections are accepted e.g. by
+// a broker.Engine.
+type WebSocketHandler struct {
+	MaxWriteDelay time.Duration
+
+	upgrader      *websocket.Upgrader
+	incoming      chan *WebSocketConn
+	closed        chan struct{}
+	once          sync.Once
+	fallback      http.Handler
+	originChecker func(r *http.Request) bool
+	proxyPolicy   *ProxyPolicy
+	compression   *WebSocketCompression
+}
+
+// NewWebSocketHandler returns a new WebSocketHandler.
+func NewWebSocketHandler() *WebSocketHandler {
+	// create handler
+	h := &WebSocketHandler{
+		upgrader: &websocket.Upgrader{
+			HandshakeTimeout: 60 * time.Second,
+			Subprotocols:     []string{"mqtt", "mqttv3.1"},
+		},
+		incoming: make(chan *WebSocketConn),
+		closed:   make(chan struct{}),
+	}
+
+	// add check origin method that uses the optional check origin function
+	h.upgrader.CheckOrigin = func(r *http.Request) bool {
+		if h.originChecker != nil {
+			return h.originChecker(r)
+		}
+
+		return true
+	}
+
+	return h
+}
+
+// SetFallback will register a http.Handler that gets called if a request is not
+// a WebSocket upgrade request.
+func (h *WebSocketHandler) SetFallback(handler http.Handler) {
+	h.fallback = handler
+}
+
+// SetOriginChecker sets an optional function that allows check the request origin
+// before accepting the connection.
+func (h *WebSocketHandler) SetOriginChecker(fn func(r *http.Request) bool) {
+	h.originChecker = fn
+}
+
+// SetProxyPolicy sets an optional policy that allows trusted proxies to report
+// the address of the client using the Forwarded or X-Forwarded-For header.
+func (h *WebSocketHandler) SetProxyPolicy(policy *ProxyPolicy) {
+	h.proxyPolicy = policy
+}
+
+// SetCompression enables the permessage-deflate extension for clients that
+// request it. Compression is disabled if the config is nil.
+func (h *WebSocketHandler) SetCompression(config *WebSocketCompression) {
+	h.compression = config
+	h.upgrader.EnableCompression = config != nil
+}
+
+// ServeHTTP will upgrade the request and queue the connection until it is
+// accepted.
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, h.MaxWriteDelay)
+}
+
+func (h *WebSocketHandler) serve(w http.ResponseWriter, r *http.Request, maxWriteDelay time.Duration) {
+	// ensure write delay default
+	if maxWriteDelay == 0 {
+		maxWriteDelay = 10 * time.Millisecond
+	}
+
+	// run fallback if request is not an upgrade
+	if r.Header.Get("Upgrade") != "websocket" && h.fallback != nil {
+		h.fallback.ServeHTTP(w, r)
+		return
+	}
+
+	// reject request if closed
+	select {
+	case <-h.closed:
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	// run WebSocket upgrader
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgrader already responded to request
+		return
+	}
+
+	// create connection
+	webSocketConn := NewWebSocketConn(conn, maxWriteDelay)
+	webSocketConn.request = r
+
+	// configure compression if negotiated
+	if h.compression != nil && negotiatedCompression(r.Header) {
+		err = webSocketConn.enableCompression(h.compression)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+
+	// use forwarded address if available
+	if h.proxyPolicy != nil {
+		webSocketConn.remoteAddr = h.proxyPolicy.ForwardedAddr(r)
+	}
+
+	select {
+	case h.incoming <- webSocketConn:
+	case <-h.closed:
+		_ = webSocketConn.Close()
+	}
+}
+
+// Accept will return the next available connection or block until a
+// connection becomes available, otherwise returns an Error.
+func (h *WebSocketHandler) Accept() (Conn, error) {
+	select {
+	case <-h.closed:
+		return nil, ErrAcceptAfterClose
+	case conn := <-h.incoming:
+		return conn, nil
+	}
+}
+
+// Close will stop accepting connections. Later upgrade requests are rejected
+// while the handler remains mounted.
+func (h *WebSocketHandler) Close() error {
+	h.once.Do(func() {
+		close(h.closed)
+	})
+
+	return nil
+}
+
+// Addr returns a placeholder address as the handler is not bound to a
+// listener.
+func (h *WebSocketHandler) Addr() net.Addr {
+	return handlerAddr{}
+}
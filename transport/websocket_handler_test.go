@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qingcloudhx/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocketHandler(t *testing.T) {
+	handler := NewWebSocketHandler()
+
+	mux := http.NewServeMux()
+	mux.Handle("/app/mqtt", handler)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		conn, err := handler.Accept()
+		require.NoError(t, err)
+
+		req := conn.(*WebSocketConn).Request()
+		if assert.NotNil(t, req) {
+			assert.Equal(t, "/app/mqtt", req.URL.Path)
+			assert.Equal(t, "bar", req.URL.Query().Get("foo"))
+
+			cookie, err := req.Cookie("session")
+			assert.NoError(t, err)
+			assert.Equal(t, "secret", cookie.Value)
+		}
+
+		pkt, err := conn.Receive()
+		assert.Equal(t, pkt.Type(), packet.CONNECT)
+		assert.NoError(t, err)
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		close(done)
+	}()
+
+	dialer := NewDialer()
+	dialer.RequestHeader = http.Header{
+		"Cookie": []string{"session=secret"},
+	}
+
+	conn, err := dialer.Dial(strings.Replace(server.URL, "http://", "ws://", 1) + "/app/mqtt?foo=bar")
+	require.NoError(t, err)
+	assert.Nil(t, conn.(*WebSocketConn).Request())
+
+	err = conn.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+
+	// reject connections after close
+
+	err = handler.Close()
+	assert.NoError(t, err)
+
+	c, err := handler.Accept()
+	assert.Nil(t, c)
+	assert.Equal(t, ErrAcceptAfterClose, err)
+
+	conn, err = dialer.Dial(strings.Replace(server.URL, "http://", "ws://", 1) + "/app/mqtt")
+	assert.Nil(t, conn)
+	assert.Error(t, err)
+}
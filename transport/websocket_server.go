@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"gopkg.in/tomb.v2"
 )
 
@@ -17,12 +16,8 @@ var errManualClose = errors.New("internal: manual close")
 type WebSocketServer struct {
 	MaxWriteDelay time.Duration
 
-	listener      net.Listener
-	mux           *http.ServeMux
-	fallback      http.Handler
-	upgrader      *websocket.Upgrader
-	incoming      chan *WebSocketConn
-	originChecker func(r *http.Request) bool
+	listener net.Listener
+	handler  *WebSocketHandler
 
 	tomb tomb.Tomb
 }
@@ -32,20 +27,7 @@ func NewWebSocketServer(listener net.Listener) *WebSocketServer {
 	// create server
 	ws := &WebSocketServer{
 		listener: listener,
-		upgrader: &websocket.Upgrader{
-			HandshakeTimeout: 60 * time.Second,
-			Subprotocols:     []string{"mqtt", "mqttv3.1"},
-		},
-		incoming: make(chan *WebSocketConn),
-	}
-
-	// add check origin method that uses the optional check origin function
-	ws.upgrader.CheckOrigin = func(r *http.Request) bool {
-		if ws.originChecker != nil {
-			return ws.originChecker(r)
-		}
-
-		return true
+		handler:  NewWebSocketHandler(),
 	}
 
 	// create http server
@@ -55,7 +37,12 @@ func NewWebSocketServer(listener net.Listener) *WebSocketServer {
 
 	// serve http traffic in background
 	ws.tomb.Go(func() error {
-		return h.Serve(ws.listener)
+		err := h.Serve(ws.listener)
+
+		// reject pending connections
+		_ = ws.handler.Close()
+
+		return err
 	})
 
 	return ws
@@ -85,42 +72,29 @@ func CreateSecureWebSocketServer(address string, config *tls.Config) (*WebSocket
 // SetFallback will register a http.Handler that gets called if a request is not
 // a WebSocket upgrade request.
 func (s *WebSocketServer) SetFallback(handler http.Handler) {
-	s.fallback = handler
+	s.handler.SetFallback(handler)
 }
 
 // SetOriginChecker sets an optional function that allows check the request origin
 // before accepting the connection.
 func (s *WebSocketServer) SetOriginChecker(fn func(r *http.Request) bool) {
-	s.originChecker = fn
+	s.handler.SetOriginChecker(fn)
 }
 
-func (s *WebSocketServer) requestHandler(w http.ResponseWriter, r *http.Request) {
-	// ensure write delay default
-	if s.MaxWriteDelay == 0 {
-		s.MaxWriteDelay = 10 * time.Millisecond
-	}
-
-	// run fallback if request is not an upgrade
-	if r.Header.Get("Upgrade") != "websocket" && s.fallback != nil {
-		s.fallback.ServeHTTP(w, r)
-		return
-	}
-
-	// run WebSocket upgrader
-	conn, err := s.upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		// upgrader already responded to request
-		return
-	}
+// SetProxyPolicy sets an optional policy that allows trusted proxies to report
+// the address of the client using the Forwarded or X-Forwarded-For header.
+func (s *WebSocketServer) SetProxyPolicy(policy *ProxyPolicy) {
+	s.handler.SetProxyPolicy(policy)
+}
 
-	// create connection
-	webSocketConn := NewWebSocketConn(conn, s.MaxWriteDelay)
+// SetCompression enables the permessage-deflate extension for clients that
+// request it. Compression is disabled if the config is nil.
+func (s *WebSocketServer) SetCompression(config *WebSocketCompression) {
+	s.handler.SetCompression(config)
+}
 
-	select {
-	case s.incoming <- webSocketConn:
-	case <-s.tomb.Dying():
-		_ = webSocketConn.Close()
-	}
+func (s *WebSocketServer) requestHandler(w http.ResponseWriter, r *http.Request) {
+	s.handler.serve(w, r, s.MaxWriteDelay)
 }
 
 // Accept will return the next available connection or block until a
@@ -135,7 +109,7 @@ func (s *WebSocketServer) Accept() (Conn, error) {
 
 		// return the previously caught error
 		return nil, s.tomb.Err()
-	case conn := <-s.incoming:
+	case conn := <-s.handler.incoming:
 		return conn, nil
 	}
 }